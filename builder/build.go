@@ -4,6 +4,7 @@
 package builder
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -16,24 +17,54 @@ import (
 	"github.com/tinygo-org/tinygo/compiler"
 	"github.com/tinygo-org/tinygo/goenv"
 	"github.com/tinygo-org/tinygo/interp"
+	"github.com/tinygo-org/tinygo/loader"
 	"github.com/tinygo-org/tinygo/transform"
 )
 
+// BuildResult is the result of a build, which is passed to the action given to
+// Build.
+type BuildResult struct {
+	// Binary is the path to the output file (.elf, .hex, etc.) in a temporary
+	// directory. It is removed after the action returns.
+	Binary string
+
+	// Size is the size of the program. It is only loaded when it is needed:
+	// to print it, to check it against the flash and RAM size of the target or
+	// for the -json build-end event. Otherwise it is nil.
+	Size *SizeReport
+}
+
 // Build performs a single package to executable Go build. It takes in a package
 // name, an output path, and set of compile options and from that it manages the
 // whole compilation process.
 //
-// The error value may be of type *MultiError. Callers will likely want to check
-// for this case and print such errors individually.
-func Build(pkgName, outpath string, config *compileopts.Config, action func(string) error) error {
+// Errors that happen during the build are returned as a *StageError, which
+// wraps the actual error. That error may be of type *MultiError. Callers will
+// likely want to check for this case and print such errors individually.
+func Build(pkgName, outpath string, config *compileopts.Config, action func(BuildResult) error) (err error) {
+	// Keep track of the current build stage, so that errors can be attributed
+	// to it.
+	stage := StageCompiler
+	defer func() {
+		if err != nil && stage != "" {
+			err = &StageError{stage, err}
+		}
+	}()
+
 	c, err := compiler.NewCompiler(pkgName, config)
 	if err != nil {
 		return err
 	}
 
 	// Compile Go code to IR.
-	errs := c.Compile(pkgName)
+	cacheStats := &cacheStats{verbose: config.Options.PrintCommands}
+	errs := c.Compile(pkgName, newPackageCache(config.Triple(), cacheStats))
 	if len(errs) != 0 {
+		switch errs[0].(type) {
+		case loader.Errors, *loader.ImportCycleError:
+			// Parse or type check errors.
+			stage = StageLoader
+		}
 		return newMultiError(errs)
 	}
 	if config.Options.PrintIR {
@@ -44,6 +75,7 @@ func Build(pkgName, outpath string, config *compileopts.Config, action func(stri
 		return errors.New("verification error after IR construction")
 	}
 
+	stage = StageInterp
 	err = interp.Run(c.Module(), config.DumpSSA())
 	if err != nil {
 		return err
@@ -52,6 +84,7 @@ func Build(pkgName, outpath string, config *compileopts.Config, action func(stri
 		return errors.New("verification error after interpreting runtime.initAll")
 	}
 
+	stage = StageTransform
 	if config.GOOS() != "darwin" {
 		c.ApplyFunctionSections() // -ffunction-sections
 	}
@@ -92,6 +125,15 @@ func Build(pkgName, outpath string, config *compileopts.Config, action func(stri
 		return errors.New("verification failure after LLVM optimization passes")
 	}
 
+	// Determine the stack size of each goroutine. With automatic stack sizes,
+	// the final stack sizes are only known after linking.
+	if config.Scheduler() == "tasks" {
+		transform.CreateStackSizeLoads(c.Module(), config.StackSize(), config.AutomaticStackSize())
+		if err := c.Verify(); err != nil {
+			return errors.New("verification error after creating goroutine stack size loads")
+		}
+	}
+
 	// On the AVR, pointers can point either to flash or to RAM, but we don't
 	// know. As a temporary fix, load all global variables in RAM.
 	// In the future, there should be a compiler pass that determines which
@@ -105,6 +147,7 @@ func Build(pkgName, outpath string, config *compileopts.Config, action func(stri
 	}
 
 	// Generate output.
+	stage = StageCompiler
 	outext := filepath.Ext(outpath)
 	switch outext {
 	case ".o":
@@ -117,24 +160,57 @@ func Build(pkgName, outpath string, config *compileopts.Config, action func(stri
 		// Act as a compiler driver.
 
 		// Create a temporary directory for intermediary files.
+		// With -work, it is kept for inspection.
 		dir, err := ioutil.TempDir("", "tinygo")
 		if err != nil {
 			return err
 		}
-		defer os.RemoveAll(dir)
+		if config.Options.PrintCommands || config.Options.Work {
+			fmt.Fprintln(os.Stderr, "WORK="+dir)
+		}
+		if !config.Options.Work {
+			defer os.RemoveAll(dir)
+		}
 
 		// Write the object file.
 		objfile := filepath.Join(dir, "main.o")
-		err = c.EmitObject(objfile)
-		if err != nil {
-			return err
+		var callGraph map[string]*callNode
+		stackSizes := config.Options.PrintStacks || config.AutomaticStackSize()
+		if stackSizes {
+			// The LLVM C API has no way to emit the .stack_sizes section, so
+			// let Clang do the code generation instead. The module has
+			// already been optimized and must not be changed anymore by
+			// Clang, so that the call graph matches the generated code.
+			callGraph = buildCallGraph(c.Module())
+			bcfile := filepath.Join(dir, "main.bc")
+			err = c.EmitBitcode(bcfile)
+			if err != nil {
+				return err
+			}
+			optFlag := "-O" + config.Options.Opt
+			if config.Options.Opt == "none:" {
+				optFlag = "-O0"
+			}
+			err = runCommand(config, runCCompiler, config.Target.Compiler, append(config.CFlags(), optFlag, "-fstack-size-section", "-Xclang", "-disable-llvm-optzns", "-Wno-override-module", "-Wno-unused-command-line-argument", "-c", "-o", objfile, bcfile)...)
+			if err != nil {
+				return &commandError{"failed to build", bcfile, err}
+			}
+			err = addObjectCalls(callGraph, objfile)
+			if err != nil {
+				return err
+			}
+		} else {
+			err = c.EmitObject(objfile)
+			if err != nil {
+				return err
+			}
 		}
 
 		// Load builtins library from the cache, possibly compiling it on the
 		// fly.
 		var librt string
 		if config.Target.RTLib == "compiler-rt" {
-			librt, err = loadBuiltins(config.Triple())
+			librt, err = loadBuiltins(config.Triple(), config.Options, cacheStats)
 			if err != nil {
 				return err
 			}
@@ -147,72 +223,245 @@ func Build(pkgName, outpath string, config *compileopts.Config, action func(stri
 		if config.Target.RTLib == "compiler-rt" {
 			ldflags = append(ldflags, librt)
 		}
+		if size := config.ImageHeaderSize(); size != 0 {
+			// Reserve space for the image header in the linker script. Only
+			// some linker scripts (see targets/arm.ld) support this.
+			if !config.Target.ImageHeader {
+				return fmt.Errorf("image format %s is not supported on this target: the linker script doesn't reserve space for an image header", config.ImageFormat())
+			}
+			ldflags = append(ldflags, "--defsym=_image_header_size="+strconv.FormatUint(size, 10))
+		}
 
-		// Compile extra files.
+		// Compile extra files and C files in packages, in parallel.
+		var jobs []compileJob
 		root := goenv.Get("TINYGOROOT")
 		for i, path := range config.ExtraFiles() {
 			abspath := filepath.Join(root, path)
 			outpath := filepath.Join(dir, "extra-"+strconv.Itoa(i)+"-"+filepath.Base(path)+".o")
-			err := runCCompiler(config.Target.Compiler, append(config.CFlags(), "-c", "-o", outpath, abspath)...)
-			if err != nil {
-				return &commandError{"failed to build", path, err}
-			}
+			jobs = append(jobs, compileJob{path, abspath, append(config.CFlags(), "-c", "-o", outpath, abspath)})
 			ldflags = append(ldflags, outpath)
 		}
-
-		// Compile C files in packages.
 		for i, pkg := range c.Packages() {
 			for _, file := range pkg.CFiles {
 				path := filepath.Join(pkg.Package.Dir, file)
 				outpath := filepath.Join(dir, "pkg"+strconv.Itoa(i)+"-"+file+".o")
-				err := runCCompiler(config.Target.Compiler, append(config.CFlags(), "-c", "-o", outpath, path)...)
-				if err != nil {
-					return &commandError{"failed to build", path, err}
+				cflags := config.CFlags()
+				if stackSizes {
+					cflags = append(cflags, "-fstack-size-section")
 				}
+				jobs = append(jobs, compileJob{path, path, append(cflags, "-c", "-o", outpath, path)})
 				ldflags = append(ldflags, outpath)
 			}
 		}
+		// Write a compilation database of these files for clangd and other
+		// tools, if requested. This is done before compiling, so that it is
+		// also available when the C code doesn't compile.
+		if config.Options.CompileCommands != "" {
+			err := writeCompileCommands(config.Options.CompileCommands, config.Target.Compiler, jobs)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = runCompileJobs(config.Target.Compiler, jobs, config.Options.Parallelism, config.Options.PrintCommands)
+		if err != nil {
+			return err
+		}
+
+		// Let the linker write a map file, if requested. ld.lld 9 prints the
+		// cross reference table to stdout instead of the map file, so it is
+		// captured and appended to the map file after linking (if the linker
+		// doesn't run in the current process).
+		linkFunc := link
+		var crossReferences bytes.Buffer
+		if config.Options.MapFile != "" {
+			mapflags, err := linkerMapFlags(config.Target.Linker, config.Options.MapFile)
+			if err != nil {
+				return err
+			}
+			ldflags = append(ldflags, mapflags...)
+			if config.Target.Linker == "ld.lld" {
+				linkFunc = func(linker string, flags ...string) error {
+					return linkWithOutput(&crossReferences, linker, flags...)
+				}
+			}
+		}
 
 		// Link the object files together.
-		err = link(config.Target.Linker, ldflags...)
+		stage = StageLink
+		err = runCommand(config, linkFunc, config.Target.Linker, ldflags...)
 		if err != nil {
 			return &commandError{"failed to link", executable, err}
 		}
+		if crossReferences.Len() != 0 {
+			err := appendCrossReferenceTable(config.Options.MapFile, crossReferences.Bytes())
+			if err != nil {
+				return err
+			}
+		}
+		if config.Options.PrintCommands {
+			fmt.Fprintf(os.Stderr, "# cache: %d hits, %d misses\n", cacheStats.hits, cacheStats.misses)
+		}
+
+		// Remove the least recently used files from the cache, now that
+		// everything that is needed for this build has been stored there.
+		if config.Options.CacheSize > 0 {
+			files, size, err := trimCache(goenv.Get("GOCACHE"), config.Options.CacheSize)
+			if err != nil {
+				return err
+			}
+			if config.Options.PrintCommands && files != 0 {
+				fmt.Fprintf(os.Stderr, "# cache: removed %d files (%d bytes)\n", files, size)
+			}
+		}
+
+		// Summarize the linker map per section and package. Only the map
+		// files of ld.lld and wasm-ld can be read, other linkers only write
+		// the map file.
+		if config.Options.MapFile != "" && (config.Target.Linker == "ld.lld" || config.Target.Linker == "wasm-ld") {
+			err := printLinkerMap(config.Options.MapFile)
+			if err != nil {
+				return err
+			}
+		}
 
-		if config.Options.PrintSizes == "short" || config.Options.PrintSizes == "full" {
-			sizes, err := loadProgramSize(executable)
+		// Set the stack size of each goroutine based on its worst-case stack
+		// usage.
+		if config.AutomaticStackSize() {
+			err := setGoroutineStackSizes(callGraph, executable)
 			if err != nil {
 				return err
 			}
-			if config.Options.PrintSizes == "short" {
+		}
+
+		// Print the program size and check it against the available flash and
+		// RAM of the target.
+		maxFlash, maxRAM := config.FlashSize(), config.RAMSize()
+		printSizes := false
+		switch config.Options.PrintSizes {
+		case "short", "full", "symbols", "json", "csv":
+			printSizes = true
+		}
+		var sizes *programSize
+		if printSizes || maxFlash != 0 || maxRAM != 0 || config.Options.PrintJSON {
+			sizes, err = loadProgramSize(executable)
+			if err != nil {
+				return err
+			}
+			switch config.Options.PrintSizes {
+			case "short":
 				fmt.Printf("   code    data     bss |   flash     ram\n")
-				fmt.Printf("%7d %7d %7d | %7d %7d\n", sizes.Code, sizes.Data, sizes.BSS, sizes.Code+sizes.Data, sizes.Data+sizes.BSS)
-			} else {
+				fmt.Printf("%7d %7d %7d | %7d %7d\n", sizes.Code, sizes.Data, sizes.BSS, sizes.Flash(), sizes.RAM())
+			case "full":
 				fmt.Printf("   code  rodata    data     bss |   flash     ram | package\n")
 				for _, name := range sizes.sortedPackageNames() {
 					pkgSize := sizes.Packages[name]
 					fmt.Printf("%7d %7d %7d %7d | %7d %7d | %s\n", pkgSize.Code, pkgSize.ROData, pkgSize.Data, pkgSize.BSS, pkgSize.Flash(), pkgSize.RAM(), name)
+					for _, filename := range sizes.sortedFileNames(name) {
+						fSize := sizes.Files[filename]
+						fmt.Printf("%7d %7d %7d %7d | %7d %7d |   %s\n", fSize.Code, fSize.ROData, fSize.Data, fSize.BSS, fSize.Flash(), fSize.RAM(), shortFileName(filename))
+					}
 				}
 				fmt.Printf("%7d %7d %7d %7d | %7d %7d | (sum)\n", sizes.Sum.Code, sizes.Sum.ROData, sizes.Sum.Data, sizes.Sum.BSS, sizes.Sum.Flash(), sizes.Sum.RAM())
-				fmt.Printf("%7d       - %7d %7d | %7d %7d | (all)\n", sizes.Code, sizes.Data, sizes.BSS, sizes.Code+sizes.Data, sizes.Data+sizes.BSS)
+				fmt.Printf("%7d       - %7d %7d | %7d %7d | (all)\n", sizes.Code, sizes.Data, sizes.BSS, sizes.Flash(), sizes.RAM())
+			case "symbols":
+				fmt.Printf("   code  rodata    data     bss |   flash     ram | symbol\n")
+				for _, symbol := range sizes.sortedSymbols() {
+					name := symbol.Name
+					if symbol.File != "" {
+						name += " (" + shortFileName(symbol.File) + ")"
+					}
+					fmt.Printf("%7d %7d %7d %7d | %7d %7d | %s\n", symbol.Code, symbol.ROData, symbol.Data, symbol.BSS, symbol.Flash(), symbol.RAM(), name)
+				}
+			case "json":
+				err = sizes.report().WriteJSON(os.Stdout)
+			case "csv":
+				err = sizes.report().WriteCSV(os.Stdout)
+			}
+			if err != nil {
+				return err
+			}
+			imageSize := sizes.Flash()
+			if format := config.ImageFormat(); format != "" && maxFlash != 0 {
+				// The image header and trailer are stored in flash too.
+				segments, _, err := extractROMSegments(executable)
+				if err != nil {
+					return err
+				}
+				segments, err = createFirmwareImage(segments, format, config.ImageHeaderSize(), config.Options.ImageVersion)
+				if err != nil {
+					return err
+				}
+				imageSize = uint64(len(segments[0].data))
+			}
+			if err := checkProgramSize(sizes, imageSize, maxFlash, maxRAM); err != nil {
+				return err
 			}
 		}
 
-		// Get an Intel .hex file or .bin file from the .elf file.
-		if outext == ".hex" || outext == ".bin" || outext == ".gba" {
-			tmppath = filepath.Join(dir, "main"+outext)
-			err := objcopy(executable, tmppath)
+		if config.Options.PrintStacks {
+			err := printStacks(callGraph, executable)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Get an Intel .hex, Motorola .srec, .bin or UF2 file from the .elf
+		// file, possibly with a header or trailer for the bootloader.
+		switch outext {
+		case ".hex", ".srec", ".bin", ".gba", ".uf2":
+			segments, entry, err := extractROMSegments(executable)
 			if err != nil {
 				return err
 			}
-		} else if outext == ".uf2" {
-			// Get UF2 from the .elf file.
+			if format := config.ImageFormat(); format != "" {
+				err = checkImageHeaderSpace(executable, segments, config.ImageHeaderSize())
+				if err != nil {
+					return err
+				}
+				segments, err = createFirmwareImage(segments, format, config.ImageHeaderSize(), config.Options.ImageVersion)
+				if err != nil {
+					return err
+				}
+			}
 			tmppath = filepath.Join(dir, "main"+outext)
-			err := convertELFFileToUF2File(executable, tmppath, config.Target.UF2FamilyID)
+			if outext == ".uf2" {
+				err = writeUF2File(tmppath, segments, config.Target.UF2FamilyID)
+			} else {
+				err = objcopy(tmppath, segments, entry, config.Options.BinFill, config.Options.BinBase)
+			}
 			if err != nil {
 				return err
 			}
 		}
-		return action(tmppath)
+		result := BuildResult{Binary: tmppath}
+		if sizes != nil {
+			result.Size = sizes.report()
+		}
+		stage = "" // the build is done
+		return action(result)
+	}
+}
+
+// runCommand runs the C compiler or linker with the given function (runCCompiler
+// or link). With -x, the command line is printed first.
+func runCommand(config *compileopts.Config, run func(command string, args ...string) error, command string, args ...string) error {
+	if config.Options.PrintCommands {
+		err := printCommandLine(command, args)
+		if err != nil {
+			return err
+		}
+	}
+	return run(command, args...)
+}
+
+// printCommandLine prints the command line that is run for the given command
+// and arguments (see commandLine), for the -x flag.
+func printCommandLine(command string, args []string) error {
+	cmdline, err := commandLine(command, args)
+	if err != nil {
+		return err
 	}
+	PrintCommand(cmdline[0], cmdline[1:]...)
+	return nil
 }
@@ -1,9 +1,15 @@
 package builder
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/tinygo-org/tinygo/goenv"
@@ -48,6 +54,7 @@ func cacheLoad(name, configKey string, sourceFiles []string) (string, error) {
 	}
 
 	if cacheStat.ModTime().After(sourceTimestamp) {
+		touchCacheFile(cachepath)
 		return cachepath, nil
 	} else {
 		os.Remove(cachepath)
@@ -116,3 +123,196 @@ func moveFile(src, dst string) error {
 
 	return os.Rename(dst+".tmp", dst)
 }
+
+// cacheStats counts the cache hits and misses of a single build. With -x, each
+// cache hit and the totals are printed.
+type cacheStats struct {
+	hits    int
+	misses  int
+	verbose bool
+}
+
+// count records a single cache lookup of the file at the given path.
+func (s *cacheStats) count(hit bool, path string) {
+	if hit {
+		s.hits++
+		if s.verbose {
+			fmt.Fprintln(os.Stderr, "# cache hit:", path)
+		}
+	} else {
+		s.misses++
+	}
+}
+
+// touchCacheFile updates the modification time of a cache file when it is
+// used, so that the least recently used files are removed first when the cache
+// is trimmed.
+func touchCacheFile(path string) {
+	now := time.Now()
+	os.Chtimes(path, now, now)
+}
+
+// tmpFileMaxAge is the age after which a temporary file in the cache directory
+// is assumed to be left behind by an interrupted build.
+const tmpFileMaxAge = 24 * time.Hour
+
+// isTemporaryCacheFile returns whether the file with the given name is being
+// written to the cache, see packageCache.Store and moveFile.
+func isTemporaryCacheFile(name string) bool {
+	return strings.HasPrefix(name, "tmp-") || strings.HasSuffix(name, ".tmp")
+}
+
+// trimCache removes the least recently used files from the given cache
+// directory until its size is at most maxSize bytes. Temporary files are only
+// removed when they are old, as they may be in use by a concurrent build. It
+// returns the number of removed files and bytes.
+func trimCache(dir string, maxSize int64) (files int, size int64, err error) {
+	type cacheFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var cacheFiles []cacheFile
+	var total int64
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if isTemporaryCacheFile(info.Name()) && time.Since(info.ModTime()) < tmpFileMaxAge {
+			return nil
+		}
+		cacheFiles = append(cacheFiles, cacheFile{path, info.Size(), info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	sort.Slice(cacheFiles, func(i, j int) bool {
+		return cacheFiles[i].modTime.Before(cacheFiles[j].modTime)
+	})
+	for _, f := range cacheFiles {
+		if total <= maxSize {
+			break
+		}
+		err := os.Remove(f.path)
+		if err != nil && !os.IsNotExist(err) {
+			return files, size, err
+		}
+		total -= f.size
+		files++
+		size += f.size
+	}
+	return files, size, nil
+}
+
+// CleanCache removes files from the cache directory. Without a target triple,
+// the whole cache is removed. With a target triple, only the files compiled
+// for that triple are removed. If builtins is set, only the compiled builtins
+// (compiler-rt) are removed, optionally only for the given triple.
+func CleanCache(triple string, builtins bool) error {
+	return cleanCache(goenv.Get("GOCACHE"), triple, builtins)
+}
+
+// cleanCache implements CleanCache for the given cache directory.
+func cleanCache(dir, triple string, builtins bool) error {
+	if triple == "" && !builtins {
+		return os.RemoveAll(dir)
+	}
+	pattern := "librt-*.a"
+	if triple != "" {
+		pattern = "librt-" + triple + ".a"
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		return err
+	}
+	if !builtins {
+		paths = append(paths, filepath.Join(dir, "pkg", triple))
+	}
+	for _, path := range paths {
+		err := os.RemoveAll(path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// packageCache stores the compiled LLVM bitcode of packages in the cache
+// directory, in a subdirectory per target triple. The file name is derived from
+// the key calculated by the compiler and the TinyGo executable, so that a
+// different build of TinyGo never uses bitcode compiled by another build.
+type packageCache struct {
+	dir        string
+	compilerID string
+	stats      *cacheStats
+}
+
+// newPackageCache returns the package cache for the given target triple.
+func newPackageCache(triple string, stats *cacheStats) *packageCache {
+	cache := &packageCache{
+		dir:   filepath.Join(goenv.Get("GOCACHE"), "pkg", triple),
+		stats: stats,
+	}
+	if executable, err := os.Executable(); err == nil {
+		if st, err := os.Stat(executable); err == nil {
+			cache.compilerID = fmt.Sprintf("%s %d %d", executable, st.Size(), st.ModTime().UnixNano())
+		}
+	}
+	return cache
+}
+
+// path returns the path of the bitcode file with the given key.
+func (c *packageCache) path(key string) string {
+	hash := sha256.Sum256([]byte(c.compilerID + "\n" + key))
+	return filepath.Join(c.dir, hex.EncodeToString(hash[:])+".bc")
+}
+
+// Load returns the path of the bitcode file stored with the given key, or "" if
+// it is not in the cache.
+func (c *packageCache) Load(key string) (string, error) {
+	path := c.path(key)
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		c.stats.count(false, path)
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	c.stats.count(true, path)
+	touchCacheFile(path)
+	return path, nil
+}
+
+// Store stores the bitcode with the given key in the cache. The file is written
+// to a temporary file first, so that concurrent builds never see a partially
+// written file.
+func (c *packageCache) Store(key string, bitcode []byte) error {
+	err := os.MkdirAll(c.dir, 0777)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(c.dir, "tmp-*.bc")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(bitcode)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return moveFile(f.Name(), c.path(key))
+}
@@ -0,0 +1,153 @@
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// writeCacheFiles creates the given files (relative to dir) of 100 bytes each,
+// with increasing modification times in the given order.
+func writeCacheFiles(t *testing.T, dir string, names ...string) {
+	modTime := time.Now().Add(-time.Hour)
+	for _, name := range names {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, make([]byte, 100), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		modTime = modTime.Add(time.Minute)
+	}
+}
+
+// listCacheFiles returns all files in dir, relative to dir and sorted.
+func listCacheFiles(t *testing.T, dir string) []string {
+	var names []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			names = append(names, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func checkCacheFiles(t *testing.T, dir string, expected ...string) {
+	t.Helper()
+	names := listCacheFiles(t, dir)
+	if len(names) != len(expected) {
+		t.Errorf("expected cache files %q, got %q", expected, names)
+		return
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Errorf("expected cache files %q, got %q", expected, names)
+			return
+		}
+	}
+}
+
+func TestTrimCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tinygo-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The oldest files are removed first, but files that are being written by
+	// another build are kept.
+	writeCacheFiles(t, dir,
+		"pkg/armv7m-none-eabi/tmp-123.bc",
+		"librt-armv7m-none-eabi.a.tmp",
+		"pkg/armv7m-none-eabi/a.bc",
+		"librt-armv7m-none-eabi.a",
+		"pkg/armv7m-none-eabi/b.bc")
+	files, size, err := trimCache(dir, 150)
+	if err != nil {
+		t.Fatal("could not trim cache:", err)
+	}
+	if files != 2 || size != 200 {
+		t.Errorf("expected 2 files of 200 bytes to be removed, got %d files of %d bytes", files, size)
+	}
+	checkCacheFiles(t, dir,
+		"librt-armv7m-none-eabi.a.tmp",
+		"pkg/armv7m-none-eabi/b.bc",
+		"pkg/armv7m-none-eabi/tmp-123.bc")
+
+	// Temporary files left behind by an interrupted build are removed.
+	old := time.Now().Add(-2 * tmpFileMaxAge)
+	if err := os.Chtimes(filepath.Join(dir, "librt-armv7m-none-eabi.a.tmp"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := trimCache(dir, 0); err != nil {
+		t.Fatal("could not trim cache:", err)
+	}
+	checkCacheFiles(t, dir, "pkg/armv7m-none-eabi/tmp-123.bc")
+
+	// A cache directory that doesn't exist yet is not an error.
+	if _, _, err := trimCache(filepath.Join(dir, "missing"), 0); err != nil {
+		t.Error("could not trim missing cache:", err)
+	}
+}
+
+func TestCleanCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tinygo-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []string{
+		"librt-armv7m-none-eabi.a",
+		"librt-wasm32--wasi.a",
+		"pkg/armv7m-none-eabi/a.bc",
+		"pkg/wasm32--wasi/b.bc",
+	}
+	writeCacheFiles(t, dir, files...)
+
+	// Only the builtins of a single target.
+	if err := cleanCache(dir, "wasm32--wasi", true); err != nil {
+		t.Fatal(err)
+	}
+	checkCacheFiles(t, dir, "librt-armv7m-none-eabi.a", "pkg/armv7m-none-eabi/a.bc", "pkg/wasm32--wasi/b.bc")
+
+	// Everything of a single target.
+	if err := cleanCache(dir, "armv7m-none-eabi", false); err != nil {
+		t.Fatal(err)
+	}
+	checkCacheFiles(t, dir, "pkg/wasm32--wasi/b.bc")
+
+	// The builtins of all targets.
+	writeCacheFiles(t, dir, files...)
+	if err := cleanCache(dir, "", true); err != nil {
+		t.Fatal(err)
+	}
+	checkCacheFiles(t, dir, "pkg/armv7m-none-eabi/a.bc", "pkg/wasm32--wasi/b.bc")
+
+	// The whole cache.
+	if err := cleanCache(dir, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Error("expected the cache directory to be removed")
+	}
+}
@@ -1,11 +1,13 @@
 package builder
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/tinygo-org/tinygo/compileopts"
 	"github.com/tinygo-org/tinygo/goenv"
 )
 
@@ -170,7 +172,7 @@ func builtinsDir() string {
 }
 
 // Get the builtins archive, possibly generating it as needed.
-func loadBuiltins(target string) (path string, err error) {
+func loadBuiltins(target string, options *compileopts.Options, stats *cacheStats) (path string, err error) {
 	// Try to load a precompiled compiler-rt library.
 	precompiledPath := filepath.Join(goenv.Get("TINYGOROOT"), "pkg", target, "compiler-rt.a")
 	if _, err := os.Stat(precompiledPath); err == nil {
@@ -189,11 +191,15 @@ func loadBuiltins(target string) (path string, err error) {
 	}
 
 	if path, err := cacheLoad(outfile, commands["clang"][0], srcs); path != "" || err != nil {
+		if err == nil {
+			stats.count(true, path)
+		}
 		return path, err
 	}
+	stats.count(false, outfile)
 
 	var cachepath string
-	err = CompileBuiltins(target, func(path string) error {
+	err = CompileBuiltins(target, options, func(path string) error {
 		path, err := cacheStore(path, outfile, commands["clang"][0], srcs)
 		cachepath = path
 		return err
@@ -203,9 +209,10 @@ func loadBuiltins(target string) (path string, err error) {
 
 // CompileBuiltins compiles builtins from compiler-rt into a static library.
 // When it succeeds, it will call the callback with the resulting path. The path
-// will be removed after callback returns. If callback returns an error, this is
-// passed through to the return value of this function.
-func CompileBuiltins(target string, callback func(path string) error) error {
+// will be removed after callback returns, unless the -work flag is set. If callback returns an error, this is
+// passed through to the return value of this function. The builtins are compiled
+// in parallel, see the -p and -x flags in the options.
+func CompileBuiltins(target string, options *compileopts.Options, callback func(path string) error) error {
 	builtinsDir := builtinsDir()
 
 	builtins := builtinFiles(target)
@@ -220,11 +227,18 @@ func CompileBuiltins(target string, callback func(path string) error) error {
 	if err != nil {
 		return err
 	}
-	defer os.RemoveAll(dir)
+	// With -work, the temporary directory is kept for inspection.
+	if options.PrintCommands || options.Work {
+		fmt.Fprintln(os.Stderr, "WORK="+dir)
+	}
+	if !options.Work {
+		defer os.RemoveAll(dir)
+	}
 
 	// Compile all builtins.
 	// TODO: use builtins optimized for a given target if available.
 	objs := make([]string, 0, len(builtins))
+	jobs := make([]compileJob, 0, len(builtins))
 	for _, name := range builtins {
 		objname := name
 		if strings.LastIndexByte(objname, '/') >= 0 {
@@ -237,13 +251,19 @@ func CompileBuiltins(target string, callback func(path string) error) error {
 		// reproducible. Otherwise the temporary directory is stored in the
 		// archive itself, which varies each run.
 		args := []string{"-c", "-Oz", "-g", "-Werror", "-Wall", "-std=c11", "-fshort-enums", "-nostdlibinc", "-ffunction-sections", "-fdata-sections", "-Wno-macro-redefined", "--target=" + target, "-fdebug-prefix-map=" + dir + "=" + remapDir}
+		if strings.HasSuffix(name, ".c") {
+			// The backend inserts calls to these functions, so the stack
+			// usage analysis needs their frame sizes.
+			args = append(args, "-fstack-size-section")
+		}
 		if strings.HasPrefix(target, "riscv32-") {
 			args = append(args, "-march=rv32imac", "-mabi=ilp32", "-fforce-enable-int128")
 		}
-		err := runCCompiler("clang", append(args, "-o", objpath, srcpath)...)
-		if err != nil {
-			return &commandError{"failed to build", srcpath, err}
-		}
+		jobs = append(jobs, compileJob{srcpath, srcpath, append(args, "-o", objpath, srcpath)})
+	}
+	err = runCompileJobs("clang", jobs, options.Parallelism, options.PrintCommands)
+	if err != nil {
+		return err
 	}
 
 	// Put all the object files in a single archive. This archive file will be
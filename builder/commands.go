@@ -2,6 +2,8 @@ package builder
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"runtime"
@@ -43,9 +45,15 @@ func init() {
 }
 
 func execCommand(cmdNames []string, args ...string) error {
+	return execCommandOutput(os.Stdout, cmdNames, args...)
+}
+
+// execCommandOutput runs the first command of cmdNames that can be found, like
+// execCommand, but writes its standard output to stdout.
+func execCommandOutput(stdout io.Writer, cmdNames []string, args ...string) error {
 	for _, cmdName := range cmdNames {
 		cmd := exec.Command(cmdName, args...)
-		cmd.Stdout = os.Stdout
+		cmd.Stdout = stdout
 		cmd.Stderr = os.Stderr
 		err := cmd.Run()
 		if err != nil {
@@ -59,3 +67,41 @@ func execCommand(cmdNames []string, args ...string) error {
 	}
 	return errors.New("none of these commands were found in your $PATH: " + strings.Join(cmdNames, " "))
 }
+
+// lookupCommand returns the path of the executable that execCommand runs for
+// the given command, or the command itself if it can't be found.
+func lookupCommand(command string) string {
+	cmdNames, ok := commands[command]
+	if !ok {
+		cmdNames = []string{command}
+	}
+	for _, cmdName := range cmdNames {
+		if path, err := exec.LookPath(cmdName); err == nil {
+			return path
+		}
+	}
+	return command
+}
+
+// PrintCommand prints a command line to stderr, for the -x flag. Arguments are
+// quoted when needed, so that the command line can be copied into a shell.
+func PrintCommand(cmd string, args ...string) {
+	words := make([]string, 0, len(args)+1)
+	for _, arg := range append([]string{cmd}, args...) {
+		words = append(words, shellQuote(arg))
+	}
+	fmt.Fprintln(os.Stderr, strings.Join(words, " "))
+}
+
+// shellQuote quotes a single argument for a POSIX shell, if necessary.
+func shellQuote(arg string) string {
+	if arg == "" {
+		return "''"
+	}
+	for _, c := range arg {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_./:=+,@%", c)) {
+			return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+		}
+	}
+	return arg
+}
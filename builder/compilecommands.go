@@ -0,0 +1,59 @@
+package builder
+
+// This file writes a compilation database (compile_commands.json) for the C and
+// assembly files of a build, so that tools like clangd can find the include
+// paths, sysroot and target flags that TinyGo uses. The format is described
+// here: https://clang.llvm.org/docs/JSONCompilationDatabase.html
+//
+// Only the extra files of the target and the C files in packages are included.
+// The builtins (compiler-rt) are usually loaded from the cache and are not
+// part of the program sources.
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// compileCommand is a single entry in a compile_commands.json file.
+type compileCommand struct {
+	Directory string   `json:"directory"`
+	Arguments []string `json:"arguments"`
+	File      string   `json:"file"`
+}
+
+// writeCompileCommands writes the given compile jobs as a compilation database
+// to the given path. The arguments are exactly the ones passed to the C
+// compiler (see compilerArgs), with the {root} of the target flags already
+// expanded. The compiler is the one found in $PATH, as tools can't run the
+// built-in Clang.
+func writeCompileCommands(path, compiler string, jobs []compileJob) error {
+	// The C compiler runs in the current working directory.
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	executable := lookupCommand(compiler)
+	commands := make([]compileCommand, 0, len(jobs))
+	for _, job := range jobs {
+		source, err := filepath.Abs(job.source)
+		if err != nil {
+			return err
+		}
+		args, err := compilerArgs(compiler, job.args)
+		if err != nil {
+			return err
+		}
+		commands = append(commands, compileCommand{
+			Directory: wd,
+			Arguments: append([]string{executable}, args...),
+			File:      source,
+		})
+	}
+	data, err := json.MarshalIndent(commands, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0666)
+}
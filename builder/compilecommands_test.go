@@ -0,0 +1,76 @@
+package builder
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestWriteCompileCommands(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test uses a shell script as the C compiler")
+	}
+	dir, err := ioutil.TempDir("", "tinygo-compile-commands")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The compiler in the database is the one found in $PATH.
+	compiler := filepath.Join(dir, commands["clang"][0])
+	err = ioutil.WriteFile(compiler, []byte("#!/bin/sh\n"), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir)
+
+	jobs := []compileJob{
+		{"src/device/arm/cortexm.s", "/tinygo/src/device/arm/cortexm.s", []string{"--target=thumbv7em-none-eabi", "-c", "-o", "/tmp/extra-0.o", "/tinygo/src/device/arm/cortexm.s"}},
+		{"foo.c", "foo.c", []string{"--target=thumbv7em-none-eabi", "-Oz", "-c", "-o", "/tmp/pkg-0.o", "foo.c"}},
+	}
+	path := filepath.Join(dir, "compile_commands.json")
+	err = writeCompileCommands(path, "clang", jobs)
+	if err != nil {
+		t.Fatal("could not write compile_commands.json:", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result []compileCommand
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		t.Fatal("could not parse compile_commands.json:", err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != len(jobs) {
+		t.Fatalf("expected %d entries, got %d", len(jobs), len(result))
+	}
+	for i, job := range jobs {
+		args, err := compilerArgs("clang", job.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		source, err := filepath.Abs(job.source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := compileCommand{
+			Directory: wd,
+			Arguments: append([]string{compiler}, args...),
+			File:      source,
+		}
+		if !reflect.DeepEqual(result[i], expected) {
+			t.Errorf("entry %d: expected %+v, got %+v", i, expected, result[i])
+		}
+	}
+}
@@ -6,45 +6,23 @@ import (
 	"errors"
 	"os"
 	"os/exec"
-	"unsafe"
 
 	"github.com/tinygo-org/tinygo/goenv"
 )
 
-/*
-#cgo CXXFLAGS: -fno-rtti
-#include <stdbool.h>
-#include <stdlib.h>
-bool tinygo_clang_driver(int argc, char **argv);
-*/
-import "C"
-
 // runCCompiler invokes a C compiler with the given arguments.
 //
 // This version invokes the built-in Clang when trying to run the Clang compiler.
+// Compile jobs only run in parallel with ToolProcesses.
 func runCCompiler(command string, flags ...string) error {
 	switch command {
 	case "clang":
 		// Compile this with the internal Clang compiler.
-		headerPath := getClangHeaderPath(goenv.Get("TINYGOROOT"))
-		if headerPath == "" {
-			return errors.New("could not locate Clang headers")
-		}
-		flags = append(flags, "-I"+headerPath)
-		flags = append([]string{"tinygo:" + command}, flags...)
-		var cflag *C.char
-		buf := C.calloc(C.size_t(len(flags)), C.size_t(unsafe.Sizeof(cflag)))
-		cflags := (*[1 << 10]*C.char)(unsafe.Pointer(buf))[:len(flags):len(flags)]
-		for i, flag := range flags {
-			cflag := C.CString(flag)
-			cflags[i] = cflag
-			defer C.free(unsafe.Pointer(cflag))
+		flags, err := compilerArgs(command, flags)
+		if err != nil {
+			return err
 		}
-		ok := C.tinygo_clang_driver(C.int(len(flags)), (**C.char)(buf))
-		if !ok {
-			return errors.New("failed to compile using built-in clang")
-		}
-		return nil
+		return runBuiltinTool(os.Stdout, command, flags...)
 	default:
 		// Running some other compiler. Maybe it has been defined in the
 		// commands map (unlikely).
@@ -58,3 +36,17 @@ func runCCompiler(command string, flags ...string) error {
 		return cmd.Run()
 	}
 }
+
+// compilerArgs returns the arguments that runCCompiler passes to the given C
+// compiler for the given flags. The built-in Clang also needs the path to its
+// own headers.
+func compilerArgs(command string, flags []string) ([]string, error) {
+	if command != "clang" {
+		return flags, nil
+	}
+	headerPath := getClangHeaderPath(goenv.Get("TINYGOROOT"))
+	if headerPath == "" {
+		return nil, errors.New("could not locate Clang headers")
+	}
+	return append(flags[:len(flags):len(flags)], "-I"+headerPath), nil
+}
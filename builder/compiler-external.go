@@ -22,3 +22,9 @@ func runCCompiler(command string, flags ...string) error {
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
 }
+
+// compilerArgs returns the arguments that runCCompiler passes to the given C
+// compiler for the given flags. An external compiler gets the flags as-is.
+func compilerArgs(command string, flags []string) ([]string, error) {
+	return flags, nil
+}
@@ -1,7 +1,8 @@
 package builder
 
 // MultiError is a list of multiple errors (actually: diagnostics) returned
-// during LLVM IR generation.
+// during LLVM IR generation, or the errors of C compiler invocations that ran in
+// parallel.
 type MultiError struct {
 	Errs []error
 }
@@ -37,3 +38,24 @@ type commandError struct {
 func (e *commandError) Error() string {
 	return e.Msg + " " + e.File + ": " + e.Err.Error()
 }
+
+// Build stages, as reported in StageError.
+const (
+	StageLoader    = "loader"
+	StageCompiler  = "compiler"
+	StageInterp    = "interp"
+	StageTransform = "transform"
+	StageLink      = "link"
+)
+
+// StageError wraps an error returned by Build with the build stage in which it
+// happened, such as StageLoader or StageLink. Errors returned by the action
+// passed to Build are not wrapped, as they happen after the build finished.
+type StageError struct {
+	Stage string
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return e.Err.Error()
+}
@@ -0,0 +1,218 @@
+package builder
+
+// This file adds headers and trailers to firmware images, as expected by
+// bootloaders. The following image formats are supported:
+//
+//   crc32:   the image followed by its CRC32 (IEEE), in little endian.
+//   sha256:  the image followed by its SHA-256 hash.
+//   header:  a header followed by the image. The header contains the magic
+//            "TGIH", the header size, the image size, the version (major,
+//            minor and 16-bit revision packed in a single word) and the CRC32
+//            of the image, all as little endian 32-bit words. The rest of the
+//            header is filled with 0xff.
+//   mcuboot: a MCUboot image header followed by the image and a TLV trailer
+//            with the SHA-256 hash, like imgtool creates for unsigned images.
+//
+// The header is placed in front of the image. The space for it is reserved
+// while linking, in the .image_header section of the linker script (see
+// targets/arm.ld). For MCUboot, this means the program starts at the slot
+// address plus the header size.
+
+import (
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+)
+
+const (
+	imageHeaderMagic    = 0x48494754 // "TGIH"
+	mcubootImageMagic   = 0x96f3b83d
+	mcubootTLVInfoMagic = 0x6907
+	mcubootTLVSHA256    = 0x10
+)
+
+// imageVersion is the version of a firmware image, in the form
+// major.minor.revision+build.
+type imageVersion struct {
+	major, minor uint8
+	revision     uint16
+	build        uint32
+}
+
+// parseImageVersion parses a version string like "1.2.3+4". The minor version,
+// revision and build number are optional.
+func parseImageVersion(s string) (imageVersion, error) {
+	var version imageVersion
+	if s == "" {
+		return version, nil
+	}
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		build, err := strconv.ParseUint(s[i+1:], 10, 32)
+		if err != nil {
+			return version, errors.New("invalid build number in image version: " + s)
+		}
+		version.build = uint32(build)
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return version, errors.New("invalid image version: " + s)
+	}
+	for i, part := range parts {
+		bitSize := 8
+		if i == 2 {
+			bitSize = 16
+		}
+		n, err := strconv.ParseUint(part, 10, bitSize)
+		if err != nil {
+			return version, errors.New("invalid image version: " + s)
+		}
+		switch i {
+		case 0:
+			version.major = uint8(n)
+		case 1:
+			version.minor = uint8(n)
+		case 2:
+			version.revision = uint16(n)
+		}
+	}
+	return version, nil
+}
+
+// checkImageHeaderSpace checks whether the linker reserved enough space for an
+// image header of the given size in front of the program, so that the header
+// won't overwrite anything (like a bootloader) that is stored before it. It also
+// checks that the header doesn't misalign the vector table at the start of the
+// program.
+func checkImageHeaderSpace(executable string, segments []*romSegment, headerSize uint64) error {
+	if headerSize == 0 {
+		return nil
+	}
+	f, err := elf.Open(executable)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	section := f.Section(".image_header")
+	if section == nil || section.Size < headerSize || section.Addr+headerSize > segments[0].addr {
+		return fmt.Errorf("the linker script doesn't reserve space for the %d byte image header (see the .image_header section in targets/arm.ld)", headerSize)
+	}
+	if align := vectorTableAlignment(f); segments[0].addr%align != 0 {
+		return fmt.Errorf("the %d byte image header puts the vector table at 0x%x, which is not aligned to %d bytes as required by VTOR: use a header size that is a multiple of %d", headerSize, segments[0].addr, align, align)
+	}
+	return nil
+}
+
+// vectorTableAlignment returns the alignment the Cortex-M VTOR register needs
+// for the vector table in the given executable: its size rounded up to a power
+// of two, with a minimum of 128 bytes. The vector table has no size in the
+// symbol table, so it is taken to extend up to the next symbol.
+func vectorTableAlignment(f *elf.File) uint64 {
+	align := uint64(128)
+	symbols, err := f.Symbols()
+	if err != nil {
+		return align
+	}
+	var vectors *elf.Symbol
+	for i := range symbols {
+		if symbols[i].Name == "__isr_vector" {
+			vectors = &symbols[i]
+		}
+	}
+	if vectors == nil {
+		return align
+	}
+	start, end := vectors.Value, uint64(0)
+	for _, symbol := range symbols {
+		if symbol.Section == vectors.Section && symbol.Value > start && (end == 0 || symbol.Value < end) && elf.ST_TYPE(symbol.Info) != elf.STT_SECTION {
+			end = symbol.Value
+		}
+	}
+	for end != 0 && start+align < end {
+		align *= 2
+	}
+	return align
+}
+
+// createFirmwareImage adds a header and/or trailer to the firmware in the given
+// segments, according to the image format. The result is a single segment: gaps
+// between the input segments are filled with 0xff, like erased flash.
+func createFirmwareImage(segments []*romSegment, format string, headerSize uint64, versionString string) ([]*romSegment, error) {
+	version, err := parseImageVersion(versionString)
+	if err != nil {
+		return nil, err
+	}
+	image, err := flattenSegments(segments, 0xff, 0)
+	if err != nil {
+		return nil, err
+	}
+	addr := segments[0].addr
+
+	var header, trailer []byte
+	switch format {
+	case "crc32":
+		trailer = make([]byte, 4)
+		binary.LittleEndian.PutUint32(trailer, crc32.ChecksumIEEE(image))
+	case "sha256":
+		sum := sha256.Sum256(image)
+		trailer = sum[:]
+	case "header":
+		if headerSize < 20 {
+			return nil, fmt.Errorf("image header size %d is too small, need at least 20 bytes", headerSize)
+		}
+		header = make([]byte, headerSize)
+		for i := range header {
+			header[i] = 0xff
+		}
+		binary.LittleEndian.PutUint32(header[0:], imageHeaderMagic)
+		binary.LittleEndian.PutUint32(header[4:], uint32(headerSize))
+		binary.LittleEndian.PutUint32(header[8:], uint32(len(image)))
+		binary.LittleEndian.PutUint32(header[12:], uint32(version.major)<<24|uint32(version.minor)<<16|uint32(version.revision))
+		binary.LittleEndian.PutUint32(header[16:], crc32.ChecksumIEEE(image))
+	case "mcuboot":
+		if headerSize < 32 || headerSize > 0xffff {
+			return nil, fmt.Errorf("invalid MCUboot header size %d, must be between 32 and 65535 bytes", headerSize)
+		}
+		// The header is padded with zeroes, like imgtool does.
+		header = make([]byte, headerSize)
+		binary.LittleEndian.PutUint32(header[0:], mcubootImageMagic)
+		binary.LittleEndian.PutUint32(header[4:], 0) // load address (only for RAM loading)
+		binary.LittleEndian.PutUint16(header[8:], uint16(headerSize))
+		binary.LittleEndian.PutUint16(header[10:], 0) // size of protected TLVs
+		binary.LittleEndian.PutUint32(header[12:], uint32(len(image)))
+		binary.LittleEndian.PutUint32(header[16:], 0) // flags
+		header[20] = version.major
+		header[21] = version.minor
+		binary.LittleEndian.PutUint16(header[22:], version.revision)
+		binary.LittleEndian.PutUint32(header[24:], version.build)
+
+		// The hash covers the header (including padding) and the image.
+		hash := sha256.New()
+		hash.Write(header)
+		hash.Write(image)
+
+		// Create the TLV area: an info header followed by the SHA-256 TLV.
+		trailer = make([]byte, 4+4+sha256.Size)
+		binary.LittleEndian.PutUint16(trailer[0:], mcubootTLVInfoMagic)
+		binary.LittleEndian.PutUint16(trailer[2:], uint16(len(trailer)))
+		trailer[4] = mcubootTLVSHA256
+		binary.LittleEndian.PutUint16(trailer[6:], sha256.Size)
+		copy(trailer[8:], hash.Sum(nil))
+	default:
+		return nil, errors.New("unknown image format: " + format)
+	}
+
+	if uint64(len(header)) > addr {
+		return nil, fmt.Errorf("no space for the %d byte image header before the program at 0x%x", len(header), addr)
+	}
+	data := make([]byte, 0, len(header)+len(image)+len(trailer))
+	data = append(data, header...)
+	data = append(data, image...)
+	data = append(data, trailer...)
+	return []*romSegment{{addr: addr - uint64(len(header)), data: data}}, nil
+}
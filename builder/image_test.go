@@ -0,0 +1,75 @@
+package builder
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestParseImageVersion(t *testing.T) {
+	for _, tc := range []struct {
+		version string
+		result  imageVersion
+		err     bool
+	}{
+		{"", imageVersion{}, false},
+		{"1", imageVersion{major: 1}, false},
+		{"1.2", imageVersion{major: 1, minor: 2}, false},
+		{"1.2.3", imageVersion{major: 1, minor: 2, revision: 3}, false},
+		{"1.2.3+4", imageVersion{major: 1, minor: 2, revision: 3, build: 4}, false},
+		{"255.255.65535+4294967295", imageVersion{255, 255, 65535, 4294967295}, false},
+		{"256", imageVersion{}, true},
+		{"1.2.65536", imageVersion{}, true},
+		{"1.2.3.4", imageVersion{}, true},
+		{"1.x", imageVersion{}, true},
+		{"1.2.3+", imageVersion{}, true},
+	} {
+		result, err := parseImageVersion(tc.version)
+		if (err != nil) != tc.err {
+			t.Errorf("parseImageVersion(%q): unexpected error value: %v", tc.version, err)
+			continue
+		}
+		if err == nil && result != tc.result {
+			t.Errorf("parseImageVersion(%q): expected %+v, got %+v", tc.version, tc.result, result)
+		}
+	}
+}
+
+func TestCreateFirmwareImage(t *testing.T) {
+	program := []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f}
+	for _, tc := range []struct {
+		format     string
+		headerSize uint64
+		addr       uint64 // address of the resulting image
+		image      string // hex encoded
+	}{
+		{"crc32", 0, 0x8000, "000102030405060708090a0b0c0d0e0f" + "88e2cece"},
+		{"sha256", 0, 0x8000, "000102030405060708090a0b0c0d0e0f" + "be45cb2605bf36bebde684841a28f0fd43c69850a3dce5fedba69928ee3a8991"},
+		{"header", 32, 0x8000 - 32, "" +
+			"54474948" + "20000000" + "10000000" + "03000201" + "88e2cece" + "ffffffffffffffffffffffff" +
+			"000102030405060708090a0b0c0d0e0f"},
+		// An unsigned image in the layout created by imgtool: the header,
+		// the image, the TLV info header and the SHA-256 TLV.
+		{"mcuboot", 32, 0x8000 - 32, "" +
+			"3db8f396" + "00000000" + "2000" + "0000" + "10000000" + "00000000" + "01020300" + "04000000" + "00000000" +
+			"000102030405060708090a0b0c0d0e0f" +
+			"07692800" + "10002000" + "04cbb04cff0327ca1d27929d4af2c825fb1d13bdb48fd5fdd935263b6e42d4b3"},
+	} {
+		segments := []*romSegment{{addr: 0x8000, data: program}}
+		result, err := createFirmwareImage(segments, tc.format, tc.headerSize, "1.2.3+4")
+		if err != nil {
+			t.Errorf("format %s: %v", tc.format, err)
+			continue
+		}
+		expected, _ := hex.DecodeString(tc.image)
+		if len(result) != 1 || result[0].addr != tc.addr || !bytes.Equal(result[0].data, expected) {
+			t.Errorf("format %s: unexpected image at 0x%x:\n%x\nexpected at 0x%x:\n%x", tc.format, result[0].addr, result[0].data, tc.addr, expected)
+		}
+	}
+
+	// The header must fit in front of the program.
+	segments := []*romSegment{{addr: 0x10, data: program}}
+	if _, err := createFirmwareImage(segments, "mcuboot", 32, ""); err == nil {
+		t.Error("expected an error for a header that doesn't fit in front of the program")
+	}
+}
@@ -0,0 +1,68 @@
+package builder
+
+// This file runs C compiler invocations in parallel, for the C files in
+// packages, the extra files of a target and the builtins of compiler-rt.
+
+import (
+	"runtime"
+	"sync"
+)
+
+// compileJob is a single invocation of the C compiler.
+type compileJob struct {
+	file   string   // source file, used in error messages
+	source string   // absolute path of the source file
+	args   []string // all arguments, including the source and output file
+}
+
+// runCompileJobs runs the given C compiler jobs on at most parallelism workers
+// (GOMAXPROCS if it is zero). All jobs are run, even if some of them fail. The
+// errors are returned in the order of the jobs, so that they don't depend on
+// scheduling: as a single error or as a *MultiError.
+func runCompileJobs(compiler string, jobs []compileJob, parallelism int, printCommands bool) error {
+	if parallelism <= 0 {
+		parallelism = runtime.GOMAXPROCS(0)
+	}
+	if parallelism > len(jobs) {
+		parallelism = len(jobs)
+	}
+
+	errs := make([]error, len(jobs))
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indices {
+				job := jobs[index]
+				var err error
+				if printCommands {
+					err = printCommandLine(compiler, job.args)
+				}
+				if err == nil {
+					err = runCCompiler(compiler, job.args...)
+				}
+				if err != nil {
+					errs[index] = &commandError{"failed to build", job.file, err}
+				}
+			}
+		}()
+	}
+	for i := range jobs {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	var failed []error
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return newMultiError(failed)
+}
@@ -6,6 +6,7 @@ package builder
 // is provided for when tinygo is built without linking to liblld.
 
 import (
+	"io"
 	"os"
 	"os/exec"
 
@@ -13,14 +14,20 @@ import (
 )
 
 // link invokes a linker with the given name and arguments.
+func link(linker string, flags ...string) error {
+	return linkWithOutput(os.Stdout, linker, flags...)
+}
+
+// linkWithOutput invokes a linker with the given name and arguments, and
+// writes the standard output of the linker to stdout.
 //
 // This version always runs the linker as an external command.
-func link(linker string, flags ...string) error {
+func linkWithOutput(stdout io.Writer, linker string, flags ...string) error {
 	if cmdNames, ok := commands[linker]; ok {
-		return execCommand(cmdNames, flags...)
+		return execCommandOutput(stdout, cmdNames, flags...)
 	}
 	cmd := exec.Command(linker, flags...)
-	cmd.Stdout = os.Stdout
+	cmd.Stdout = stdout
 	cmd.Stderr = os.Stderr
 	cmd.Dir = goenv.Get("TINYGOROOT")
 	return cmd.Run()
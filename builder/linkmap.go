@@ -0,0 +1,220 @@
+package builder
+
+// This file implements the -map flag: the linker writes a map file of the
+// linked program, which is then summarized per output section and per Go
+// package.
+//
+// The map files of ld.lld and wasm-ld have the same layout. A header line
+// names the columns: a few numeric columns (such as the address and size)
+// followed by the Out, In and Symbol columns. Output sections start in the Out
+// column, input sections (in the form file:(section)) in the In column and
+// the symbols defined in an input section in the Symbol column:
+//
+//      VMA      LMA     Size Align Out     In      Symbol
+//        0        0     1234     4 .text
+//        0        0       40     4         main.o:(.text.runtime.alloc)
+//        0        0        0     1                 runtime.alloc
+//
+// ld.lld is also asked for a cross reference table (--cref), which lists for
+// each global symbol the file that defines it followed by the files that
+// reference it. This explains why a symbol was kept by --gc-sections. The
+// table follows the map in the map file and is not part of the summary.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// linkerMapFlags returns the flags that make the given linker write a map file
+// to the given path. The linker may run in a different working directory, so
+// the path is made absolute.
+func linkerMapFlags(linker, path string) ([]string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	switch linker {
+	case "ld.lld":
+		return []string{"-Map=" + path, "--cref"}, nil
+	case "wasm-ld":
+		return []string{"-Map=" + path}, nil
+	default:
+		// Linking through a compiler driver like gcc.
+		return []string{"-Wl,-Map=" + path}, nil
+	}
+}
+
+// linkerMapSection is an output section in a linker map, with the size per
+// package of the input sections it contains.
+type linkerMapSection struct {
+	name     string
+	address  uint64
+	size     uint64
+	packages map[string]uint64
+}
+
+// loadLinkerMap reads the map file written by ld.lld or wasm-ld and attributes
+// each input section to a package, based on the first symbol defined in it.
+// Input sections without symbols (such as merged strings) are attributed to
+// "(unnamed)". Non-allocated sections like debug information are skipped.
+func loadLinkerMap(path string) ([]*linkerMapSection, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+
+	// Find the columns in the header.
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("empty linker map: " + path)
+	}
+	header := scanner.Text()
+	columns := strings.Fields(header)
+	sizeColumn := -1
+	for i, column := range columns {
+		if column == "Size" {
+			sizeColumn = i
+		}
+	}
+	outColumn := strings.Index(header, " Out ") + 1
+	inColumn := strings.Index(header, " In ") + 1
+	symbolColumn := strings.Index(header, " Symbol") + 1
+	addressColumns := map[string]bool{"VMA": true, "Addr": true}
+	if sizeColumn < 0 || !addressColumns[columns[0]] || outColumn == 0 || inColumn <= outColumn || symbolColumn <= inColumn {
+		return nil, errors.New("unknown linker map format (only ld.lld and wasm-ld map files are supported): " + path)
+	}
+
+	var sections []*linkerMapSection
+	var section *linkerMapSection // current output section
+	var inputSize uint64          // size of the current input section
+	inputPackage := ""            // package of the current input section
+	flushInput := func() {
+		if section != nil && inputSize != 0 {
+			if inputPackage == "" {
+				inputPackage = "(unnamed)"
+			}
+			section.packages[inputPackage] += inputSize
+		}
+		inputSize = 0
+		inputPackage = ""
+	}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "Cross Reference Table" {
+			break // the map itself has ended
+		}
+		if len(line) <= outColumn {
+			continue
+		}
+		fields := strings.Fields(line[:outColumn])
+		if len(fields) <= sizeColumn {
+			continue
+		}
+		text := line[outColumn:]
+		indent := outColumn + len(text) - len(strings.TrimLeft(text, " "))
+		text = strings.TrimSpace(text)
+		switch {
+		case indent < inColumn:
+			// Output section.
+			flushInput()
+			section = nil
+			if isDebugSection(text) {
+				continue
+			}
+			size, err := strconv.ParseUint(fields[sizeColumn], 16, 64)
+			if err != nil || size == 0 {
+				continue
+			}
+			address, _ := strconv.ParseUint(fields[0], 16, 64) // "-" for some wasm sections
+			section = &linkerMapSection{
+				name:     text,
+				address:  address,
+				size:     size,
+				packages: make(map[string]uint64),
+			}
+			sections = append(sections, section)
+		case indent < symbolColumn:
+			// Input section (or a linker-generated entry like a symbol
+			// assignment in the linker script).
+			flushInput()
+			if section == nil || !strings.Contains(text, ":(") {
+				continue
+			}
+			inputSize, err = strconv.ParseUint(fields[sizeColumn], 16, 64)
+			if err != nil {
+				inputSize = 0
+			}
+		default:
+			// Symbol defined in the current input section.
+			if inputPackage == "" && inputSize != 0 {
+				inputPackage = symbolPackage(text, nil)
+			}
+		}
+	}
+	flushInput()
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return sections, nil
+}
+
+// appendCrossReferenceTable appends the cross reference table that ld.lld
+// printed to its standard output to the map file at the given path. Older
+// versions of ld.lld (before LLVM 12) don't write the table to the map file
+// themselves.
+func appendCrossReferenceTable(path string, table []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(table)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// isDebugSection returns whether the given section name is a section that is
+// not loaded into memory and can therefore be left out of the report.
+func isDebugSection(name string) bool {
+	for _, prefix := range []string{".debug", ".comment", ".symtab", ".strtab", ".shstrtab", ".stack_sizes", ".ARM.attributes", "CUSTOM("} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// printLinkerMap prints the size of each output section in the given linker
+// map and how much of it comes from each package.
+func printLinkerMap(path string) error {
+	sections, err := loadLinkerMap(path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("   address     size | section / package\n")
+	for _, section := range sections {
+		fmt.Printf("0x%08x %8d | %s\n", section.address, section.size, section.name)
+		names := make([]string, 0, len(section.packages))
+		for name := range section.packages {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%19d |   %s\n", section.packages[name], name)
+		}
+	}
+	return nil
+}
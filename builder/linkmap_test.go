@@ -0,0 +1,113 @@
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Map file of ld.lld for a 32-bit target (with -Map and --cref).
+const lldLinkerMap = `     VMA      LMA     Size Align Out     In      Symbol
+       0        0       c0     4 .isr_vector
+       0        0       c0     4         /tmp/tinygo123/main.o:(.isr_vector)
+       0        0        0     1                 __isr_vector
+      c0       c0      1f4     4 .text
+      c0       c0       30     4         /tmp/tinygo123/main.o:(.text.runtime.alloc)
+      c1       c1       30     0                 runtime.alloc
+      f0       f0       60     4         /tmp/tinygo123/main.o:(.text.(*machine.UART).WriteByte)
+      f1       f1       60     0                 (*machine.UART).WriteByte
+     150      150      100     4         /tmp/tinygo123/main.o:(.text.main.main)
+     151      151      100     0                 main.main
+     250      250       64     4         /root/.cache/tinygo/librt-thumbv7em-none-eabi.a(udivsi3.o):(.text)
+     251      251        0     0                 __aeabi_uidiv
+     2b4      2b4       10     4 .rodata
+     2b4      2b4       10     1         <internal>:(.rodata.str1.1)
+20000000      2c4        4     4 .data
+20000000      2c4        4     4         /tmp/tinygo123/main.o:(.data.runtime.heapptr)
+20000000      2c4        4     1                 runtime.heapptr
+20000004      2c8      800     4 .bss
+20000004      2c8      800     1         _stack_top = .
+       0        0     1234     1 .debug_info
+       0        0     1234     1         /tmp/tinygo123/main.o:(.debug_info)
+
+Cross Reference Table
+
+Symbol                                            File
+runtime.alloc                                     /tmp/tinygo123/main.o
+__aeabi_uidiv                                     /root/.cache/tinygo/librt-thumbv7em-none-eabi.a(udivsi3.o)
+                                                  /tmp/tinygo123/main.o
+`
+
+// Map file of wasm-ld (with -Map).
+const wasmLinkerMap = `    Addr      Off     Size Out     In      Symbol
+       -        8       1c TYPE
+       -       24       12 IMPORT
+       -       36        6 FUNCTION
+       -       4a      1a4 CODE
+       2       4c       40         /tmp/tinygo456/main.o:(runtime.alloc)
+       2       4c       40                 runtime.alloc
+      42       8c      164         /tmp/tinygo456/main.o:(main.main)
+      42       8c      164                 main.main
+     400      1f0       20 DATA
+     400      1f6        d         .rodata
+     400      1f6        d         /tmp/tinygo456/main.o:(.rodata..string)
+       -      210       5d CUSTOM(.debug_info)
+`
+
+func TestLoadLinkerMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tinygo-linkmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		name     string
+		contents string
+		sections []*linkerMapSection
+	}{
+		{"ld.lld", lldLinkerMap, []*linkerMapSection{
+			{".isr_vector", 0, 0xc0, map[string]uint64{"(bootstrap)": 0xc0}},
+			{".text", 0xc0, 0x1f4, map[string]uint64{"runtime": 0x30, "machine": 0x60, "main": 0x100, "(bootstrap)": 0x64}},
+			{".rodata", 0x2b4, 0x10, map[string]uint64{"(unnamed)": 0x10}},
+			{".data", 0x20000000, 4, map[string]uint64{"runtime": 4}},
+			{".bss", 0x20000004, 0x800, map[string]uint64{}},
+		}},
+		{"wasm-ld", wasmLinkerMap, []*linkerMapSection{
+			{"TYPE", 0, 0x1c, map[string]uint64{}},
+			{"IMPORT", 0, 0x12, map[string]uint64{}},
+			{"FUNCTION", 0, 6, map[string]uint64{}},
+			{"CODE", 0, 0x1a4, map[string]uint64{"runtime": 0x40, "main": 0x164}},
+			{"DATA", 0x400, 0x20, map[string]uint64{"(unnamed)": 0xd}},
+		}},
+	} {
+		path := filepath.Join(dir, tc.name+".map")
+		err := ioutil.WriteFile(path, []byte(tc.contents), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sections, err := loadLinkerMap(path)
+		if err != nil {
+			t.Errorf("%s: could not load linker map: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(sections, tc.sections) {
+			t.Errorf("%s: unexpected sections", tc.name)
+			for _, section := range sections {
+				t.Logf("  %s 0x%x 0x%x %v", section.name, section.address, section.size, section.packages)
+			}
+		}
+	}
+
+	// Other map files, like the ones of GNU ld, are rejected.
+	path := filepath.Join(dir, "ld.map")
+	err = ioutil.WriteFile(path, []byte("\nMemory Configuration\n\nName             Origin             Length             Attributes\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadLinkerMap(path); err == nil {
+		t.Error("expected an error for a GNU ld map file")
+	}
+}
@@ -1,7 +1,11 @@
 package builder
 
 import (
+	"bufio"
+	"bytes"
 	"debug/elf"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -29,12 +33,25 @@ func (s progSlice) Len() int           { return len(s) }
 func (s progSlice) Less(i, j int) bool { return s[i].Paddr < s[j].Paddr }
 func (s progSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 
-// extractROM extracts a firmware image and the first load address from the
-// given ELF file. It tries to emulate the behavior of objcopy.
-func extractROM(path string) (uint64, []byte, error) {
+// romSegment is a contiguous block of firmware data that must be loaded at the
+// given (physical) address.
+type romSegment struct {
+	addr uint64
+	data []byte
+}
+
+// end returns the address just past the end of the segment.
+func (s *romSegment) end() uint64 {
+	return s.addr + uint64(len(s.data))
+}
+
+// extractROMSegments extracts all loadable segments from the given ELF file,
+// sorted by load address. Adjacent segments are merged. It also returns the
+// entry point of the program.
+func extractROMSegments(path string) ([]*romSegment, uint64, error) {
 	f, err := elf.Open(path)
 	if err != nil {
-		return 0, nil, objcopyError{"failed to open ELF file to extract text segment", err}
+		return nil, 0, objcopyError{"failed to open ELF file to extract text segment", err}
 	}
 	defer f.Close()
 
@@ -64,68 +81,172 @@ func extractROM(path string) (uint64, []byte, error) {
 		progs = append(progs, prog)
 	}
 	if len(progs) == 0 {
-		return 0, nil, objcopyError{"file does not contain ROM segments: " + path, nil}
+		return nil, 0, objcopyError{"file does not contain ROM segments: " + path, nil}
 	}
 	sort.Sort(progs)
 
-	var rom []byte
+	var segments []*romSegment
 	for _, prog := range progs {
-		if prog.Paddr != progs[0].Paddr+uint64(len(rom)) {
-			return 0, nil, objcopyError{"ROM segments are non-contiguous: " + path, nil}
-		}
 		data, err := ioutil.ReadAll(prog.Open())
 		if err != nil {
-			return 0, nil, objcopyError{"failed to extract segment from ELF file: " + path, err}
+			return nil, 0, objcopyError{"failed to extract segment from ELF file: " + path, err}
 		}
-		rom = append(rom, data...)
+		if len(segments) != 0 {
+			last := segments[len(segments)-1]
+			if prog.Paddr < last.end() {
+				return nil, 0, objcopyError{"ROM segments overlap: " + path, nil}
+			}
+			if prog.Paddr == last.end() {
+				last.data = append(last.data, data...)
+				continue
+			}
+		}
+		segments = append(segments, &romSegment{addr: prog.Paddr, data: data})
 	}
-	if progs[0].Paddr < startAddr {
+	if first := segments[0]; first.addr < startAddr && startAddr < first.end() {
 		// The lowest memory address is before the first section. This means
 		// that there is some extra data loaded at the start of the image that
 		// should be discarded.
 		// Example: ELF files where .text doesn't start at address 0 because
 		// there is a bootloader at the start.
-		return startAddr, rom[startAddr-progs[0].Paddr:], nil
-	} else {
-		return progs[0].Paddr, rom, nil
+		first.data = first.data[startAddr-first.addr:]
+		first.addr = startAddr
 	}
+	return segments, f.Entry, nil
 }
 
-// objcopy converts an ELF file to a different (simpler) output file format:
-// .bin or .hex. It extracts only the .text section.
-func objcopy(infile, outfile string) error {
+// objcopy writes the given segments to a different (simpler) output file
+// format than ELF: .bin, .gba, .hex or .srec. In a .bin file, the gaps between
+// segments are filled with the fill byte and the image starts at the given base
+// address, or at the lowest segment address if the base address is 0. Like GNU
+// objcopy, no start address is written to a .hex file if the entry point is 0
+// (for example, because it is unknown).
+func objcopy(outfile string, segments []*romSegment, entry uint64, binFill byte, binBase uint64) error {
 	f, err := os.OpenFile(outfile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	// Read the .text segment.
-	addr, data, err := extractROM(infile)
-	if err != nil {
-		return err
-	}
-
 	// Write to the file, in the correct format.
 	switch filepath.Ext(outfile) {
 	case ".gba":
 		// The address is not stored in a .gba file.
-		_, err := f.Write(data)
+		data, err := flattenSegments(segments, 0, 0)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
 		return err
 	case ".bin":
 		// The address is not stored in a .bin file (therefore you
 		// should use .hex files in most cases).
-		_, err := f.Write(data)
+		data, err := flattenSegments(segments, binFill, binBase)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
 		return err
 	case ".hex":
 		mem := gohex.NewMemory()
-		err := mem.AddBinary(uint32(addr), data)
+		for _, segment := range segments {
+			err := mem.AddBinary(uint32(segment.addr), segment.data)
+			if err != nil {
+				return objcopyError{"failed to create .hex file", err}
+			}
+		}
+		if entry != 0 {
+			mem.SetStartAddress(uint32(entry))
+		}
+		// DumpIntelHex doesn't report write errors, so write to a buffer
+		// first.
+		buf := &bytes.Buffer{}
+		mem.DumpIntelHex(buf, 16)
+		_, err := f.Write(buf.Bytes())
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	case ".srec":
+		err := writeSREC(f, segments, entry)
 		if err != nil {
-			return objcopyError{"failed to create .hex file", err}
+			return objcopyError{"failed to create .srec file", err}
 		}
-		mem.DumpIntelHex(f, 16) // TODO: handle error
-		return nil
+		return f.Close()
 	default:
 		panic("unreachable")
 	}
 }
+
+// maxSegmentGap is the largest gap between segments that flattenSegments will
+// fill. Larger gaps are usually separate memories, like the UICR registers of
+// the nrf chips at 0x10001000, which would otherwise result in huge files.
+const maxSegmentGap = 16 * 1024 * 1024
+
+// flattenSegments creates a single memory image from the given segments,
+// starting at the base address (or the first segment if base is 0). Gaps
+// between segments are filled with the fill byte.
+func flattenSegments(segments []*romSegment, fill byte, base uint64) ([]byte, error) {
+	if base == 0 {
+		base = segments[0].addr
+	}
+	if segments[0].addr < base {
+		return nil, objcopyError{fmt.Sprintf("segment at 0x%x is below the base address 0x%x", segments[0].addr, base), nil}
+	}
+	end := base
+	for _, segment := range segments {
+		if segment.addr-end > maxSegmentGap {
+			return nil, objcopyError{fmt.Sprintf("gap of 0x%x bytes before the segment at 0x%x is too big to fill, use a .hex or .srec file instead", segment.addr-end, segment.addr), nil}
+		}
+		end = segment.end()
+	}
+	image := make([]byte, segments[len(segments)-1].end()-base)
+	for i := range image {
+		image[i] = fill
+	}
+	for _, segment := range segments {
+		copy(image[segment.addr-base:], segment.data)
+	}
+	return image, nil
+}
+
+// writeSREC writes the given segments as Motorola S-records. The address size
+// (16, 24 or 32 bits) depends on the highest address in the file.
+func writeSREC(w io.Writer, segments []*romSegment, entry uint64) error {
+	// Determine the record types to use.
+	dataType, endType, addrSize := 1, 9, 2
+	if end := segments[len(segments)-1].end(); end > 0x1000000 || entry > 0xffffff {
+		dataType, endType, addrSize = 3, 7, 4
+	} else if end > 0x10000 || entry > 0xffff {
+		dataType, endType, addrSize = 2, 8, 3
+	}
+
+	bw := bufio.NewWriter(w)
+	writeRecord := func(recordType, addrSize int, addr uint64, data []byte) {
+		record := make([]byte, 0, 1+addrSize+len(data)+1)
+		record = append(record, byte(addrSize+len(data)+1)) // byte count
+		for i := addrSize - 1; i >= 0; i-- {
+			record = append(record, byte(addr>>(uint(i)*8)))
+		}
+		record = append(record, data...)
+		sum := byte(0)
+		for _, b := range record {
+			sum += b
+		}
+		record = append(record, ^sum) // checksum
+		fmt.Fprintf(bw, "S%d%X\n", recordType, record)
+	}
+
+	writeRecord(0, 2, 0, []byte("tinygo")) // header
+	for _, segment := range segments {
+		for offset := 0; offset < len(segment.data); offset += 32 {
+			end := offset + 32
+			if end > len(segment.data) {
+				end = len(segment.data)
+			}
+			writeRecord(dataType, addrSize, segment.addr+uint64(offset), segment.data[offset:end])
+		}
+	}
+	writeRecord(endType, addrSize, entry, nil) // start address
+	return bw.Flush()
+}
@@ -0,0 +1,87 @@
+package builder
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteSREC(t *testing.T) {
+	testCases := []struct {
+		name     string
+		segments []*romSegment
+		entry    uint64
+		expected string
+	}{
+		{"S1", []*romSegment{{addr: 0x100, data: []byte{1, 2, 3, 4}}}, 0x100, "" +
+			"S009000074696E79676F5C\n" +
+			"S107010001020304ED\n" +
+			"S9030100FB\n"},
+		{"S2", []*romSegment{{addr: 0x10000, data: []byte{0xaa, 0xbb}}}, 0x10000, "" +
+			"S009000074696E79676F5C\n" +
+			"S206010000AABB93\n" +
+			"S804010000FA\n"},
+		{"S3", []*romSegment{{addr: 0x8000000, data: []byte{0xde, 0xad}}}, 0x8000000, "" +
+			"S009000074696E79676F5C\n" +
+			"S30708000000DEAD65\n" +
+			"S70508000000F2\n"},
+	}
+	for _, tc := range testCases {
+		buf := &bytes.Buffer{}
+		err := writeSREC(buf, tc.segments, tc.entry)
+		if err != nil {
+			t.Errorf("%s: could not write S-records: %v", tc.name, err)
+			continue
+		}
+		if buf.String() != tc.expected {
+			t.Errorf("%s: unexpected output:\n%s\nexpected:\n%s", tc.name, buf.String(), tc.expected)
+		}
+	}
+
+	// Segments are split in records of at most 32 bytes.
+	buf := &bytes.Buffer{}
+	err := writeSREC(buf, []*romSegment{{addr: 0, data: make([]byte, 40)}}, 0)
+	if err != nil {
+		t.Fatal("could not write S-records:", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[1], "S123") || !strings.HasPrefix(lines[2], "S10B0020") {
+		t.Errorf("unexpected records for a 40 byte segment:\n%s", buf.String())
+	}
+}
+
+func TestFlattenSegments(t *testing.T) {
+	segments := []*romSegment{
+		{addr: 0x1002, data: []byte{1, 2}},
+		{addr: 0x1006, data: []byte{3}},
+	}
+	testCases := []struct {
+		fill     byte
+		base     uint64
+		expected []byte
+	}{
+		{0xff, 0, []byte{1, 2, 0xff, 0xff, 3}},
+		{0x00, 0x1000, []byte{0, 0, 1, 2, 0, 0, 3}},
+	}
+	for _, tc := range testCases {
+		image, err := flattenSegments(segments, tc.fill, tc.base)
+		if err != nil {
+			t.Errorf("base 0x%x: could not flatten segments: %v", tc.base, err)
+			continue
+		}
+		if !bytes.Equal(image, tc.expected) {
+			t.Errorf("base 0x%x: expected %x, got %x", tc.base, tc.expected, image)
+		}
+	}
+
+	// The base address must not be after the first segment.
+	if _, err := flattenSegments(segments, 0xff, 0x1004); err == nil {
+		t.Error("expected an error for a base address after the first segment")
+	}
+
+	// Separate memories, like the UICR of the nrf chips, can't be flattened.
+	uicr := append(segments, &romSegment{addr: 0x10001000, data: []byte{0}})
+	if _, err := flattenSegments(uicr, 0xff, 0); err == nil {
+		t.Error("expected an error for a huge gap between segments")
+	}
+}
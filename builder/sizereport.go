@@ -0,0 +1,246 @@
+package builder
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// SizeReport is a machine-readable size report of a program, broken down per
+// package, source file and symbol. It is printed with -size=json and -size=csv
+// and can be compared using tinygo size-diff.
+type SizeReport struct {
+	// Section totals of the program. These include code and data that cannot
+	// be attributed to a symbol.
+	Code uint64 `json:"code"`
+	Data uint64 `json:"data"`
+	BSS  uint64 `json:"bss"`
+
+	Packages []SizeReportEntry `json:"packages"`
+	Files    []SizeReportEntry `json:"files"`
+	Symbols  []SizeReportEntry `json:"symbols"`
+}
+
+// Flash usage in regular microcontrollers.
+func (r *SizeReport) Flash() uint64 {
+	return r.Code + r.Data
+}
+
+// Static RAM usage in regular microcontrollers, which includes the stack.
+func (r *SizeReport) RAM() uint64 {
+	return r.Data + r.BSS
+}
+
+// SizeReportEntry is the size of a single package, source file or symbol in a
+// SizeReport. The File field is empty for packages and the Symbol field is empty
+// for packages and files. A function that contains inlined code from other
+// source files has an entry per source file.
+type SizeReportEntry struct {
+	Package string `json:"package"`
+	File    string `json:"file,omitempty"`
+	Symbol  string `json:"symbol,omitempty"`
+	Code    uint64 `json:"code"`
+	ROData  uint64 `json:"rodata"`
+	Data    uint64 `json:"data"`
+	BSS     uint64 `json:"bss"`
+}
+
+// Flash usage in regular microcontrollers.
+func (e *SizeReportEntry) Flash() uint64 {
+	return e.Code + e.ROData + e.Data
+}
+
+// Static RAM usage in regular microcontrollers.
+func (e *SizeReportEntry) RAM() uint64 {
+	return e.Data + e.BSS
+}
+
+// report converts the size statistics into a SizeReport. Packages are sorted by
+// name, files and symbols by package and then by name.
+func (ps *programSize) report() *SizeReport {
+	report := &SizeReport{
+		Code:     ps.Code,
+		Data:     ps.Data,
+		BSS:      ps.BSS,
+		Packages: []SizeReportEntry{},
+		Files:    []SizeReportEntry{},
+		Symbols:  []SizeReportEntry{},
+	}
+	for _, name := range ps.sortedPackageNames() {
+		pkgSize := ps.Packages[name]
+		report.Packages = append(report.Packages, SizeReportEntry{
+			Package: name,
+			Code:    pkgSize.Code,
+			ROData:  pkgSize.ROData,
+			Data:    pkgSize.Data,
+			BSS:     pkgSize.BSS,
+		})
+		for _, filename := range ps.sortedFileNames(name) {
+			fSize := ps.Files[filename]
+			report.Files = append(report.Files, SizeReportEntry{
+				Package: name,
+				File:    filename,
+				Code:    fSize.Code,
+				ROData:  fSize.ROData,
+				Data:    fSize.Data,
+				BSS:     fSize.BSS,
+			})
+		}
+	}
+	for _, symbol := range ps.Symbols {
+		report.Symbols = append(report.Symbols, SizeReportEntry{
+			Package: symbol.Package,
+			File:    symbol.File,
+			Symbol:  symbol.Name,
+			Code:    symbol.Code,
+			ROData:  symbol.ROData,
+			Data:    symbol.Data,
+			BSS:     symbol.BSS,
+		})
+	}
+	sort.SliceStable(report.Symbols, func(i, j int) bool {
+		if report.Symbols[i].Package != report.Symbols[j].Package {
+			return report.Symbols[i].Package < report.Symbols[j].Package
+		}
+		if report.Symbols[i].Symbol != report.Symbols[j].Symbol {
+			return report.Symbols[i].Symbol < report.Symbols[j].Symbol
+		}
+		return report.Symbols[i].File < report.Symbols[j].File
+	})
+	return report
+}
+
+// LoadSizeReport reads a size report from the given file. This can be a report
+// written by -size=json or -size=csv (detected by the .json or .csv file
+// extension), or an ELF file for which a new report is calculated.
+func LoadSizeReport(path string) (*SizeReport, error) {
+	switch filepath.Ext(path) {
+	case ".json":
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		report := &SizeReport{}
+		err = json.NewDecoder(f).Decode(report)
+		if err != nil {
+			return nil, errors.New("could not read size report " + path + ": " + err.Error())
+		}
+		return report, nil
+	case ".csv":
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		report, err := readCSVSizeReport(f)
+		if err != nil {
+			return nil, errors.New("could not read size report " + path + ": " + err.Error())
+		}
+		return report, nil
+	default:
+		sizes, err := loadProgramSize(path)
+		if err != nil {
+			return nil, err
+		}
+		return sizes.report(), nil
+	}
+}
+
+// WriteJSON writes the size report as an indented JSON object.
+func (r *SizeReport) WriteJSON(w io.Writer) error {
+	data, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// The header of a CSV size report. Each row is one of four kinds: "total"
+// (the section totals, with only code, data and bss set), "package", "file" or
+// "symbol".
+var sizeReportCSVHeader = []string{"kind", "package", "file", "symbol", "code", "rodata", "data", "bss"}
+
+// WriteCSV writes the size report as CSV, with one row per package, file and
+// symbol.
+func (r *SizeReport) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write(sizeReportCSVHeader)
+	writeEntry := func(kind string, e SizeReportEntry) {
+		cw.Write([]string{
+			kind,
+			e.Package,
+			e.File,
+			e.Symbol,
+			strconv.FormatUint(e.Code, 10),
+			strconv.FormatUint(e.ROData, 10),
+			strconv.FormatUint(e.Data, 10),
+			strconv.FormatUint(e.BSS, 10),
+		})
+	}
+	writeEntry("total", SizeReportEntry{Code: r.Code, Data: r.Data, BSS: r.BSS})
+	for _, e := range r.Packages {
+		writeEntry("package", e)
+	}
+	for _, e := range r.Files {
+		writeEntry("file", e)
+	}
+	for _, e := range r.Symbols {
+		writeEntry("symbol", e)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// readCSVSizeReport reads a size report as written by WriteCSV.
+func readCSVSizeReport(r io.Reader) (*SizeReport, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(sizeReportCSVHeader)
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 || records[0][0] != sizeReportCSVHeader[0] {
+		return nil, errors.New("missing CSV header")
+	}
+	report := &SizeReport{}
+	for _, record := range records[1:] {
+		var sizes [4]uint64
+		for i := range sizes {
+			sizes[i], err = strconv.ParseUint(record[4+i], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+		}
+		e := SizeReportEntry{
+			Package: record[1],
+			File:    record[2],
+			Symbol:  record[3],
+			Code:    sizes[0],
+			ROData:  sizes[1],
+			Data:    sizes[2],
+			BSS:     sizes[3],
+		}
+		switch record[0] {
+		case "total":
+			report.Code = e.Code
+			report.Data = e.Data
+			report.BSS = e.BSS
+		case "package":
+			report.Packages = append(report.Packages, e)
+		case "file":
+			report.Files = append(report.Files, e)
+		case "symbol":
+			report.Symbols = append(report.Symbols, e)
+		default:
+			return nil, errors.New("unknown row kind: " + record[0])
+		}
+	}
+	return report, nil
+}
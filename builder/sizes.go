@@ -1,20 +1,39 @@
 package builder
 
 import (
+	"debug/dwarf"
 	"debug/elf"
+	"fmt"
+	"path/filepath"
 	"sort"
 	"strings"
+
+	"github.com/tinygo-org/tinygo/goenv"
 )
 
-// programSize contains size statistics per package of a compiled program.
+// programSize contains size statistics per package, source file and symbol of
+// a compiled program.
 type programSize struct {
 	Packages map[string]*packageSize
+	Files    map[string]*fileSize
+	Symbols  []symbolSize
 	Sum      *packageSize
 	Code     uint64
 	Data     uint64
 	BSS      uint64
 }
 
+// Flash usage in regular microcontrollers: code, read-only data (which is part
+// of the code section in the linker scripts) and the initial values of data.
+func (ps *programSize) Flash() uint64 {
+	return ps.Code + ps.Data
+}
+
+// Static RAM usage in regular microcontrollers, which includes the stack.
+func (ps *programSize) RAM() uint64 {
+	return ps.Data + ps.BSS
+}
+
 // sortedPackageNames returns the list of package names (ProgramSize.Packages)
 // sorted alphabetically.
 func (ps *programSize) sortedPackageNames() []string {
@@ -45,6 +64,76 @@ func (ps *packageSize) RAM() uint64 {
 	return ps.Data + ps.BSS
 }
 
+func (ps *packageSize) add(size packageSize) {
+	ps.Code += size.Code
+	ps.ROData += size.ROData
+	ps.Data += size.Data
+	ps.BSS += size.BSS
+}
+
+// fileSize is the size of the code and data that comes from a single source
+// file, according to the DWARF debug information.
+type fileSize struct {
+	Package string
+	packageSize
+}
+
+// symbolSize is the size of a single symbol in the linked object file. A
+// function that contains inlined code from other source files is split up in
+// one symbolSize per source file, so that inlined code is attributed to the
+// package it came from.
+type symbolSize struct {
+	Name    string
+	Package string
+	File    string // empty if unknown
+	packageSize
+}
+
+// sortedFileNames returns the source files of the given package sorted
+// alphabetically.
+func (ps *programSize) sortedFileNames(pkgName string) []string {
+	var names []string
+	for name, file := range ps.Files {
+		if file.Package == pkgName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sortedSymbols returns all symbols sorted by flash usage, then RAM usage
+// (largest first).
+func (ps *programSize) sortedSymbols() []symbolSize {
+	symbols := append([]symbolSize(nil), ps.Symbols...)
+	sort.SliceStable(symbols, func(i, j int) bool {
+		if symbols[i].Flash() != symbols[j].Flash() {
+			return symbols[i].Flash() > symbols[j].Flash()
+		}
+		return symbols[i].RAM() > symbols[j].RAM()
+	})
+	return symbols
+}
+
+// add attributes the given size of a symbol to a package and source file.
+func (ps *programSize) add(name, pkgName, file string, size packageSize) {
+	pkgSize := ps.Packages[pkgName]
+	if pkgSize == nil {
+		pkgSize = &packageSize{}
+		ps.Packages[pkgName] = pkgSize
+	}
+	pkgSize.add(size)
+	if file != "" {
+		fSize := ps.Files[file]
+		if fSize == nil {
+			fSize = &fileSize{Package: pkgName}
+			ps.Files[file] = fSize
+		}
+		fSize.add(size)
+	}
+	ps.Symbols = append(ps.Symbols, symbolSize{Name: name, Package: pkgName, File: file, packageSize: size})
+}
+
 type symbolList []elf.Symbol
 
 func (l symbolList) Len() int {
@@ -65,8 +154,10 @@ func (l symbolList) Swap(i, j int) {
 	l[i], l[j] = l[j], l[i]
 }
 
-// loadProgramSize calculate a program/data size breakdown of each package for a
-// given ELF file.
+// loadProgramSize calculate a program/data size breakdown of each package,
+// source file and symbol for a given ELF file. Code and data is attributed to
+// source files (and thereby to packages) using the DWARF debug information if
+// available, falling back to the symbol name otherwise.
 func loadProgramSize(path string) (*programSize, error) {
 	file, err := elf.Open(path)
 	if err != nil {
@@ -117,46 +208,408 @@ func loadProgramSize(path string) (*programSize, error) {
 	}
 	sort.Sort(symbolList(symbols))
 
-	sizes := map[string]*packageSize{}
+	info := loadSizeDebugInfo(file)
+
+	// The address of a symbol as used in the debug information. On ARM, the
+	// lowest bit of a function address indicates Thumb mode.
+	symbolAddress := func(symbol elf.Symbol) uint64 {
+		if file.Machine == elf.EM_ARM && elf.ST_TYPE(symbol.Info) == elf.STT_FUNC {
+			return symbol.Value &^ 1
+		}
+		return symbol.Value
+	}
+
+	// Learn in which directory each Go package is stored, so that inlined code
+	// and C files in the package directory can be attributed to the package.
+	for _, symbol := range symbols {
+		if elf.ST_TYPE(symbol.Info) != elf.STT_FUNC {
+			continue
+		}
+		pkgName := symbolPackage(symbol.Name, info.packages)
+		if declFile := info.declFiles[symbolAddress(symbol)]; declFile != "" && pkgName != "(bootstrap)" {
+			info.dirPackages[filepath.Dir(declFile)] = pkgName
+		}
+	}
+
+	sizes := &programSize{
+		Packages: map[string]*packageSize{},
+		Files:    map[string]*fileSize{},
+		Code:     sumCode,
+		Data:     sumData,
+		BSS:      sumBSS,
+	}
 	var lastSymbolValue uint64
 	for _, symbol := range symbols {
+		if lastSymbolValue == symbol.Value && lastSymbolValue != 0 {
+			// Aliased symbol, already counted.
+			continue
+		}
+		lastSymbolValue = symbol.Value
 		symType := elf.ST_TYPE(symbol.Info)
-		//bind := elf.ST_BIND(symbol.Info)
 		section := file.Sections[symbol.Section]
-		pkgName := "(bootstrap)"
-		symName := strings.TrimLeft(symbol.Name, "(*")
-		dot := strings.IndexByte(symName, '.')
-		if dot > 0 {
-			pkgName = symName[:dot]
-		}
-		pkgSize := sizes[pkgName]
-		if pkgSize == nil {
-			pkgSize = &packageSize{}
-			sizes[pkgName] = pkgSize
-		}
-		if lastSymbolValue != symbol.Value || lastSymbolValue == 0 {
-			if symType == elf.STT_FUNC {
-				pkgSize.Code += symbol.Size
-			} else if section.Flags&elf.SHF_WRITE != 0 {
-				if section.Type == elf.SHT_NOBITS {
-					pkgSize.BSS += symbol.Size
-				} else {
-					pkgSize.Data += symbol.Size
-				}
+		symPkgName := symbolPackage(symbol.Name, info.packages)
+		address := symbolAddress(symbol)
+		declFile := info.declFiles[address]
+		if symType == elf.STT_FUNC {
+			// Attribute the code of this function to the source files it was
+			// compiled from, which includes inlined functions.
+			remaining := symbol.Size
+			for _, part := range info.codeFiles(address, address+symbol.Size) {
+				sizes.add(symbol.Name, info.filePackage(part.file, symPkgName), part.file, packageSize{Code: part.size})
+				remaining -= part.size
+			}
+			if remaining != 0 {
+				sizes.add(symbol.Name, info.filePackage(declFile, symPkgName), declFile, packageSize{Code: remaining})
+			}
+			continue
+		}
+		var size packageSize
+		if section.Flags&elf.SHF_WRITE != 0 {
+			if section.Type == elf.SHT_NOBITS {
+				size.BSS = symbol.Size
 			} else {
-				pkgSize.ROData += symbol.Size
+				size.Data = symbol.Size
 			}
+		} else {
+			size.ROData = symbol.Size
+		}
+		sizes.add(symbol.Name, info.filePackage(declFile, symPkgName), declFile, size)
+	}
+
+	sizes.Sum = &packageSize{}
+	for _, pkg := range sizes.Packages {
+		sizes.Sum.add(*pkg)
+	}
+
+	return sizes, nil
+}
+
+// symbolPackage returns the package of a symbol based on its name, or
+// "(bootstrap)" for symbols that don't look like Go symbols. The packages, if
+// not nil, are the import paths of all packages in the program. They are used
+// to resolve names that are ambiguous by themselves: gopkg.in/yaml.v2.Unmarshal
+// could also be the Unmarshal method of type v2 in package gopkg.in/yaml.
+func symbolPackage(name string, packages map[string]bool) string {
+	name = strings.TrimLeft(name, "(*")
+	if packages != nil {
+		// The longest package name that is followed by a dot.
+		for i := len(name) - 1; i > 0; i-- {
+			if name[i] == '.' && packages[name[:i]] {
+				return name[:i]
+			}
+		}
+	}
+	// Import paths may contain dots (like github.com/x/y), so the first dot is
+	// not necessarily the end of the import path. But the part of the symbol
+	// name after the import path may also contain slashes, for example in
+	// reflect/types.type:named:github.com/x/y.T. Therefore the import path ends
+	// at the first dot that is not followed by more import path elements: it
+	// is either not followed by a slash at all or it is followed by characters
+	// that cannot appear in an import path.
+	for i := 0; i < len(name); i++ {
+		if name[i] != '.' {
+			continue
+		}
+		if i == 0 {
+			break
+		}
+		rest := name[i+1:]
+		if isMajorVersion(rest) {
+			// A major version suffix like in gopkg.in/yaml.v2.
+			continue
+		}
+		slash := strings.IndexByte(rest, '/')
+		if slash < 0 || strings.IndexFunc(rest[:slash], isNotImportPathRune) >= 0 {
+			return name[:i]
 		}
-		lastSymbolValue = symbol.Value
 	}
+	return "(bootstrap)"
+}
 
-	sum := &packageSize{}
-	for _, pkg := range sizes {
-		sum.Code += pkg.Code
-		sum.ROData += pkg.ROData
-		sum.Data += pkg.Data
-		sum.BSS += pkg.BSS
+// isMajorVersion returns whether the given part of a symbol name starts with a
+// major version suffix of an import path (like v2), followed by a dot.
+func isMajorVersion(s string) bool {
+	if len(s) < 3 || s[0] != 'v' || s[1] < '1' || s[1] > '9' {
+		return false
+	}
+	for i := 2; i < len(s); i++ {
+		if s[i] == '.' {
+			return true
+		}
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
 	}
+	return false
+}
 
-	return &programSize{Packages: sizes, Code: sumCode, Data: sumData, BSS: sumBSS, Sum: sum}, nil
+// isNotImportPathRune returns whether the given rune cannot be part of an
+// import path element.
+func isNotImportPathRune(r rune) bool {
+	switch {
+	case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		return false
+	case r == '-' || r == '.' || r == '_' || r == '~' || r == '+':
+		return false
+	default:
+		return true
+	}
+}
+
+// sizeDebugInfo is the information from the DWARF debug information that is
+// necessary to attribute code and data to source files.
+type sizeDebugInfo struct {
+	lines       []lineRange       // code address ranges, sorted by address
+	declFiles   map[uint64]string // declaring source file of each function and global
+	dirPackages map[string]string // package in each source directory
+	packages    map[string]bool   // import paths of the compiled Go packages
+}
+
+// lineRange is an address range of code that was compiled from a single source
+// file.
+type lineRange struct {
+	start, end uint64
+	file       string
+}
+
+// codeFileSize is the size of the code in an address range that was compiled
+// from a single source file.
+type codeFileSize struct {
+	file string
+	size uint64
+}
+
+// loadSizeDebugInfo reads the line tables and the declaring files of all
+// functions and global variables from the DWARF debug information. If the
+// file has no debug information (for example, when built with -no-debug), it
+// returns an empty sizeDebugInfo so that all code and data will be attributed
+// by symbol name.
+func loadSizeDebugInfo(file *elf.File) *sizeDebugInfo {
+	info := &sizeDebugInfo{
+		declFiles:   map[uint64]string{},
+		dirPackages: map[string]string{},
+	}
+	data, err := file.DWARF()
+	if err != nil {
+		return info
+	}
+
+	r := data.Reader()
+	var files []*dwarf.LineFile
+	for {
+		entry, err := r.Next()
+		if err != nil || entry == nil {
+			break
+		}
+		switch entry.Tag {
+		case dwarf.TagCompileUnit:
+			// Each Go package is compiled as a separate compile unit, which
+			// is named after the import path of the package.
+			name, _ := entry.Val(dwarf.AttrName).(string)
+			if producer, _ := entry.Val(dwarf.AttrProducer).(string); producer == "TinyGo" && name != "" {
+				if info.packages == nil {
+					info.packages = map[string]bool{}
+				}
+				info.packages[name] = true
+			}
+			files = nil
+			lr, err := data.LineReader(entry)
+			if err != nil || lr == nil {
+				continue
+			}
+			files = lr.Files()
+			info.readLines(lr)
+		case dwarf.TagSubprogram:
+			lowpc, ok := entry.Val(dwarf.AttrLowpc).(uint64)
+			if !ok {
+				continue
+			}
+			info.declFiles[lowpc] = declFile(entry, files)
+		case dwarf.TagVariable:
+			// Only global variables have a fixed address (DW_OP_addr).
+			location, ok := entry.Val(dwarf.AttrLocation).([]byte)
+			if !ok || len(location) < 1 || location[0] != 0x03 {
+				continue
+			}
+			var address uint64
+			switch len(location) - 1 {
+			case 4:
+				address = uint64(file.ByteOrder.Uint32(location[1:]))
+			case 8:
+				address = file.ByteOrder.Uint64(location[1:])
+			default:
+				continue
+			}
+			info.declFiles[address] = declFile(entry, files)
+		}
+	}
+	sort.Slice(info.lines, func(i, j int) bool {
+		return info.lines[i].start < info.lines[j].start
+	})
+	return info
+}
+
+// readLines adds the address ranges of all line table rows to the debug info.
+func (info *sizeDebugInfo) readLines(lr *dwarf.LineReader) {
+	var prev, entry dwarf.LineEntry
+	havePrev := false
+	for {
+		if err := lr.Next(&entry); err != nil {
+			// Either io.EOF or a malformed line table. In both cases, stop
+			// reading.
+			return
+		}
+		if havePrev && !prev.EndSequence && prev.File != nil && entry.Address > prev.Address {
+			info.lines = append(info.lines, lineRange{prev.Address, entry.Address, prev.File.Name})
+		}
+		prev = entry
+		havePrev = true
+	}
+}
+
+// codeFiles returns the amount of code per source file in the given address
+// range, in order of first appearance. Code without line information is not
+// included.
+func (info *sizeDebugInfo) codeFiles(start, end uint64) []codeFileSize {
+	var parts []codeFileSize
+	i := sort.Search(len(info.lines), func(i int) bool {
+		return info.lines[i].end > start
+	})
+	for ; i < len(info.lines) && info.lines[i].start < end; i++ {
+		line := info.lines[i]
+		size := minUint64(line.end, end) - maxUint64(line.start, start)
+		found := false
+		for j := range parts {
+			if parts[j].file == line.file {
+				parts[j].size += size
+				found = true
+				break
+			}
+		}
+		if !found {
+			parts = append(parts, codeFileSize{line.file, size})
+		}
+	}
+	return parts
+}
+
+// filePackage returns the package the given source file belongs to, or the
+// fallback if it is not known.
+func (info *sizeDebugInfo) filePackage(file, fallback string) string {
+	if file == "" {
+		return fallback
+	}
+	dir := filepath.Dir(file)
+	if pkgName, ok := info.dirPackages[dir]; ok {
+		return pkgName
+	}
+	for _, root := range []string{goenv.Get("TINYGOROOT"), goenv.Get("GOROOT")} {
+		rel, err := filepath.Rel(filepath.Join(root, "src"), dir)
+		if err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+			return filepath.ToSlash(rel)
+		}
+	}
+	if strings.Contains(filepath.ToSlash(file), "/compiler-rt/") {
+		return "(compiler-rt)"
+	}
+	return fallback
+}
+
+// shortFileName returns the file name relative to the TinyGo or Go source
+// directory, for files in the standard library. Other file names are returned
+// unmodified.
+func shortFileName(file string) string {
+	for _, root := range []string{goenv.Get("TINYGOROOT"), goenv.Get("GOROOT")} {
+		rel, err := filepath.Rel(filepath.Join(root, "src"), file)
+		if err == nil && !strings.HasPrefix(rel, "..") {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return file
+}
+
+// declFile returns the source file in which the given function or variable is
+// declared, or the empty string if unknown.
+func declFile(entry *dwarf.Entry, files []*dwarf.LineFile) string {
+	index, ok := entry.Val(dwarf.AttrDeclFile).(int64)
+	if !ok || index < 0 || int(index) >= len(files) || files[index] == nil {
+		return ""
+	}
+	return files[index].Name
+}
+
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxUint64(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// SizeLimitError is returned when a program uses more flash or RAM than is
+// available on the target. See the flash-size and ram-size properties of the
+// target specification, and the -max-flash and -max-ram flags.
+type SizeLimitError struct {
+	Kind         string // "flash" or "RAM"
+	Size         uint64
+	Limit        uint64
+	Contributors []symbolSize // largest symbols first
+}
+
+func (e *SizeLimitError) Error() string {
+	msg := fmt.Sprintf("%s overflow: program uses %d bytes of %s but only %d bytes are available (%d bytes too many)", e.Kind, e.Size, e.Kind, e.Limit, e.Size-e.Limit)
+	if len(e.Contributors) != 0 {
+		msg += "\ntop contributors:"
+		for _, symbol := range e.Contributors {
+			size := symbol.Flash()
+			if e.Kind == "RAM" {
+				size = symbol.RAM()
+			}
+			name := symbol.Name
+			if symbol.File != "" {
+				name += " (" + shortFileName(symbol.File) + ")"
+			}
+			msg += fmt.Sprintf("\n%7d  %s", size, name)
+		}
+	}
+	return msg
+}
+
+// checkProgramSize checks that the program fits in the given amount of flash
+// and RAM. The flash usage is the size of the final firmware image, which is
+// bigger than the program with an image header or trailer (see -image-format).
+// A limit of 0 means there is no limit.
+func checkProgramSize(sizes *programSize, imageSize, maxFlash, maxRAM uint64) error {
+	const numContributors = 10
+	var errs []error
+	if maxFlash != 0 && imageSize > maxFlash {
+		contributors := sizes.sortedSymbols()
+		if len(contributors) > numContributors {
+			contributors = contributors[:numContributors]
+		}
+		errs = append(errs, &SizeLimitError{"flash", imageSize, maxFlash, contributors})
+	}
+	if maxRAM != 0 && sizes.RAM() > maxRAM {
+		contributors := append([]symbolSize(nil), sizes.Symbols...)
+		sort.SliceStable(contributors, func(i, j int) bool {
+			return contributors[i].RAM() > contributors[j].RAM()
+		})
+		for i, symbol := range contributors {
+			if i == numContributors || symbol.RAM() == 0 {
+				contributors = contributors[:i]
+				break
+			}
+		}
+		errs = append(errs, &SizeLimitError{"RAM", sizes.RAM(), maxRAM, contributors})
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return newMultiError(errs)
 }
@@ -0,0 +1,100 @@
+package builder
+
+import "testing"
+
+func TestSymbolPackage(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		pkg  string
+	}{
+		{"main.main", "main"},
+		{"runtime.alloc", "runtime"},
+		{"internal/task.start", "internal/task"},
+		{"(*github.com/x/y.T).Method", "github.com/x/y"},
+		{"github.com/x/y.init", "github.com/x/y"},
+		{"gopkg.in/yaml.v2.Unmarshal", "gopkg.in/yaml.v2"},
+		{"(*gopkg.in/yaml.v2.Decoder).Decode", "gopkg.in/yaml.v2"},
+		{"reflect/types.type:named:github.com/x/y.T", "reflect/types"},
+		{"reflect/types.type:pointer:named:main.T", "reflect/types"},
+		{"reflect/types.interface:{Error:func:{}{basic:string}}", "reflect/types"},
+		{"main.(*T).String", "main"},
+		{"main.main$1", "main"},
+		{"llvm.memcpy.p0i8.p0i8.i32", "llvm"},
+		{"_start", "(bootstrap)"},
+		{".Lstr", "(bootstrap)"},
+	} {
+		if pkg := symbolPackage(tc.name, nil); pkg != tc.pkg {
+			t.Errorf("symbolPackage(%q): expected %q, got %q", tc.name, tc.pkg, pkg)
+		}
+	}
+
+	// With the packages from the debug information, names that are ambiguous
+	// by themselves are resolved.
+	packages := map[string]bool{
+		"main":          true,
+		"reflect/types": true,
+		"example.com/x": true,
+		"gopkg.in/yaml": true,
+	}
+	for _, tc := range []struct {
+		name string
+		pkg  string
+	}{
+		{"example.com/x.v2.Method", "example.com/x"},
+		{"gopkg.in/yaml.v2.Unmarshal", "gopkg.in/yaml"},
+		{"reflect/types.type:named:example.com/x.T", "reflect/types"},
+		{"main.main$1", "main"},
+		{"runtime.alloc", "runtime"},
+	} {
+		if pkg := symbolPackage(tc.name, packages); pkg != tc.pkg {
+			t.Errorf("symbolPackage(%q, packages): expected %q, got %q", tc.name, tc.pkg, pkg)
+		}
+	}
+}
+
+func TestCheckProgramSize(t *testing.T) {
+	sizes := &programSize{
+		Code: 900,
+		Data: 100,
+		BSS:  400,
+		Symbols: []symbolSize{
+			{Name: "main.main", Package: "main", packageSize: packageSize{Code: 600}},
+			{Name: "runtime.alloc", Package: "runtime", packageSize: packageSize{Code: 300}},
+			{Name: "main.buf", Package: "main", packageSize: packageSize{BSS: 400}},
+			{Name: "main.table", Package: "main", packageSize: packageSize{Data: 100}},
+		},
+	}
+
+	// The program fits, or there is no limit.
+	if err := checkProgramSize(sizes, sizes.Flash(), 1000, 500); err != nil {
+		t.Error("unexpected error for a program that fits:", err)
+	}
+	if err := checkProgramSize(sizes, sizes.Flash(), 0, 0); err != nil {
+		t.Error("unexpected error without limits:", err)
+	}
+
+	// The image header and trailer make the program too big for flash.
+	err := checkProgramSize(sizes, sizes.Flash()+0x200+40, 1000, 500)
+	sizeErr, ok := err.(*SizeLimitError)
+	if !ok {
+		t.Fatalf("expected a *SizeLimitError for the image, got %#v", err)
+	}
+	if sizeErr.Kind != "flash" || sizeErr.Size != 1552 || sizeErr.Limit != 1000 {
+		t.Errorf("unexpected flash error: %v", sizeErr)
+	}
+	if len(sizeErr.Contributors) != 4 || sizeErr.Contributors[0].Name != "main.main" {
+		t.Errorf("expected the largest flash users first, got %v", sizeErr.Contributors)
+	}
+
+	// Both flash and RAM overflow. Only symbols that use RAM contribute to
+	// the RAM overflow.
+	err = checkProgramSize(sizes, sizes.Flash(), 999, 499)
+	multiErr, ok := err.(*MultiError)
+	if !ok || len(multiErr.Errs) != 2 {
+		t.Fatalf("expected two errors, got %#v", err)
+	}
+	ramErr := multiErr.Errs[1].(*SizeLimitError)
+	if ramErr.Kind != "RAM" || ramErr.Size != 500 || len(ramErr.Contributors) != 2 || ramErr.Contributors[0].Name != "main.buf" {
+		t.Errorf("unexpected RAM error: %v", ramErr)
+	}
+}
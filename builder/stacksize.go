@@ -0,0 +1,533 @@
+package builder
+
+// This file implements static stack usage analysis, for -print-stacks and for
+// automatically sizing goroutine stacks. The frame size of each function is
+// read from the .stack_sizes section emitted by the LLVM backend (with
+// -fstack-size-section) and combined with the call graph of the program to
+// calculate the worst-case stack usage of the program entry point and of each
+// goroutine. The call graph is built from the LLVM IR (which knows about
+// indirect calls) and completed with the calls in the object file (which
+// include calls to library functions inserted by the backend).
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"tinygo.org/x/go-llvm"
+)
+
+// Stack sizes of functions implemented in assembly, which don't have an entry
+// in the .stack_sizes section, per architecture.
+var assemblyStackSizes = map[elf.Machine]map[string]uint64{
+	elf.EM_ARM: {
+		"tinygo_getSystemStackPointer": 0,
+		"tinygo_swapTask":              36, // push {r4-r11, lr}
+		"tinygo_switchToScheduler":     36, // tail calls tinygo_swapTask
+		"tinygo_switchToTask":          36, // falls through to tinygo_swapTask
+	},
+}
+
+// Extra space reserved on each automatically sized goroutine stack, in addition
+// to the worst-case stack usage of the goroutine itself. This is used for the
+// task struct at the top of the stack, the stack canary at the bottom, and the
+// exception frame that is pushed on the current stack when an interrupt
+// happens (up to 104 bytes on Cortex-M with a FPU).
+const goroutineStackMargin = 192
+
+// callNode is a single function in the call graph of a program.
+type callNode struct {
+	name     string
+	callees  []string // direct calls, sorted and deduplicated
+	indirect bool     // whether this function calls a function pointer
+	defined  bool     // whether this function is defined in the LLVM IR
+}
+
+// stackUsage is the worst-case stack usage of a function, including the
+// functions it calls. If the stack usage cannot be determined, reason explains
+// why and size is a lower bound.
+type stackUsage struct {
+	size      uint64
+	reason    string
+	unbounded bool // recursion or an indirect call
+}
+
+func (u stackUsage) String() string {
+	if u.reason == "" {
+		return fmt.Sprint(u.size)
+	}
+	kind := "unknown"
+	if u.unbounded {
+		kind = "unbounded"
+	}
+	if u.size != 0 {
+		return fmt.Sprintf("%s (at least %d), %s", kind, u.size, u.reason)
+	}
+	return kind + ", " + u.reason
+}
+
+// buildCallGraph creates a call graph from the given LLVM module. It also
+// gives private functions internal linkage, so that they appear in the symbol
+// table and their frame size can be looked up.
+func buildCallGraph(mod llvm.Module) map[string]*callNode {
+	graph := make(map[string]*callNode)
+	for fn := mod.FirstFunction(); !fn.IsNil(); fn = llvm.NextFunction(fn) {
+		name := fn.Name()
+		if strings.HasPrefix(name, "llvm.") {
+			continue // intrinsic
+		}
+		node := &callNode{name: name, defined: !fn.IsDeclaration()}
+		graph[name] = node
+		if !node.defined {
+			continue
+		}
+		if fn.Linkage() == llvm.PrivateLinkage {
+			fn.SetLinkage(llvm.InternalLinkage)
+		}
+		callees := make(map[string]struct{})
+		for bb := fn.FirstBasicBlock(); !bb.IsNil(); bb = llvm.NextBasicBlock(bb) {
+			for inst := bb.FirstInstruction(); !inst.IsNil(); inst = llvm.NextInstruction(inst) {
+				if inst.IsACallInst().IsNil() {
+					continue
+				}
+				callee := inst.CalledValue()
+				if !callee.IsAConstantExpr().IsNil() && callee.Opcode() == llvm.BitCast {
+					callee = callee.Operand(0)
+				}
+				if callee.IsAFunction().IsNil() {
+					if callee.IsAInlineAsm().IsNil() {
+						node.indirect = true
+					}
+					continue
+				}
+				if strings.HasPrefix(callee.Name(), "llvm.") {
+					continue
+				}
+				callees[callee.Name()] = struct{}{}
+			}
+		}
+		for callee := range callees {
+			node.callees = append(node.callees, callee)
+		}
+		sort.Strings(node.callees)
+	}
+	return graph
+}
+
+// addObjectCalls adds the direct calls in the given object file to the call
+// graph. The backend may insert calls that are not visible in the LLVM IR, like
+// calls to compiler-rt for integer division. Calls are found by looking at the
+// call relocations in the object file, which requires every function to be in
+// a separate section (-ffunction-sections).
+func addObjectCalls(graph map[string]*callNode, path string) error {
+	file, err := elf.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	symbols, err := file.Symbols()
+	if err != nil {
+		return err
+	}
+
+	// On ARM, the lowest bit of a function address indicates Thumb mode.
+	addressMask := ^uint64(0)
+	if file.Machine == elf.EM_ARM {
+		addressMask = ^uint64(1)
+	}
+
+	// functionAt returns the name of the function at the given offset in the
+	// section with the given index, or "" if there is none.
+	functionAt := func(section elf.SectionIndex, offset uint64) string {
+		for _, symbol := range symbols {
+			if symbol.Section != section || elf.ST_TYPE(symbol.Info) != elf.STT_FUNC {
+				continue
+			}
+			start := symbol.Value & addressMask
+			if offset == start || offset > start && offset < start+symbol.Size {
+				return symbol.Name
+			}
+		}
+		return ""
+	}
+
+	callees := make(map[string]map[string]struct{})
+	for _, section := range file.Sections {
+		if section.Type != elf.SHT_REL && section.Type != elf.SHT_RELA {
+			continue
+		}
+		if int(section.Info) >= len(file.Sections) || file.Sections[section.Info].Flags&elf.SHF_EXECINSTR == 0 {
+			continue
+		}
+		data, err := section.Data()
+		if err != nil {
+			return err
+		}
+		entrySize := 8 // Elf32_Rel
+		switch {
+		case file.Class == elf.ELFCLASS64 && section.Type == elf.SHT_RELA:
+			entrySize = 24
+		case file.Class == elf.ELFCLASS64:
+			entrySize = 16
+		case section.Type == elf.SHT_RELA:
+			entrySize = 12
+		}
+		for ; len(data) >= entrySize; data = data[entrySize:] {
+			var offset uint64
+			var symbolIndex, relocationType uint32
+			if file.Class == elf.ELFCLASS64 {
+				offset = file.ByteOrder.Uint64(data)
+				info := file.ByteOrder.Uint64(data[8:])
+				symbolIndex, relocationType = uint32(info>>32), uint32(info)
+			} else {
+				offset = uint64(file.ByteOrder.Uint32(data))
+				info := file.ByteOrder.Uint32(data[4:])
+				symbolIndex, relocationType = info>>8, info&0xff
+			}
+			call, local := isCallRelocation(file.Machine, relocationType)
+			if !call || symbolIndex == 0 || int(symbolIndex) > len(symbols) {
+				continue
+			}
+			caller := functionAt(elf.SectionIndex(section.Info), offset)
+			callee := symbols[symbolIndex-1] // the null symbol is not included
+			if local && (callee.Section == elf.SHN_UNDEF || int(callee.Section) >= len(file.Sections) || file.Sections[callee.Section].Flags&elf.SHF_EXECINSTR == 0) {
+				continue // reference to data
+			}
+			name := callee.Name
+			if elf.ST_TYPE(callee.Info) == elf.STT_SECTION {
+				// Calls to local functions may refer to the section of the
+				// function instead of the function itself. Each function is
+				// in its own section, at the start of it.
+				name = functionAt(callee.Section, 0)
+			}
+			if caller == "" || name == "" {
+				continue
+			}
+			if callees[caller] == nil {
+				callees[caller] = make(map[string]struct{})
+			}
+			callees[caller][name] = struct{}{}
+		}
+	}
+
+	for caller, names := range callees {
+		node := graph[caller]
+		if node == nil {
+			// Not defined in the LLVM IR, so its callees are unknown anyway.
+			continue
+		}
+		for _, callee := range node.callees {
+			names[callee] = struct{}{}
+		}
+		node.callees = node.callees[:0]
+		for callee := range names {
+			node.callees = append(node.callees, callee)
+			if graph[callee] == nil {
+				graph[callee] = &callNode{name: callee}
+			}
+		}
+		sort.Strings(node.callees)
+	}
+	return nil
+}
+
+// isCallRelocation returns whether the given relocation type is used for
+// direct calls (and tail calls) on the given architecture. Some relocation
+// types are used both for calls to functions in the same object file and for
+// references to data: these are only calls if they refer to code (local).
+func isCallRelocation(machine elf.Machine, typ uint32) (call, local bool) {
+	switch machine {
+	case elf.EM_ARM:
+		switch elf.R_ARM(typ) {
+		case elf.R_ARM_CALL, elf.R_ARM_JUMP24, elf.R_ARM_THM_PC22, elf.R_ARM_THM_JUMP24, elf.R_ARM_THM_JUMP19:
+			return true, false
+		}
+	case elf.EM_AARCH64:
+		switch elf.R_AARCH64(typ) {
+		case elf.R_AARCH64_CALL26, elf.R_AARCH64_JUMP26:
+			return true, false
+		}
+	case elf.EM_RISCV:
+		switch elf.R_RISCV(typ) {
+		case elf.R_RISCV_CALL, elf.R_RISCV_CALL_PLT, elf.R_RISCV_JAL:
+			return true, false
+		}
+	case elf.EM_386:
+		switch elf.R_386(typ) {
+		case elf.R_386_PLT32:
+			return true, false
+		case elf.R_386_PC32:
+			return true, true
+		}
+	case elf.EM_X86_64:
+		switch elf.R_X86_64(typ) {
+		case elf.R_X86_64_PLT32:
+			return true, false
+		case elf.R_X86_64_PC32:
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// goroutineEntryPoints returns the start wrappers of all goroutines in the call
+// graph (see createGoroutineStartWrapper in the compiler), sorted by name.
+func goroutineEntryPoints(graph map[string]*callNode) []string {
+	var names []string
+	for name, node := range graph {
+		if node.defined && (strings.HasSuffix(name, "$gowrapper") || strings.HasPrefix(name, ".gowrapper")) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadFunctionStackSizes reads the frame size of each function from the
+// .stack_sizes section of the given ELF file, by function name.
+func loadFunctionStackSizes(path string) (map[string]uint64, error) {
+	file, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	section := file.Section(".stack_sizes")
+	if section == nil {
+		return nil, errors.New("no stack size information found in " + path + " (-print-stacks is not supported on this target)")
+	}
+	data, err := section.Data()
+	if err != nil {
+		return nil, err
+	}
+
+	// Normalize function addresses: on ARM, the lowest bit of a function
+	// address indicates Thumb mode.
+	addressMask := ^uint64(0)
+	if file.Machine == elf.EM_ARM {
+		addressMask = ^uint64(1)
+	}
+
+	// Each entry is a function address followed by the frame size as an
+	// ULEB128 number.
+	sizes := make(map[uint64]uint64)
+	addressSize := 4
+	if file.Class == elf.ELFCLASS64 {
+		addressSize = 8
+	}
+	for len(data) != 0 {
+		if len(data) < addressSize {
+			return nil, errors.New("invalid .stack_sizes section in " + path)
+		}
+		var address uint64
+		if addressSize == 8 {
+			address = file.ByteOrder.Uint64(data)
+		} else {
+			address = uint64(file.ByteOrder.Uint32(data))
+		}
+		data = data[addressSize:]
+		var size uint64
+		for shift := uint(0); ; shift += 7 {
+			if len(data) == 0 {
+				return nil, errors.New("invalid .stack_sizes section in " + path)
+			}
+			b := data[0]
+			data = data[1:]
+			size |= uint64(b&0x7f) << shift
+			if b&0x80 == 0 {
+				break
+			}
+		}
+		sizes[address&addressMask] = size
+	}
+
+	symbols, err := file.Symbols()
+	if err != nil {
+		return nil, err
+	}
+	functionSizes := make(map[string]uint64)
+	for _, symbol := range symbols {
+		if elf.ST_TYPE(symbol.Info) != elf.STT_FUNC {
+			continue
+		}
+		if size, ok := sizes[symbol.Value&addressMask]; ok {
+			functionSizes[symbol.Name] = size
+		}
+	}
+	for name, size := range assemblyStackSizes[file.Machine] {
+		functionSizes[name] = size
+	}
+	return functionSizes, nil
+}
+
+// stackAnalysis calculates the worst-case stack usage of functions in a call
+// graph.
+type stackAnalysis struct {
+	graph      map[string]*callNode
+	frameSizes map[string]uint64
+	results    map[string]stackUsage
+	visiting   map[string]bool
+}
+
+// usage returns the worst-case stack usage of the given function, including
+// all functions it (transitively) calls. Recursion and indirect calls make the
+// stack usage unbounded, calls to functions with an unknown frame size make it
+// unknown.
+func (a *stackAnalysis) usage(name string, path []string) stackUsage {
+	if result, ok := a.results[name]; ok {
+		return result
+	}
+	if a.visiting[name] {
+		// Print the cycle, starting at the first occurence of this function.
+		var cycle []string
+		for i, fn := range path {
+			if fn == name {
+				cycle = append(cycle, path[i:]...)
+				break
+			}
+		}
+		cycle = append(cycle, name)
+		return stackUsage{reason: "recursion: " + strings.Join(cycle, " -> "), unbounded: true}
+	}
+	frameSize, ok := a.frameSizes[name]
+	if !ok {
+		return stackUsage{reason: "unknown frame size of " + name}
+	}
+	node := a.graph[name]
+	if node == nil || !node.defined {
+		// Defined outside the LLVM IR (in C or assembly), so the callees are
+		// unknown. Assume it doesn't call any other function.
+		return stackUsage{size: frameSize}
+	}
+
+	a.visiting[name] = true
+	result := stackUsage{size: frameSize}
+	if node.indirect {
+		result.reason = name + " calls a function pointer"
+		result.unbounded = true
+	}
+	recursive := false
+	for _, callee := range node.callees {
+		calleeUsage := a.usage(callee, append(path, name))
+		if strings.HasPrefix(calleeUsage.reason, "recursion: ") {
+			recursive = true
+		}
+		if calleeUsage.reason != "" && result.reason == "" {
+			// Keep the first reason, but continue looking at the other
+			// callees to find the best lower bound.
+			result.reason = calleeUsage.reason
+			result.unbounded = calleeUsage.unbounded
+		}
+		if frameSize+calleeUsage.size > result.size {
+			result.size = frameSize + calleeUsage.size
+		}
+	}
+	a.visiting[name] = false
+	if !recursive {
+		// Results that depend on a recursive call are only valid on the
+		// current path.
+		a.results[name] = result
+	}
+	return result
+}
+
+// newStackAnalysis prepares a stack analysis of the given call graph, using the
+// frame sizes from the given executable.
+func newStackAnalysis(graph map[string]*callNode, executable string) (*stackAnalysis, error) {
+	frameSizes, err := loadFunctionStackSizes(executable)
+	if err != nil {
+		return nil, err
+	}
+	return &stackAnalysis{
+		graph:      graph,
+		frameSizes: frameSizes,
+		results:    make(map[string]stackUsage),
+		visiting:   make(map[string]bool),
+	}, nil
+}
+
+// printStacks prints the worst-case stack usage of the program entry point and
+// of each goroutine.
+func printStacks(graph map[string]*callNode, executable string) error {
+	analysis, err := newStackAnalysis(graph, executable)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-40s %s\n", "function", "stack usage (in bytes)")
+	for _, name := range []string{"Reset_Handler", "main"} {
+		if node := graph[name]; node != nil && node.defined {
+			fmt.Printf("%-40s %s\n", name, analysis.usage(name, nil))
+			break
+		}
+	}
+	for _, name := range goroutineEntryPoints(graph) {
+		fmt.Printf("%-40s %s\n", strings.TrimSuffix(name, "$gowrapper"), analysis.usage(name, nil))
+	}
+	return nil
+}
+
+// setGoroutineStackSizes sets the stack size of each goroutine in the given
+// executable to the worst-case stack usage of the goroutine plus a margin. The
+// stack sizes are stored in globals created by transform.CreateStackSizeLoads,
+// which are initialized to the default stack size. Goroutines with an
+// unbounded or unknown stack usage keep this default.
+func setGoroutineStackSizes(graph map[string]*callNode, executable string) error {
+	analysis, err := newStackAnalysis(graph, executable)
+	if err != nil {
+		return err
+	}
+
+	file, err := elf.Open(executable)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	symbols, err := file.Symbols()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(executable, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, symbol := range symbols {
+		if !strings.HasSuffix(symbol.Name, "$stacksize") {
+			continue
+		}
+		usage := analysis.usage(strings.TrimSuffix(symbol.Name, "$stacksize"), nil)
+		if usage.reason != "" {
+			continue
+		}
+		stackSize := (usage.size + goroutineStackMargin + 15) &^ 15 // align to 16 bytes
+
+		// Find the location of the global in the executable and overwrite
+		// the default stack size.
+		if int(symbol.Section) >= len(file.Sections) {
+			return errors.New("stack size global " + symbol.Name + " is not stored in a section")
+		}
+		section := file.Sections[symbol.Section]
+		if section.Type != elf.SHT_PROGBITS || symbol.Value < section.Addr || symbol.Value+symbol.Size > section.Addr+section.Size {
+			return errors.New("stack size global " + symbol.Name + " is not stored in a data section")
+		}
+		buf := make([]byte, symbol.Size)
+		switch symbol.Size {
+		case 4:
+			file.ByteOrder.PutUint32(buf, uint32(stackSize))
+		case 8:
+			file.ByteOrder.PutUint64(buf, stackSize)
+		default:
+			return fmt.Errorf("stack size global %s has unexpected size %d", symbol.Name, symbol.Size)
+		}
+		_, err := f.WriteAt(buf, int64(section.Offset+symbol.Value-section.Addr))
+		if err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
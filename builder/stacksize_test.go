@@ -0,0 +1,54 @@
+package builder
+
+import "testing"
+
+func TestStackUsage(t *testing.T) {
+	graph := map[string]*callNode{
+		"main":  {name: "main", callees: []string{"a", "b"}, defined: true},
+		"a":     {name: "a", callees: []string{"leaf"}, defined: true},
+		"leaf":  {name: "leaf", defined: true},
+		"b":     {name: "b", callees: []string{"c"}, defined: true},
+		"c":     {name: "c", callees: []string{"b"}, defined: true},
+		"d":     {name: "d", callees: []string{"ext", "leaf"}, defined: true},
+		"ext":   {name: "ext"},
+		"e":     {name: "e", callees: []string{"leaf"}, indirect: true, defined: true},
+		"f":     {name: "f", callees: []string{"cfunc"}, defined: true},
+		"cfunc": {name: "cfunc"},
+	}
+	frameSizes := map[string]uint64{
+		"main":  8,
+		"a":     16,
+		"leaf":  4,
+		"b":     8,
+		"c":     12,
+		"d":     4,
+		"e":     8,
+		"f":     4,
+		"cfunc": 20,
+	}
+	for _, tc := range []struct {
+		name  string
+		usage string
+	}{
+		{"leaf", "4"},
+		{"a", "20"},
+		{"cfunc", "20"}, // defined outside the IR, assumed to be a leaf
+		{"f", "24"},
+		{"b", "unbounded (at least 20), recursion: b -> c -> b"},
+		{"c", "unbounded (at least 20), recursion: c -> b -> c"},
+		{"main", "unbounded (at least 28), recursion: b -> c -> b"},
+		{"d", "unknown (at least 8), unknown frame size of ext"},
+		{"ext", "unknown, unknown frame size of ext"},
+		{"e", "unbounded (at least 12), e calls a function pointer"},
+	} {
+		analysis := &stackAnalysis{
+			graph:      graph,
+			frameSizes: frameSizes,
+			results:    make(map[string]stackUsage),
+			visiting:   make(map[string]bool),
+		}
+		if usage := analysis.usage(tc.name, nil).String(); usage != tc.usage {
+			t.Errorf("stack usage of %s: expected %q, got %q", tc.name, tc.usage, usage)
+		}
+	}
+}
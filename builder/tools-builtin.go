@@ -0,0 +1,103 @@
+// +build byollvm
+
+package builder
+
+// This file runs the tools that are linked into tinygo (Clang and lld). These
+// tools use global state in LLVM (like command line options), so only one of
+// them can run at a time in a process. With ToolProcesses, they are run in a
+// child process instead, so that multiple invocations can run in parallel.
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"unsafe"
+)
+
+/*
+#cgo CXXFLAGS: -fno-rtti
+#include <stdbool.h>
+#include <stdlib.h>
+bool tinygo_clang_driver(int argc, char **argv);
+bool tinygo_link_elf(int argc, char **argv);
+bool tinygo_link_wasm(int argc, char **argv);
+*/
+import "C"
+
+// toolLock makes sure only one built-in tool runs at a time in this process.
+var toolLock sync.Mutex
+
+// RunTool runs the given built-in tool (clang, ld.lld or wasm-ld) with the
+// given arguments in the current process.
+func RunTool(tool string, args ...string) error {
+	toolLock.Lock()
+	defer toolLock.Unlock()
+
+	args = append([]string{"tinygo:" + tool}, args...)
+	var cflag *C.char
+	buf := C.calloc(C.size_t(len(args)), C.size_t(unsafe.Sizeof(cflag)))
+	defer C.free(buf)
+	cflags := (*[1 << 10]*C.char)(unsafe.Pointer(buf))[:len(args):len(args)]
+	for i, flag := range args {
+		cflag := C.CString(flag)
+		cflags[i] = cflag
+		defer C.free(unsafe.Pointer(cflag))
+	}
+	var ok C.bool
+	switch tool {
+	case "clang":
+		ok = C.tinygo_clang_driver(C.int(len(args)), (**C.char)(buf))
+	case "ld.lld":
+		ok = C.tinygo_link_elf(C.int(len(args)), (**C.char)(buf))
+	case "wasm-ld":
+		ok = C.tinygo_link_wasm(C.int(len(args)), (**C.char)(buf))
+	default:
+		return errors.New("unknown built-in tool: " + tool)
+	}
+	if !ok {
+		return errors.New("failed to run built-in " + tool)
+	}
+	return nil
+}
+
+// commandLine returns the command line that runCCompiler or link runs for the
+// given command and arguments, to print it with -x. The built-in tools are
+// shown as subcommands of the current executable, which is how they run with
+// ToolProcesses.
+func commandLine(command string, args []string) ([]string, error) {
+	switch command {
+	case "clang", "ld.lld", "wasm-ld":
+		args, err := compilerArgs(command, args)
+		if err != nil {
+			return nil, err
+		}
+		executable, err := os.Executable()
+		if err != nil {
+			executable = "tinygo"
+		}
+		return append([]string{executable, command}, args...), nil
+	default:
+		return append([]string{lookupCommand(command)}, args...), nil
+	}
+}
+
+// runBuiltinTool runs the given built-in tool, writing its standard output to
+// stdout. With ToolProcesses, it runs in a child process of the current
+// executable. Otherwise it runs in the current process and its output always
+// goes to os.Stdout.
+func runBuiltinTool(stdout io.Writer, tool string, args ...string) error {
+	if !ToolProcesses {
+		return RunTool(tool, args...)
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(executable, append([]string{tool}, args...)...)
+	cmd.Env = append(os.Environ(), toolProcessEnv+"=1")
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,21 @@
+// +build !byollvm
+
+package builder
+
+import "errors"
+
+// commandLine returns the command line that runCCompiler or link runs for the
+// given command and arguments, to print it with -x.
+func commandLine(command string, args []string) ([]string, error) {
+	args, err := compilerArgs(command, args)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{lookupCommand(command)}, args...), nil
+}
+
+// RunTool runs the given built-in tool. This version of tinygo has been built
+// without the built-in tools, so it always returns an error.
+func RunTool(tool string, args ...string) error {
+	return errors.New("tinygo was built without the built-in " + tool)
+}
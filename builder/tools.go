@@ -0,0 +1,25 @@
+package builder
+
+import "os"
+
+// toolProcessEnv is set in the environment of a child process that is started
+// to run a built-in tool. The tool and its arguments are passed as the command
+// line arguments of the child process: os.Args[1] and os.Args[2:].
+const toolProcessEnv = "TINYGO_TOOL_PROCESS"
+
+// ToolProcesses enables running the built-in tools (Clang and lld) in child
+// processes of the current executable, so that multiple invocations can run in
+// parallel. The tools use global state in LLVM, so otherwise they run in the
+// current process, one at a time.
+//
+// This must only be enabled by programs that run the tool (with RunTool) when
+// IsToolProcess returns true, before doing anything else. This is the case for
+// the tinygo command and its tests.
+var ToolProcesses bool
+
+// IsToolProcess returns whether the current process was started to run a
+// built-in tool. The name of the tool is in os.Args[1] and its arguments are
+// in os.Args[2:].
+func IsToolProcess() bool {
+	return os.Getenv(toolProcessEnv) != "" && len(os.Args) >= 2
+}
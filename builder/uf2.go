@@ -1,6 +1,8 @@
 package builder
 
-// This file converts firmware files from BIN to UF2 format before flashing.
+// This file converts firmware files to UF2 format before flashing, and
+// implements the tinygo uf2 command to inspect, verify, convert and merge UF2
+// files.
 //
 // For more information about the UF2 firmware file format, please see:
 // https://github.com/Microsoft/uf2
@@ -10,45 +12,301 @@ package builder
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"path/filepath"
+	"sort"
 	"strconv"
 )
 
-// convertELFFileToUF2File converts an ELF file to a UF2 file.
-func convertELFFileToUF2File(infile, outfile string, uf2FamilyID string) error {
-	// Read the .text segment.
-	targetAddress, data, err := extractROM(infile)
+// writeUF2File writes the given firmware segments to a UF2 file.
+func writeUF2File(outfile string, segments []*romSegment, uf2FamilyID string) error {
+	blocks, err := uf2Blocks(segments, uf2FamilyID)
 	if err != nil {
 		return err
 	}
+	numberUF2Blocks(blocks)
+	return writeUF2Blocks(outfile, blocks)
+}
+
+// The size of the payload of each UF2 block. Blocks start at an address that
+// is a multiple of this size, as some bootloaders (like the one of the RP2040)
+// require.
+const uf2PageSize = 256
+
+// uf2Blocks splits the given segments into UF2 blocks of uf2PageSize bytes,
+// each covering an aligned page of the flash. Bytes of a page that are not part
+// of a segment are filled with 0xff, like erased flash. The blocks still need
+// to be numbered with numberUF2Blocks.
+func uf2Blocks(segments []*romSegment, uf2FamilyID string) ([]*uf2Block, error) {
+	sorted := append([]*romSegment(nil), segments...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].addr < sorted[j].addr
+	})
+	var blocks []*uf2Block
+	var bl *uf2Block // block of the current page
+	for _, segment := range sorted {
+		for offset := 0; offset < len(segment.data); {
+			addr := segment.addr + uint64(offset)
+			page := addr &^ (uf2PageSize - 1)
+			if bl == nil || uint64(bl.targetAddr) != page {
+				var err error
+				bl, err = newUF2Block(uint32(page), uf2FamilyID)
+				if err != nil {
+					return nil, err
+				}
+				for i := range bl.data[:uf2PageSize] {
+					bl.data[i] = 0xff
+				}
+				blocks = append(blocks, bl)
+			}
+			offset += copy(bl.data[addr-page:uf2PageSize], segment.data[offset:])
+		}
+	}
+	return blocks, nil
+}
+
+// numberUF2Blocks sets the block number and the total number of blocks of each
+// block. Blocks are numbered per family, as a bootloader only looks at the
+// blocks of its own family.
+func numberUF2Blocks(blocks []*uf2Block) {
+	counts := make(map[uint32]int)
+	for _, bl := range blocks {
+		bl.SetBlockNo(counts[bl.family()])
+		counts[bl.family()]++
+	}
+	for _, bl := range blocks {
+		bl.SetNumBlocks(counts[bl.family()])
+	}
+}
+
+// writeUF2Blocks writes the given blocks to a UF2 file.
+func writeUF2Blocks(outfile string, blocks []*uf2Block) error {
+	output := make([]byte, 0, len(blocks)*512)
+	for _, bl := range blocks {
+		output = append(output, bl.Bytes()...)
+	}
+	return ioutil.WriteFile(outfile, output, 0644)
+}
 
-	output, _, err := convertBinToUF2(data, uint32(targetAddress), uf2FamilyID)
+// readUF2File reads all blocks from the given UF2 file.
+func readUF2File(path string) ([]*uf2Block, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%512 != 0 {
+		return nil, fmt.Errorf("%s: file size %d is not a multiple of 512 bytes", path, len(data))
+	}
+	var blocks []*uf2Block
+	for i := 0; i < len(data); i += 512 {
+		bl, err := parseUF2Block(data[i : i+512])
+		if err != nil {
+			return nil, fmt.Errorf("%s: block %d: %v", path, i/512, err)
+		}
+		blocks = append(blocks, bl)
+	}
+	return blocks, nil
+}
+
+// PrintUF2Info prints the header of each block in the given UF2 file, followed
+// by a summary per family.
+func PrintUF2Info(path string) error {
+	blocks, err := readUF2File(path)
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(outfile, output, 0644)
+	fmt.Printf("block  address     size  flags       family      number\n")
+	var families []uint32
+	payloads := make(map[uint32]int)
+	counts := make(map[uint32]int)
+	for i, bl := range blocks {
+		fmt.Printf("%5d  0x%08x  %4d  0x%08x  0x%08x  %d/%d\n", i, bl.targetAddr, bl.payloadSize, bl.flags, bl.familyID, bl.blockNo, bl.numBlocks)
+		family := bl.family()
+		if _, ok := counts[family]; !ok {
+			families = append(families, family)
+		}
+		counts[family]++
+		payloads[family] += int(bl.payloadSize)
+	}
+	fmt.Println()
+	for _, family := range families {
+		name := "no family"
+		if family != 0 {
+			name = fmt.Sprintf("family 0x%08x", family)
+		}
+		fmt.Printf("%s: %d blocks, %d bytes\n", name, counts[family], payloads[family])
+	}
+	return nil
 }
 
-// convertBinToUF2 converts the binary bytes in input to UF2 formatted data.
-func convertBinToUF2(input []byte, targetAddr uint32, uf2FamilyID string) ([]byte, int, error) {
-	blocks := split(input, 256)
-	output := make([]byte, 0)
+// VerifyUF2File checks whether the blocks in the given UF2 file are consistent:
+// block numbers and counts must match and blocks of the same family must not
+// overlap.
+func VerifyUF2File(path string) error {
+	blocks, err := readUF2File(path)
+	if err != nil {
+		return err
+	}
+	if len(blocks) == 0 {
+		return errors.New(path + ": file contains no blocks")
+	}
+	if errs := checkUF2Blocks(blocks); len(errs) != 0 {
+		return newMultiError(errs)
+	}
+	return nil
+}
 
-	bl, err := newUF2Block(targetAddr, uf2FamilyID)
+// checkUF2Blocks returns all inconsistencies in the given list of blocks.
+func checkUF2Blocks(blocks []*uf2Block) []error {
+	var errs []error
+	counts := make(map[uint32]int)
+	for _, bl := range blocks {
+		counts[bl.family()]++
+	}
+	next := make(map[uint32]int)
+	ranges := make(map[uint32][]*romSegment)
+	for i, bl := range blocks {
+		family := bl.family()
+		if int(bl.blockNo) != next[family] {
+			errs = append(errs, fmt.Errorf("block %d: expected block number %d, got %d", i, next[family], bl.blockNo))
+		}
+		next[family]++
+		if int(bl.numBlocks) != counts[family] {
+			errs = append(errs, fmt.Errorf("block %d: expected %d blocks in total, got %d", i, counts[family], bl.numBlocks))
+		}
+		if bl.payloadSize == 0 || bl.payloadSize > 476 {
+			errs = append(errs, fmt.Errorf("block %d: invalid payload size %d", i, bl.payloadSize))
+			continue
+		}
+		if bl.flags&(flagNotMainFlash|flagFileContainer) == 0 {
+			ranges[family] = append(ranges[family], &romSegment{addr: uint64(bl.targetAddr), data: bl.payload()})
+		}
+	}
+	for family, segments := range ranges {
+		sort.Slice(segments, func(i, j int) bool {
+			return segments[i].addr < segments[j].addr
+		})
+		for i := 1; i < len(segments); i++ {
+			if segments[i].addr < segments[i-1].end() {
+				errs = append(errs, fmt.Errorf("family 0x%08x: blocks at 0x%08x and 0x%08x overlap", family, segments[i-1].addr, segments[i].addr))
+			}
+		}
+	}
+	return errs
+}
+
+// ConvertUF2File converts a UF2 file back to a .bin, .hex or .srec file. If the
+// UF2 file contains multiple families, the family ID must be specified.
+func ConvertUF2File(infile, outfile, uf2FamilyID string) error {
+	blocks, err := readUF2File(infile)
 	if err != nil {
-		return nil, 0, err
+		return err
+	}
+	var familyID uint32
+	if uf2FamilyID != "" {
+		v, err := strconv.ParseUint(uf2FamilyID, 0, 32)
+		if err != nil {
+			return err
+		}
+		familyID = uint32(v)
 	}
-	bl.SetNumBlocks(len(blocks))
 
-	for i := 0; i < len(blocks); i++ {
-		bl.SetBlockNo(i)
-		bl.SetData(blocks[i])
+	// Collect the payloads of all blocks that must be flashed.
+	var segments []*romSegment
+	families := make(map[uint32]struct{})
+	for _, bl := range blocks {
+		if bl.flags&(flagNotMainFlash|flagFileContainer) != 0 {
+			continue
+		}
+		if uf2FamilyID != "" && bl.family() != familyID {
+			continue
+		}
+		families[bl.family()] = struct{}{}
+		segments = append(segments, &romSegment{addr: uint64(bl.targetAddr), data: bl.payload()})
+	}
+	if len(segments) == 0 {
+		return errors.New(infile + ": no blocks to convert")
+	}
+	if len(families) > 1 {
+		return errors.New(infile + ": file contains multiple families, select one with -family")
+	}
 
-		output = append(output, bl.Bytes()...)
-		bl.IncrementAddress(bl.payloadSize)
+	// Merge adjacent blocks into segments.
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].addr < segments[j].addr
+	})
+	merged := segments[:1]
+	for _, segment := range segments[1:] {
+		last := merged[len(merged)-1]
+		if segment.addr < last.end() {
+			return fmt.Errorf("%s: blocks at 0x%08x and 0x%08x overlap", infile, last.addr, segment.addr)
+		}
+		if segment.addr == last.end() {
+			last.data = append(last.data, segment.data...)
+			continue
+		}
+		merged = append(merged, segment)
+	}
+
+	switch filepath.Ext(outfile) {
+	case ".bin", ".hex", ".srec":
+		// The entry point is not stored in a UF2 file.
+		return objcopy(outfile, merged, 0, 0xff, 0)
+	default:
+		return errors.New("unsupported output file, expected .bin, .hex or .srec: " + outfile)
 	}
+}
+
+// UF2Input is a single input file for MergeUF2Files. Address is the load
+// address of a .bin file. FamilyID is the family of the blocks created for this
+// input, and is not used for UF2 inputs.
+type UF2Input struct {
+	Path     string
+	Address  uint64
+	FamilyID string
+}
 
-	return output, len(blocks), nil
+// MergeUF2Files combines several ELF, .bin or UF2 files into a single UF2 file,
+// for example to flash an application together with a settings page or to
+// create a UF2 file for multiple families.
+func MergeUF2Files(outfile string, inputs []UF2Input) error {
+	var blocks []*uf2Block
+	for _, input := range inputs {
+		var segments []*romSegment
+		switch filepath.Ext(input.Path) {
+		case ".uf2":
+			inputBlocks, err := readUF2File(input.Path)
+			if err != nil {
+				return err
+			}
+			blocks = append(blocks, inputBlocks...)
+			continue
+		case ".bin":
+			data, err := ioutil.ReadFile(input.Path)
+			if err != nil {
+				return err
+			}
+			segments = []*romSegment{{addr: input.Address, data: data}}
+		default:
+			var err error
+			segments, _, err = extractROMSegments(input.Path)
+			if err != nil {
+				return err
+			}
+		}
+		inputBlocks, err := uf2Blocks(segments, input.FamilyID)
+		if err != nil {
+			return err
+		}
+		blocks = append(blocks, inputBlocks...)
+	}
+	numberUF2Blocks(blocks)
+	if errs := checkUF2Blocks(blocks); len(errs) != 0 {
+		return newMultiError(errs)
+	}
+	return writeUF2Blocks(outfile, blocks)
 }
 
 const (
@@ -89,15 +347,56 @@ func newUF2Block(targetAddr uint32, uf2FamilyID string) (*uf2Block, error) {
 		targetAddr:  targetAddr,
 		flags:       flags,
 		familyID:    familyID,
-		payloadSize: 256,
+		payloadSize: uf2PageSize,
 		data:        make([]byte, 476),
 	}, nil
 }
 
 const (
+	flagNotMainFlash    = 0x00000001
+	flagFileContainer   = 0x00001000
 	flagFamilyIDPresent = 0x00002000
 )
 
+// parseUF2Block parses a single 512-byte block from a UF2 file.
+func parseUF2Block(buf []byte) (*uf2Block, error) {
+	if len(buf) != 512 {
+		return nil, fmt.Errorf("invalid block size %d", len(buf))
+	}
+	b := &uf2Block{
+		magicStart0: binary.LittleEndian.Uint32(buf[0:]),
+		magicStart1: binary.LittleEndian.Uint32(buf[4:]),
+		flags:       binary.LittleEndian.Uint32(buf[8:]),
+		targetAddr:  binary.LittleEndian.Uint32(buf[12:]),
+		payloadSize: binary.LittleEndian.Uint32(buf[16:]),
+		blockNo:     binary.LittleEndian.Uint32(buf[20:]),
+		numBlocks:   binary.LittleEndian.Uint32(buf[24:]),
+		familyID:    binary.LittleEndian.Uint32(buf[28:]),
+		data:        append([]byte(nil), buf[32:508]...),
+		magicEnd:    binary.LittleEndian.Uint32(buf[508:]),
+	}
+	if b.magicStart0 != uf2MagicStart0 || b.magicStart1 != uf2MagicStart1 || b.magicEnd != uf2MagicEnd {
+		return nil, errors.New("invalid magic number, not a UF2 block")
+	}
+	return b, nil
+}
+
+// family returns the family ID of this block, or 0 if it has none.
+func (b *uf2Block) family() uint32 {
+	if b.flags&flagFamilyIDPresent == 0 {
+		return 0
+	}
+	return b.familyID
+}
+
+// payload returns the data of this block that must be flashed.
+func (b *uf2Block) payload() []byte {
+	if b.payloadSize > uint32(len(b.data)) {
+		return b.data
+	}
+	return b.data[:b.payloadSize]
+}
+
 // Bytes converts the uf2Block to a slice of bytes that can be written to file.
 func (b *uf2Block) Bytes() []byte {
 	buf := bytes.NewBuffer(make([]byte, 0, 512))
@@ -135,17 +434,3 @@ func (b *uf2Block) SetBlockNo(bn int) {
 func (b *uf2Block) SetNumBlocks(total int) {
 	b.numBlocks = uint32(total)
 }
-
-// split splits a slice of bytes into a slice of byte slices of a specific size limit.
-func split(input []byte, limit int) [][]byte {
-	var block []byte
-	output := make([][]byte, 0, len(input)/limit+1)
-	for len(input) >= limit {
-		block, input = input[:limit], input[limit:]
-		output = append(output, block)
-	}
-	if len(input) > 0 {
-		output = append(output, input[:len(input)])
-	}
-	return output
-}
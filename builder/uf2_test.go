@@ -0,0 +1,146 @@
+package builder
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUF2RoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tinygo-uf2")
+	if err != nil {
+		t.Fatal("could not create temporary directory:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Segments that don't start at a page boundary, with a gap of less than
+	// a page between the first two. Blocks cover aligned pages and the parts
+	// of a page that are not in a segment are filled with 0xff.
+	segments := []*romSegment{
+		{addr: 0x2010, data: bytes.Repeat([]byte{0xaa}, 300)},
+		{addr: 0x2180, data: bytes.Repeat([]byte{0x55}, 64)},
+		{addr: 0x3000, data: bytes.Repeat([]byte{0x33}, 256)},
+	}
+	path := filepath.Join(dir, "firmware.uf2")
+	err = writeUF2File(path, segments, "0x68ed2b88")
+	if err != nil {
+		t.Fatal("could not write UF2 file:", err)
+	}
+	blocks, err := readUF2File(path)
+	if err != nil {
+		t.Fatal("could not read UF2 file:", err)
+	}
+	expected := []struct {
+		addr uint32
+		size uint32
+	}{
+		{0x2000, 256},
+		{0x2100, 256},
+		{0x3000, 256},
+	}
+	if len(blocks) != len(expected) {
+		t.Fatalf("expected %d blocks, got %d", len(expected), len(blocks))
+	}
+	for i, bl := range blocks {
+		if bl.targetAddr != expected[i].addr || bl.payloadSize != expected[i].size {
+			t.Errorf("block %d: expected %d bytes at 0x%x, got %d bytes at 0x%x", i, expected[i].size, expected[i].addr, bl.payloadSize, bl.targetAddr)
+		}
+		if bl.blockNo != uint32(i) || bl.numBlocks != 3 {
+			t.Errorf("block %d: unexpected block number %d/%d", i, bl.blockNo, bl.numBlocks)
+		}
+		if bl.family() != 0x68ed2b88 {
+			t.Errorf("block %d: unexpected family 0x%08x", i, bl.family())
+		}
+	}
+	if errs := checkUF2Blocks(blocks); len(errs) != 0 {
+		t.Errorf("unexpected errors in written file: %v", errs)
+	}
+	image := bytes.Repeat([]byte{0xff}, 0x1100) // 0x2000..0x3100
+	for _, segment := range segments {
+		copy(image[segment.addr-0x2000:], segment.data)
+	}
+	for i, bl := range blocks {
+		offset := bl.targetAddr - 0x2000
+		if !bytes.Equal(bl.payload(), image[offset:offset+256]) {
+			t.Errorf("block %d: unexpected payload % x", i, bl.payload())
+		}
+	}
+
+	// Parsing and writing a block must not change it.
+	for i, bl := range blocks {
+		parsed, err := parseUF2Block(bl.Bytes())
+		if err != nil {
+			t.Errorf("block %d: could not parse: %v", i, err)
+		} else if !bytes.Equal(parsed.Bytes(), bl.Bytes()) {
+			t.Errorf("block %d: changed after parsing", i)
+		}
+	}
+	if _, err := parseUF2Block(make([]byte, 512)); err == nil {
+		t.Error("expected an error when parsing a block without magic numbers")
+	}
+
+	// Converting the file back must result in the original data, without a
+	// start address (the entry point is unknown).
+	hexPath := filepath.Join(dir, "firmware.hex")
+	err = ConvertUF2File(path, hexPath, "")
+	if err != nil {
+		t.Fatal("could not convert UF2 file:", err)
+	}
+	hexData, err := ioutil.ReadFile(hexPath)
+	if err != nil {
+		t.Fatal("could not read .hex file:", err)
+	}
+	for _, line := range strings.Split(string(hexData), "\n") {
+		if len(line) >= 9 && (line[7:9] == "03" || line[7:9] == "05") {
+			t.Errorf("unexpected start address record in .hex file: %s", line)
+		}
+	}
+	binPath := filepath.Join(dir, "firmware.bin")
+	err = ConvertUF2File(path, binPath, "")
+	if err != nil {
+		t.Fatal("could not convert UF2 file:", err)
+	}
+	binData, err := ioutil.ReadFile(binPath)
+	if err != nil {
+		t.Fatal("could not read .bin file:", err)
+	}
+	if !bytes.Equal(binData, image) {
+		t.Error("converted .bin file doesn't match the original data")
+	}
+}
+
+func TestUF2Families(t *testing.T) {
+	// Blocks are numbered per family.
+	var blocks []*uf2Block
+	for _, family := range []string{"0x1", "", "0x1", "0x2", ""} {
+		bl, err := newUF2Block(uint32(0x1000+len(blocks)*256), family)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, bl)
+	}
+	numberUF2Blocks(blocks)
+	expected := []struct{ blockNo, numBlocks uint32 }{
+		{0, 2}, {0, 2}, {1, 2}, {0, 1}, {1, 2},
+	}
+	for i, bl := range blocks {
+		if bl.blockNo != expected[i].blockNo || bl.numBlocks != expected[i].numBlocks {
+			t.Errorf("block %d: expected number %d/%d, got %d/%d", i, expected[i].blockNo, expected[i].numBlocks, bl.blockNo, bl.numBlocks)
+		}
+	}
+	if errs := checkUF2Blocks(blocks); len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+
+	// Wrong block numbers and overlapping blocks of the same family are
+	// errors, overlapping blocks of different families are not.
+	blocks[2].blockNo = 0
+	blocks[4].targetAddr = blocks[1].targetAddr
+	blocks[3].targetAddr = blocks[0].targetAddr
+	if errs := checkUF2Blocks(blocks); len(errs) != 2 {
+		t.Errorf("expected 2 errors, got %d: %v", len(errs), errs)
+	}
+}
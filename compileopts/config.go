@@ -5,6 +5,7 @@ package compileopts
 import (
 	"errors"
 	"fmt"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -56,6 +57,9 @@ func (c *Config) GOARCH() string {
 // BuildTags returns the complete list of build tags used during this build.
 func (c *Config) BuildTags() []string {
 	tags := append(c.Target.BuildTags, []string{"tinygo", "gc." + c.GC(), "scheduler." + c.Scheduler()}...)
+	if c.Scheduler() == "tasks" {
+		tags = append(tags, "stackcheck."+c.StackCheck())
+	}
 	for i := 1; i <= c.GoMinorVersion; i++ {
 		tags = append(tags, fmt.Sprintf("go1.%d", i))
 	}
@@ -157,6 +161,93 @@ func (c *Config) ExtraFiles() []string {
 	return c.Target.ExtraFiles
 }
 
+// FlashSize returns the maximum allowed flash usage of the program in bytes, or
+// 0 if there is no limit. It can be set in the target specification and
+// overridden with the -max-flash flag.
+func (c *Config) FlashSize() uint64 {
+	if c.Options.MaxFlash > 0 {
+		return uint64(c.Options.MaxFlash)
+	}
+	return c.Target.FlashSize
+}
+
+// RAMSize returns the maximum allowed static RAM usage (data, bss and stack) of
+// the program in bytes, or 0 if there is no limit. It can be set in the target
+// specification and overridden with the -max-ram flag.
+func (c *Config) RAMSize() uint64 {
+	if c.Options.MaxRAM > 0 {
+		return uint64(c.Options.MaxRAM)
+	}
+	return c.Target.RAMSize
+}
+
+// AutomaticStackSize returns whether goroutine stack sizes should be
+// determined automatically from the worst-case stack usage of each goroutine.
+// It can be set in the target specification and overridden with the
+// -automatic-stack-size flag. This is only possible with the tasks scheduler.
+func (c *Config) AutomaticStackSize() bool {
+	if c.Options.AutoStackSize != nil {
+		return *c.Options.AutoStackSize && c.Scheduler() == "tasks"
+	}
+	return c.Target.AutoStackSize && c.Scheduler() == "tasks"
+}
+
+// StackSize returns the stack size of goroutines whose stack usage cannot be
+// determined automatically (because of recursion or indirect calls, for
+// example). It can be set in the target specification and overridden with the
+// -stack-size flag.
+func (c *Config) StackSize() uint64 {
+	if c.Options.StackSize > 0 {
+		return uint64(c.Options.StackSize)
+	}
+	if c.Target.DefaultStackSize != 0 {
+		return c.Target.DefaultStackSize
+	}
+	return 1024
+}
+
+// StackCheck returns how goroutine stack overflows are detected with the tasks
+// scheduler. Valid values are "none", "canary" (check a canary value at the
+// bottom of the stack on each task switch) and "mpu" (a canary plus a guard
+// region using the MPU, if available).
+func (c *Config) StackCheck() string {
+	if c.Options.StackCheck != "" {
+		return c.Options.StackCheck
+	}
+	if c.Target.StackCheck != "" {
+		return c.Target.StackCheck
+	}
+	return "canary"
+}
+
+// ImageFormat returns the header or trailer to add to firmware images (.bin,
+// .hex, .uf2, etc.) for the bootloader: "crc32", "sha256", "header" or
+// "mcuboot". It returns the empty string for plain firmware images.
+func (c *Config) ImageFormat() string {
+	if c.Options.ImageFormat != "" {
+		return c.Options.ImageFormat
+	}
+	return c.Target.ImageFormat
+}
+
+// ImageHeaderSize returns the size of the image header for image formats that
+// have one, or 0 for other image formats. The space for the header is reserved
+// in front of the program while linking. The default size keeps the vector
+// table after it aligned, as required by VTOR on Cortex-M.
+func (c *Config) ImageHeaderSize() uint64 {
+	var size uint64
+	switch c.ImageFormat() {
+	case "header", "mcuboot":
+		size = 0x200
+	default:
+		return 0
+	}
+	if c.Target.ImageHeaderSize != 0 {
+		size = c.Target.ImageHeaderSize
+	}
+	return size
+}
+
 // DumpSSA returns whether to dump Go SSA while compiling (-dumpssa flag). Only
 // enable this for debugging.
 func (c *Config) DumpSSA() bool {
@@ -223,5 +314,32 @@ func (c *Config) OpenOCDConfiguration() (args []string, err error) {
 
 type TestConfig struct {
 	CompileTestBinary bool
-	// TODO: Filter the test functions to run, include verbose flag, etc
+	Verbose           bool   // print the output of all tests (-v)
+	RunRegexp         string // only run tests matching this regexp (-run)
+	BenchRegexp       string // run benchmarks matching this regexp (-bench)
+	BenchTime         string // run each benchmark for this duration or number of iterations (-benchtime)
+	Cover             bool   // instrument the package under test for code coverage (-cover)
+	CoverProfile      string // write a coverage profile to this file (-coverprofile)
+}
+
+// TestArgs returns the -test.* flags for the test binary. They are compiled
+// into the test binary as most targets don't provide a command line.
+func (c TestConfig) TestArgs() []string {
+	var args []string
+	if c.Verbose {
+		args = append(args, "-test.v")
+	}
+	if c.RunRegexp != "" {
+		args = append(args, "-test.run="+c.RunRegexp)
+	}
+	if c.BenchRegexp != "" {
+		args = append(args, "-test.bench="+c.BenchRegexp)
+	}
+	if c.BenchTime != "" {
+		args = append(args, "-test.benchtime="+c.BenchTime)
+	}
+	if c.CoverProfile != "" {
+		args = append(args, "-test.coverprofile="+filepath.Base(c.CoverProfile))
+	}
+	return args
 }
@@ -3,21 +3,39 @@ package compileopts
 // Options contains extra options to give to the compiler. These options are
 // usually passed from the command line.
 type Options struct {
-	Target        string
-	Opt           string
-	GC            string
-	PanicStrategy string
-	Scheduler     string
-	PrintIR       bool
-	DumpSSA       bool
-	VerifyIR      bool
-	Debug         bool
-	PrintSizes    string
-	CFlags        []string
-	LDFlags       []string
-	Tags          string
-	WasmAbi       string
-	HeapSize      int64
-	TestConfig    TestConfig
-	Programmer    string
+	Target          string
+	Opt             string
+	GC              string
+	PanicStrategy   string
+	Scheduler       string
+	PrintIR         bool
+	DumpSSA         bool
+	VerifyIR        bool
+	Debug           bool
+	PrintSizes      string
+	PrintJSON       bool
+	PrintStacks     bool
+	MapFile         string
+	CompileCommands string
+	PrintCommands   bool
+	Work            bool
+	Parallelism     int
+	CFlags          []string
+	LDFlags         []string
+	GlobalValues    map[string]map[string]string // -X importpath.name=value
+	Tags            string
+	WasmAbi         string
+	HeapSize        int64
+	MaxFlash        int64
+	MaxRAM          int64
+	StackSize       int64
+	AutoStackSize   *bool // nil if not set on the command line
+	CacheSize       int64
+	StackCheck      string
+	BinFill         byte
+	BinBase         uint64
+	ImageFormat     string
+	ImageVersion    string
+	TestConfig      TestConfig
+	Programmer      string
 }
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -48,6 +49,14 @@ type TargetSpec struct {
 	OpenOCDTarget    string   `json:"openocd-target"`
 	OpenOCDTransport string   `json:"openocd-transport"`
 	JLinkDevice      string   `json:"jlink-device"`
+	FlashSize        uint64   `json:"flash-size"`           // available flash in bytes, excluding the bootloader
+	RAMSize          uint64   `json:"ram-size"`             // available RAM in bytes
+	AutoStackSize    bool     `json:"automatic-stack-size"` // size goroutine stacks using stack analysis
+	DefaultStackSize uint64   `json:"default-stack-size"`   // goroutine stack size if it cannot be determined
+	StackCheck       string   `json:"stack-check"`          // goroutine stack overflow detection (none, canary, mpu)
+	ImageFormat      string   `json:"image-format"`         // header or trailer expected by the bootloader
+	ImageHeaderSize  uint64   `json:"image-header-size"`    // space reserved for the image header
+	ImageHeader      bool     `json:"image-header"`         // linker script reserves space for an image header
 }
 
 // copyProperties copies all properties that are set in spec2 into itself.
@@ -126,6 +135,30 @@ func (spec *TargetSpec) copyProperties(spec2 *TargetSpec) {
 	if spec2.JLinkDevice != "" {
 		spec.JLinkDevice = spec2.JLinkDevice
 	}
+	if spec2.FlashSize != 0 {
+		spec.FlashSize = spec2.FlashSize
+	}
+	if spec2.RAMSize != 0 {
+		spec.RAMSize = spec2.RAMSize
+	}
+	if spec2.AutoStackSize {
+		spec.AutoStackSize = spec2.AutoStackSize
+	}
+	if spec2.DefaultStackSize != 0 {
+		spec.DefaultStackSize = spec2.DefaultStackSize
+	}
+	if spec2.StackCheck != "" {
+		spec.StackCheck = spec2.StackCheck
+	}
+	if spec2.ImageFormat != "" {
+		spec.ImageFormat = spec2.ImageFormat
+	}
+	if spec2.ImageHeaderSize != 0 {
+		spec.ImageHeaderSize = spec2.ImageHeaderSize
+	}
+	if spec2.ImageHeader {
+		spec.ImageHeader = spec2.ImageHeader
+	}
 }
 
 // load reads a target specification from the JSON in the given io.Reader. It
@@ -183,6 +216,41 @@ func (spec *TargetSpec) resolveInherits() error {
 	return nil
 }
 
+// IsAbstract returns whether this target specification is only meant to be
+// inherited by other target specifications (like cortex-m.json) and cannot be
+// used directly. It must be called on a target with all inherited properties
+// resolved, like the ones returned by LoadTarget.
+func (spec *TargetSpec) IsAbstract() bool {
+	if spec.Triple == "" {
+		return true
+	}
+	for _, tag := range spec.BuildTags {
+		if tag == "baremetal" {
+			// Baremetal targets cannot be linked without a linker script.
+			return spec.LinkerScript == ""
+		}
+	}
+	return false
+}
+
+// ListTargets returns the names of all built-in target specifications (in the
+// targets directory of TINYGOROOT), including abstract ones. Each name can be
+// passed to LoadTarget.
+func ListTargets() ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(goenv.Get("TINYGOROOT"), "targets"))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(entry.Name(), ".json"))
+	}
+	return names, nil
+}
+
 // Load a target specification.
 func LoadTarget(target string) (*TargetSpec, error) {
 	if target == "" {
@@ -17,3 +17,22 @@ func TestLoadTarget(t *testing.T) {
 		t.Error("LoadTarget failed for wrong reason:", err)
 	}
 }
+
+func TestIsAbstract(t *testing.T) {
+	for target, abstract := range map[string]bool{
+		"cortex-m":      true,
+		"riscv":         true,
+		"cortex-m-qemu": false,
+		"arduino":       false,
+		"wasm":          false,
+	} {
+		spec, err := LoadTarget(target)
+		if err != nil {
+			t.Errorf("could not load target %s: %v", target, err)
+			continue
+		}
+		if spec.IsAbstract() != abstract {
+			t.Errorf("target %s: expected IsAbstract() to be %v", target, abstract)
+		}
+	}
+}
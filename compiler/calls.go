@@ -1,7 +1,7 @@
 package compiler
 
 import (
-	"fmt"
+	"github.com/tinygo-org/tinygo/ir"
 	"golang.org/x/tools/go/ssa"
 	"tinygo.org/x/go-llvm"
 )
@@ -15,20 +15,38 @@ const MaxFieldsPerParam = 3
 
 // Shortcut: create a call to runtime.<fnName> with the given arguments.
 func (c *Compiler) createRuntimeCall(fnName string, args []llvm.Value, name string) llvm.Value {
+	fn, llvmFn := c.getRuntimeFunction(fnName)
+	if !fn.IsExported() {
+		args = append(args, llvm.Undef(c.i8ptrType))            // unused context parameter
+		args = append(args, llvm.ConstPointerNull(c.i8ptrType)) // coroutine handle
+	}
+	return c.createCall(llvmFn, args, name)
+}
+
+// getRuntimeFunction returns runtime.<fnName> and its LLVM function. The
+// function is looked up by name instead of using fn.LLVMFn, as it may have been
+// removed from the module by an optimization pass. Declarations that are not
+// used in any package aren't in the module at all, so they are declared here.
+func (c *Compiler) getRuntimeFunction(fnName string) (*ir.Function, llvm.Value) {
 	runtimePkg := c.ir.Program.ImportedPackage("runtime")
 	member := runtimePkg.Members[fnName]
 	if member == nil {
 		panic("trying to call runtime." + fnName)
 	}
 	fn := c.ir.GetFunction(member.(*ssa.Function))
-	if fn.LLVMFn.IsNil() {
-		panic(fmt.Errorf("function %s does not appear in LLVM IR", fnName))
-	}
-	if !fn.IsExported() {
-		args = append(args, llvm.Undef(c.i8ptrType))            // unused context parameter
-		args = append(args, llvm.ConstPointerNull(c.i8ptrType)) // coroutine handle
+	return fn, c.getFunction(fn)
+}
+
+// getFunction returns the LLVM function of the given function in the current
+// module, declaring it if needed. Package modules only declare the functions
+// of other packages that they use, so fn.LLVMFn may belong to a different
+// module.
+func (c *Compiler) getFunction(fn *ir.Function) llvm.Value {
+	llvmFn := c.mod.NamedFunction(fn.LinkName())
+	if llvmFn.IsNil() {
+		llvmFn = c.parseFuncDecl(fn).fn.LLVMFn
 	}
-	return c.createCall(fn.LLVMFn, args, name)
+	return llvmFn
 }
 
 // Create a call to the given function with the arguments possibly expanded.
@@ -46,6 +46,7 @@ var functionsUsedInTransforms = []string{
 
 var taskFunctionsUsedInTransforms = []string{
 	"runtime.startGoroutine",
+	"runtime.getGoroutineStackSize",
 }
 
 var coroFunctionsUsedInTransforms = []string{
@@ -75,11 +76,14 @@ type Compiler struct {
 	i8ptrType               llvm.Type // for convenience
 	funcPtrAddrSpace        int
 	uintptrType             llvm.Type
-	initFuncs               []llvm.Value
+	pkg                     *ssa.Package // package being compiled (nil for shared functions)
 	interfaceInvokeWrappers []interfaceInvokeWrapper
 	ir                      *ir.Program
 	diagnostics             []error
 	astComments             map[string]*ast.CommentGroup
+	coverCounters           llvm.Value   // counters for code coverage (see coverage.go)
+	coverCounterCount       int          // number of coverage counters
+	coverBlocks             []coverBlock // statements counted by each coverage counter
 }
 
 type Frame struct {
@@ -172,8 +176,9 @@ func (c *Compiler) getFunctionsUsedInTransforms() []string {
 }
 
 // Compile the given package path or .go file path. Return an error when this
-// fails (in any stage).
-func (c *Compiler) Compile(mainPath string) []error {
+// fails (in any stage). Compiled packages are stored in the given cache and
+// loaded from it when they haven't changed. The cache may be nil.
+func (c *Compiler) Compile(mainPath string, cache PackageCache) []error {
 	// Prefix the GOPATH with the system GOROOT, as GOROOT is already set to
 	// the TinyGo root.
 	overlayGopath := goenv.Get("GOPATH")
@@ -243,6 +248,7 @@ func (c *Compiler) Compile(mainPath string) []error {
 		TINYGOROOT:   goenv.Get("TINYGOROOT"),
 		CFlags:       c.CFlags(),
 		ClangHeaders: c.ClangHeaders,
+		TestArgs:     c.TestConfig.TestArgs(),
 	}
 
 	if strings.HasSuffix(mainPath, ".go") {
@@ -276,6 +282,18 @@ func (c *Compiler) Compile(mainPath string) []error {
 	// Run a simple dead code elimination pass.
 	c.ir.SimpleDCE()
 
+	c.loadASTComments(lprogram)
+
+	// Compile each package into a separate module and link them together.
+	// Packages that haven't changed are loaded from the cache instead.
+	err = c.compilePackages(lprogram, cache)
+	if err != nil {
+		return []error{err}
+	}
+	if len(c.diagnostics) != 0 {
+		return c.diagnostics
+	}
+
 	// Initialize debug information.
 	if c.Debug() {
 		c.cu = c.dibuilder.CreateCompileUnit(llvm.DICompileUnit{
@@ -287,38 +305,13 @@ func (c *Compiler) Compile(mainPath string) []error {
 		})
 	}
 
-	var frames []*Frame
-
-	c.loadASTComments(lprogram)
-
-	// Declare all functions.
-	for _, f := range c.ir.Functions {
-		frames = append(frames, c.parseFuncDecl(f))
-	}
-
-	// Add definitions to declarations.
-	for _, frame := range frames {
-		if frame.fn.Synthetic == "package initializer" {
-			c.initFuncs = append(c.initFuncs, frame.fn.LLVMFn)
-		}
-		if frame.fn.CName() != "" {
-			continue
-		}
-		if frame.fn.Blocks == nil {
-			continue // external function
-		}
-		c.parseFunc(frame)
-	}
-
-	// Define the already declared functions that wrap methods for use in
-	// interfaces.
-	for _, state := range c.interfaceInvokeWrappers {
-		c.createInterfaceInvokeWrapper(state)
-	}
+	// Store the coverage counters and blocks, if instrumented.
+	c.finalizeCoverage()
 
 	// After all packages are imported, add a synthetic initializer function
 	// that calls the initializer of each package.
 	initFn := c.ir.GetFunction(c.ir.Program.ImportedPackage("runtime").Members["initAll"].(*ssa.Function))
+	c.parseFuncDecl(initFn)
 	initFn.LLVMFn.SetLinkage(llvm.InternalLinkage)
 	initFn.LLVMFn.SetUnnamedAddr(true)
 	if c.Debug() {
@@ -328,22 +321,28 @@ func (c *Compiler) Compile(mainPath string) []error {
 	}
 	block := c.ctx.AddBasicBlock(initFn.LLVMFn, "entry")
 	c.builder.SetInsertPointAtEnd(block)
-	for _, fn := range c.initFuncs {
-		c.builder.CreateCall(fn, []llvm.Value{llvm.Undef(c.i8ptrType), llvm.Undef(c.i8ptrType)}, "")
+	for _, f := range c.ir.Functions {
+		if f.Synthetic == "package initializer" {
+			fn := c.mod.NamedFunction(f.LinkName())
+			c.builder.CreateCall(fn, []llvm.Value{llvm.Undef(c.i8ptrType), llvm.Undef(c.i8ptrType)}, "")
+		}
 	}
 	c.builder.CreateRetVoid()
 
+	// Functions and globals were only externally visible to link the packages
+	// together.
+	c.internalize()
+
 	// Conserve for goroutine lowering. Without marking these as external, they
 	// would be optimized away.
 	realMain := c.mod.NamedFunction(c.ir.MainPkg().Pkg.Path() + ".main")
 	realMain.SetLinkage(llvm.ExternalLinkage) // keep alive until goroutine lowering
 
-	// Make sure these functions are kept in tact during TinyGo transformation passes.
+	// Make sure these functions are kept in tact during TinyGo transformation
+	// passes. Functions without a body (like runtime.getGoroutineStackSize)
+	// are declared if no package uses them yet.
 	for _, name := range c.getFunctionsUsedInTransforms() {
-		fn := c.mod.NamedFunction(name)
-		if fn.IsNil() {
-			panic(fmt.Errorf("missing core function %q", name))
-		}
+		_, fn := c.getRuntimeFunction(strings.TrimPrefix(name, "runtime."))
 		fn.SetLinkage(llvm.ExternalLinkage)
 	}
 
@@ -384,28 +383,35 @@ func (c *Compiler) Compile(mainPath string) []error {
 		fn.AddAttributeAtIndex(2, readonly)
 	}
 
-	// see: https://reviews.llvm.org/D18355
+	// The debug info module flags were already copied from the package
+	// modules while linking.
 	if c.Debug() {
-		c.mod.AddNamedMetadataOperand("llvm.module.flags",
-			c.ctx.MDNode([]llvm.Metadata{
-				llvm.ConstInt(c.ctx.Int32Type(), 1, false).ConstantAsMetadata(), // Error on mismatch
-				llvm.GlobalContext().MDString("Debug Info Version"),
-				llvm.ConstInt(c.ctx.Int32Type(), 3, false).ConstantAsMetadata(), // DWARF version
-			}),
-		)
-		c.mod.AddNamedMetadataOperand("llvm.module.flags",
-			c.ctx.MDNode([]llvm.Metadata{
-				llvm.ConstInt(c.ctx.Int32Type(), 1, false).ConstantAsMetadata(),
-				llvm.GlobalContext().MDString("Dwarf Version"),
-				llvm.ConstInt(c.ctx.Int32Type(), 4, false).ConstantAsMetadata(),
-			}),
-		)
 		c.dibuilder.Finalize()
 	}
 
 	return c.diagnostics
 }
 
+// addDebugInfoFlags adds the module flags that are required for debug
+// information to the current module.
+func (c *Compiler) addDebugInfoFlags() {
+	// see: https://reviews.llvm.org/D18355
+	c.mod.AddNamedMetadataOperand("llvm.module.flags",
+		c.ctx.MDNode([]llvm.Metadata{
+			llvm.ConstInt(c.ctx.Int32Type(), 1, false).ConstantAsMetadata(), // Error on mismatch
+			llvm.GlobalContext().MDString("Debug Info Version"),
+			llvm.ConstInt(c.ctx.Int32Type(), 3, false).ConstantAsMetadata(), // DWARF version
+		}),
+	)
+	c.mod.AddNamedMetadataOperand("llvm.module.flags",
+		c.ctx.MDNode([]llvm.Metadata{
+			llvm.ConstInt(c.ctx.Int32Type(), 1, false).ConstantAsMetadata(),
+			llvm.GlobalContext().MDString("Dwarf Version"),
+			llvm.ConstInt(c.ctx.Int32Type(), 4, false).ConstantAsMetadata(),
+		}),
+	)
+}
+
 // getRuntimeType obtains a named type from the runtime package and returns it
 // as a Go type.
 func (c *Compiler) getRuntimeType(name string) types.Type {
@@ -824,11 +830,6 @@ func (c *Compiler) parseFunc(frame *Frame) {
 		c.addError(frame.fn.Pos(), errValue)
 		return
 	}
-	if !frame.fn.IsExported() {
-		frame.fn.LLVMFn.SetLinkage(llvm.InternalLinkage)
-		frame.fn.LLVMFn.SetUnnamedAddr(true)
-	}
-
 	// Some functions have a pragma controlling the inlining level.
 	switch frame.fn.Inline() {
 	case ir.InlineHint:
@@ -937,16 +938,27 @@ func (c *Compiler) parseFunc(frame *Frame) {
 	}
 
 	// Fill blocks with instructions.
+	var coverCounters map[*ssa.BasicBlock]int
+	if c.isCovered(frame.fn) {
+		coverCounters = c.addCoverBlocks(frame.fn)
+	}
 	for _, block := range frame.fn.DomPreorder() {
 		if c.DumpSSA() {
 			fmt.Printf("%d: %s:\n", block.Index, block.Comment)
 		}
 		c.builder.SetInsertPointAtEnd(frame.blockEntries[block])
 		frame.currentBlock = block
+		coverCounter, needsCoverCounter := coverCounters[block]
 		for _, instr := range block.Instrs {
 			if _, ok := instr.(*ssa.DebugRef); ok {
 				continue
 			}
+			if _, ok := instr.(*ssa.Phi); !ok && needsCoverCounter {
+				// Count the execution of this block, after the phi nodes
+				// (which must be at the start of the LLVM basic block).
+				c.emitCoverCounter(coverCounter)
+				needsCoverCounter = false
+			}
 			if c.DumpSSA() {
 				if val, ok := instr.(ssa.Value); ok && val.Name() != "" {
 					fmt.Printf("\t%s = %s\n", val.Name(), val.String())
@@ -1025,7 +1037,7 @@ func (c *Compiler) parseInstr(frame *Frame, instr ssa.Instruction) {
 				panic("StaticCallee returned an unexpected value")
 			}
 			params = append(params, context) // context parameter
-			c.emitStartGoroutine(calleeFn.LLVMFn, params)
+			c.emitStartGoroutine(c.getFunction(calleeFn), params)
 		} else if !instr.Call.IsInvoke() {
 			// This is a function pointer.
 			// At the moment, two extra params are passed to the newly started
@@ -1085,6 +1097,14 @@ func (c *Compiler) parseInstr(frame *Frame, instr ssa.Instruction) {
 	case *ssa.Send:
 		c.emitChanSend(frame, instr)
 	case *ssa.Store:
+		if g, ok := instr.Addr.(*ssa.Global); ok && frame.fn.Synthetic == "package initializer" {
+			if _, ok := instr.Val.(*ssa.Const); ok {
+				if _, ok := c.globalValue(g); ok {
+					// The value is set with -X, see setGlobalValues.
+					return
+				}
+			}
+		}
 		llvmAddr := c.getValue(frame, instr.Addr)
 		llvmVal := c.getValue(frame, instr.Val)
 		c.emitNilCheck(frame, llvmAddr, "store")
@@ -1316,9 +1336,6 @@ func (c *Compiler) parseCall(frame *Frame, instr *ssa.CallCommon) (llvm.Value, e
 		}
 
 		targetFunc := c.ir.GetFunction(fn)
-		if targetFunc.LLVMFn.IsNil() {
-			return llvm.Value{}, c.makeError(instr.Pos(), "undefined function: "+targetFunc.LinkName())
-		}
 		var context llvm.Value
 		switch value := instr.Value.(type) {
 		case *ssa.Function:
@@ -1332,7 +1349,7 @@ func (c *Compiler) parseCall(frame *Frame, instr *ssa.CallCommon) (llvm.Value, e
 		default:
 			panic("StaticCallee returned an unexpected value")
 		}
-		return c.parseFunctionCall(frame, instr.Args, targetFunc.LLVMFn, context, targetFunc.IsExported()), nil
+		return c.parseFunctionCall(frame, instr.Args, c.getFunction(targetFunc), context, targetFunc.IsExported()), nil
 	}
 
 	// Builtin or function pointer.
@@ -1361,7 +1378,7 @@ func (c *Compiler) getValue(frame *Frame, expr ssa.Value) llvm.Value {
 			c.addError(expr.Pos(), "cannot use an exported function as value: "+expr.String())
 			return llvm.Undef(c.getLLVMType(expr.Type()))
 		}
-		return c.createFuncValue(fn.LLVMFn, llvm.Undef(c.i8ptrType), fn.Signature)
+		return c.createFuncValue(c.getFunction(fn), llvm.Undef(c.i8ptrType), fn.Signature)
 	case *ssa.Global:
 		value := c.getGlobal(expr)
 		if value.IsNil() {
@@ -0,0 +1,405 @@
+package compiler
+
+// This file implements code coverage instrumentation, for tinygo test -cover.
+// Like go test, coverage is reported per statement: the statements of a
+// function are grouped in blocks of consecutive statements that are always
+// executed together, which are the blocks of the coverage profile. Each block
+// is counted by the SSA basic block that executes its first statement, so
+// blocks that are executed by the same basic block share a counter. The
+// counters and blocks are stored in the testing package, which writes the
+// coverage report at the end of the test run.
+
+import (
+	"go/ast"
+	"go/token"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/tinygo-org/tinygo/ir"
+	"golang.org/x/tools/go/ssa"
+	"tinygo.org/x/go-llvm"
+)
+
+// coverBlock is a block of the coverage profile: a list of consecutive
+// statements that are counted by the same counter.
+type coverBlock struct {
+	file       string // file name as used in coverage profiles: import path + base name
+	line0      int
+	col0       int
+	line1      int
+	col1       int
+	numStmts   int
+	counter    int // index of the counter
+	basicBlock *ssa.BasicBlock
+}
+
+// isCovered returns whether coverage counters should be emitted for the given
+// function. Only the package under test is instrumented, excluding test files.
+func (c *Compiler) isCovered(f *ir.Function) bool {
+	if !c.TestConfig.Cover || f.Synthetic != "" || f.Pkg != c.ir.MainPkg() {
+		return false
+	}
+	filename := c.ir.Program.Fset.Position(f.Pos()).Filename
+	return filename != "" && !strings.HasSuffix(filename, "_test.go") && filepath.Base(filename) != "$testmain.go"
+}
+
+// addCoverBlocks finds the coverage blocks of the given function and assigns a
+// counter to each of them. It returns the counter for each basic block that
+// needs to be counted.
+func (c *Compiler) addCoverBlocks(f *ir.Function) map[*ssa.BasicBlock]int {
+	pkgPath := c.ir.MainPkg().Pkg.Path()
+	counters := make(map[*ssa.BasicBlock]int)
+	for _, block := range findCoverBlocks(c.ir.Program.Fset, f.Function) {
+		block.file = pkgPath + "/" + filepath.Base(block.file)
+		if block.basicBlock == nil {
+			// Statements that are never executed get a counter that is never
+			// incremented.
+			block.counter = c.coverCounterCount
+			c.coverCounterCount++
+		} else if counter, ok := counters[block.basicBlock]; ok {
+			block.counter = counter
+		} else {
+			block.counter = c.coverCounterCount
+			counters[block.basicBlock] = block.counter
+			c.coverCounterCount++
+		}
+		c.coverBlocks = append(c.coverBlocks, block)
+	}
+	return counters
+}
+
+// findCoverBlocks returns the coverage blocks in the body of the given
+// function, with the basic block that executes each of them. The file field of
+// the returned blocks is the full path of the source file.
+func findCoverBlocks(fset *token.FileSet, fn *ssa.Function) []coverBlock {
+	var body *ast.BlockStmt
+	switch syntax := fn.Syntax().(type) {
+	case *ast.FuncDecl:
+		body = syntax.Body
+	case *ast.FuncLit:
+		body = syntax.Body
+	}
+	if body == nil || len(fn.Blocks) == 0 {
+		return nil // external function
+	}
+
+	// Find the basic block of every source position in this function. The
+	// DebugRef instructions make sure that even statements that don't result
+	// in any code (like assigning a constant to a local variable) are found.
+	finder := &coverBlockFinder{
+		fset:   fset,
+		blocks: make(map[token.Pos]*ssa.BasicBlock),
+	}
+	for _, block := range fn.Blocks {
+		for _, instr := range block.Instrs {
+			pos := instr.Pos()
+			if !pos.IsValid() {
+				continue
+			}
+			if _, ok := finder.blocks[pos]; !ok {
+				finder.blocks[pos] = block
+				finder.positions = append(finder.positions, pos)
+			}
+		}
+	}
+	sort.Slice(finder.positions, func(i, j int) bool {
+		return finder.positions[i] < finder.positions[j]
+	})
+
+	finder.addList(body.List, fn.Blocks[0])
+	return finder.coverBlocks
+}
+
+// coverBlockFinder groups the statements of a function in coverage blocks.
+type coverBlockFinder struct {
+	fset        *token.FileSet
+	blocks      map[token.Pos]*ssa.BasicBlock // basic block of each source position
+	positions   []token.Pos                   // all positions in blocks, sorted
+	coverBlocks []coverBlock
+}
+
+// addList adds the coverage blocks of a list of statements. The parent is the
+// basic block that executes the statement this list is part of, which is used
+// for statements that don't have a basic block of their own.
+func (f *coverBlockFinder) addList(list []ast.Stmt, parent *ssa.BasicBlock) {
+	// Find the basic block of each statement. Statements without any code of
+	// their own are executed by the same basic block as the previous
+	// statement, or are never executed if the previous statement doesn't
+	// continue to the next.
+	blocks := make([]*ssa.BasicBlock, len(list))
+	var previous *ssa.BasicBlock
+	reachable := true
+	for i, stmt := range list {
+		blocks[i] = f.basicBlock(stmt)
+		if blocks[i] == nil && reachable {
+			blocks[i] = previous
+		}
+		previous = blocks[i]
+		reachable = true
+		switch stmt.(type) {
+		case *ast.ReturnStmt, *ast.BranchStmt:
+			reachable = false
+		}
+	}
+	// Statements at the start of the list without code of their own are
+	// executed by the same basic block as the first statement that has code.
+	first := parent
+	for _, block := range blocks {
+		if block != nil {
+			first = block
+			break
+		}
+	}
+	for i := range blocks {
+		if blocks[i] != nil {
+			break
+		}
+		blocks[i] = first
+	}
+
+	// Group the statements in blocks. A block ends at a statement with a body
+	// or a function literal, because the block in the coverage profile can't
+	// contain the statements in there.
+	startNewBlock := true
+	for i, stmt := range list {
+		endPos := statementEnd(stmt)
+		start := f.fset.Position(stmt.Pos())
+		end := f.fset.Position(endPos)
+		last := len(f.coverBlocks) - 1
+		if startNewBlock || blocks[i] != f.coverBlocks[last].basicBlock {
+			f.coverBlocks = append(f.coverBlocks, coverBlock{
+				file:       start.Filename,
+				line0:      start.Line,
+				col0:       start.Column,
+				line1:      end.Line,
+				col1:       end.Column,
+				numStmts:   1,
+				basicBlock: blocks[i],
+			})
+		} else {
+			f.coverBlocks[last].line1 = end.Line
+			f.coverBlocks[last].col1 = end.Column
+			f.coverBlocks[last].numStmts++
+		}
+		startNewBlock = f.addBodies(stmt, blocks[i]) || endPos != stmt.End()
+	}
+}
+
+// addBodies adds the coverage blocks of the statement lists nested in the
+// given statement, and returns whether the statement has any.
+func (f *coverBlockFinder) addBodies(stmt ast.Stmt, block *ssa.BasicBlock) bool {
+	switch stmt := stmt.(type) {
+	case *ast.LabeledStmt:
+		return f.addBodies(stmt.Stmt, block)
+	case *ast.BlockStmt:
+		f.addList(stmt.List, block)
+	case *ast.IfStmt:
+		f.addList(stmt.Body.List, block)
+		switch els := stmt.Else.(type) {
+		case *ast.BlockStmt:
+			f.addList(els.List, block)
+		case *ast.IfStmt:
+			f.addList([]ast.Stmt{els}, block)
+		}
+	case *ast.ForStmt:
+		f.addList(stmt.Body.List, block)
+	case *ast.RangeStmt:
+		f.addList(stmt.Body.List, block)
+	case *ast.SwitchStmt:
+		for _, clause := range stmt.Body.List {
+			f.addList(clause.(*ast.CaseClause).Body, block)
+		}
+	case *ast.TypeSwitchStmt:
+		for _, clause := range stmt.Body.List {
+			f.addList(clause.(*ast.CaseClause).Body, block)
+		}
+	case *ast.SelectStmt:
+		for _, clause := range stmt.Body.List {
+			f.addList(clause.(*ast.CommClause).Body, block)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// basicBlock returns the basic block that executes the given statement, or nil
+// if the statement has no code of its own. For statements with a body only the
+// code that is executed once before the body (like the condition of an if
+// statement) is considered.
+func (f *coverBlockFinder) basicBlock(stmt ast.Stmt) *ssa.BasicBlock {
+	start, end := stmt.Pos(), stmt.End()
+	switch stmt := stmt.(type) {
+	case *ast.LabeledStmt:
+		return f.basicBlock(stmt.Stmt)
+	case *ast.BlockStmt:
+		return nil
+	case *ast.IfStmt:
+		end = stmt.Cond.End()
+	case *ast.ForStmt:
+		// The condition is evaluated for every iteration.
+		if stmt.Init == nil {
+			return nil
+		}
+		end = stmt.Init.End()
+	case *ast.RangeStmt:
+		// The key and value are assigned for every iteration.
+		start, end = stmt.X.Pos(), stmt.X.End()
+	case *ast.SwitchStmt:
+		end = stmt.Body.Lbrace
+	case *ast.TypeSwitchStmt:
+		end = stmt.Assign.End()
+	case *ast.SelectStmt:
+		end = stmt.Body.Lbrace
+	}
+	i := sort.Search(len(f.positions), func(i int) bool {
+		return f.positions[i] >= start
+	})
+	if i == len(f.positions) || f.positions[i] >= end {
+		return nil
+	}
+	return f.blocks[f.positions[i]]
+}
+
+// statementEnd returns the end of the given statement in the coverage profile.
+// Like in go test, this is the start of the body for statements with a body
+// and the start of the body of the first function literal in the statement, as
+// the statements in a body and in a function literal have blocks of their own.
+func statementEnd(stmt ast.Stmt) token.Pos {
+	end := stmt.End()
+	switch s := stmt.(type) {
+	case *ast.LabeledStmt:
+		return statementEnd(s.Stmt)
+	case *ast.BlockStmt:
+		end = s.Lbrace
+	case *ast.IfStmt:
+		end = s.Body.Lbrace
+	case *ast.ForStmt:
+		end = s.Body.Lbrace
+	case *ast.RangeStmt:
+		end = s.Body.Lbrace
+	case *ast.SwitchStmt:
+		end = s.Body.Lbrace
+	case *ast.TypeSwitchStmt:
+		end = s.Body.Lbrace
+	case *ast.SelectStmt:
+		end = s.Body.Lbrace
+	}
+	ast.Inspect(stmt, func(node ast.Node) bool {
+		if lit, ok := node.(*ast.FuncLit); ok && lit.Body.Lbrace < end {
+			end = lit.Body.Lbrace
+		}
+		return node != nil && node.Pos() < end
+	})
+	return end
+}
+
+// emitCoverCounter emits an increment of the given coverage counter at the
+// current insert position.
+func (c *Compiler) emitCoverCounter(counter int) {
+	// The global is a placeholder, the real global is created in
+	// finalizeCoverage once the number of counters is known.
+	if c.coverCounters.IsNil() {
+		c.coverCounters = llvm.AddGlobal(c.mod, llvm.ArrayType(c.ctx.Int32Type(), 0), "tinygo.coverCounters.tmp")
+	}
+	ptr := c.builder.CreateInBoundsGEP(c.coverCounters, []llvm.Value{
+		llvm.ConstInt(c.ctx.Int32Type(), 0, false),
+		llvm.ConstInt(c.ctx.Int32Type(), uint64(counter), false),
+	}, "")
+	count := c.builder.CreateLoad(ptr, "cover.count")
+	count = c.builder.CreateAdd(count, llvm.ConstInt(c.ctx.Int32Type(), 1, false), "cover.count")
+	c.builder.CreateStore(count, ptr)
+}
+
+// finalizeCoverage creates the global with all coverage counters and stores
+// the counters and coverage blocks in the testing package (in coverCounters
+// and coverBlocks), so that they can be reported at the end of the test run.
+func (c *Compiler) finalizeCoverage() {
+	if len(c.coverBlocks) == 0 {
+		return // nothing instrumented
+	}
+
+	// Create the real counters global, replacing the placeholder. The
+	// placeholder was created in the module of the main package, which has
+	// been linked into the current module. It doesn't exist if no counter is
+	// ever incremented.
+	countersType := llvm.ArrayType(c.ctx.Int32Type(), c.coverCounterCount)
+	counters := llvm.AddGlobal(c.mod, countersType, "tinygo.coverCounters")
+	counters.SetInitializer(llvm.ConstNull(countersType))
+	counters.SetLinkage(llvm.InternalLinkage)
+	if placeholder := c.mod.NamedGlobal("tinygo.coverCounters.tmp"); !placeholder.IsNil() {
+		placeholder.ReplaceAllUsesWith(llvm.ConstBitCast(counters, placeholder.Type()))
+		placeholder.EraseFromParentAsGlobal()
+	}
+	c.coverCounters = counters
+
+	zero := llvm.ConstInt(c.ctx.Int32Type(), 0, false)
+	if global := c.mod.NamedGlobal("testing.coverCounters"); !global.IsNil() {
+		length := llvm.ConstInt(c.uintptrType, uint64(c.coverCounterCount), false)
+		global.SetInitializer(c.ctx.ConstStruct([]llvm.Value{
+			llvm.ConstGEP(counters, []llvm.Value{zero, zero}),
+			length,
+			length,
+		}, false))
+	}
+
+	global := c.mod.NamedGlobal("testing.coverBlocks")
+	if global.IsNil() {
+		return
+	}
+
+	// Sort all blocks by position, like in the profiles of go test.
+	coverBlocks := c.coverBlocks
+	sort.SliceStable(coverBlocks, func(i, j int) bool {
+		if coverBlocks[i].file != coverBlocks[j].file {
+			return coverBlocks[i].file < coverBlocks[j].file
+		}
+		if coverBlocks[i].line0 != coverBlocks[j].line0 {
+			return coverBlocks[i].line0 < coverBlocks[j].line0
+		}
+		return coverBlocks[i].col0 < coverBlocks[j].col0
+	})
+
+	// Create the backing array for the coverBlocks slice.
+	blockType := global.Type().ElementType().StructElementTypes()[0].ElementType()
+	stringType := blockType.StructElementTypes()[0]
+	files := make(map[string]llvm.Value)
+	blocks := make([]llvm.Value, len(coverBlocks))
+	for i, block := range coverBlocks {
+		file, ok := files[block.file]
+		if !ok {
+			buf := c.ctx.ConstString(block.file, false)
+			fileGlobal := llvm.AddGlobal(c.mod, buf.Type(), "testing.coverBlocks$file")
+			fileGlobal.SetInitializer(buf)
+			fileGlobal.SetLinkage(llvm.InternalLinkage)
+			fileGlobal.SetGlobalConstant(true)
+			fileGlobal.SetUnnamedAddr(true)
+			file = llvm.ConstNamedStruct(stringType, []llvm.Value{
+				llvm.ConstGEP(fileGlobal, []llvm.Value{zero, zero}),
+				llvm.ConstInt(c.uintptrType, uint64(len(block.file)), false),
+			})
+			files[block.file] = file
+		}
+		blocks[i] = llvm.ConstNamedStruct(blockType, []llvm.Value{
+			file,
+			llvm.ConstInt(c.ctx.Int32Type(), uint64(block.line0), false),
+			llvm.ConstInt(c.ctx.Int32Type(), uint64(block.col0), false),
+			llvm.ConstInt(c.ctx.Int32Type(), uint64(block.line1), false),
+			llvm.ConstInt(c.ctx.Int32Type(), uint64(block.col1), false),
+			llvm.ConstInt(c.ctx.Int32Type(), uint64(block.numStmts), false),
+			llvm.ConstInt(c.ctx.Int32Type(), uint64(block.counter), false),
+		})
+	}
+	blocksArray := llvm.ConstArray(blockType, blocks)
+	blocksGlobal := llvm.AddGlobal(c.mod, blocksArray.Type(), "testing.coverBlocks$array")
+	blocksGlobal.SetInitializer(blocksArray)
+	blocksGlobal.SetLinkage(llvm.InternalLinkage)
+	blocksGlobal.SetGlobalConstant(true)
+	length := llvm.ConstInt(c.uintptrType, uint64(len(blocks)), false)
+	global.SetInitializer(c.ctx.ConstStruct([]llvm.Value{
+		llvm.ConstGEP(blocksGlobal, []llvm.Value{zero, zero}),
+		length,
+		length,
+	}, false))
+}
@@ -303,7 +303,7 @@ func (c *Compiler) emitRunDefers(frame *Frame) {
 			forwardParams = append(forwardParams, llvm.Undef(c.i8ptrType))
 
 			// Call real function.
-			c.createCall(callback.LLVMFn, forwardParams, "")
+			c.createCall(c.getFunction(callback), forwardParams, "")
 
 		case *ssa.MakeClosure:
 			// Get the real defer struct type and cast to it.
@@ -330,7 +330,7 @@ func (c *Compiler) emitRunDefers(frame *Frame) {
 			forwardParams = append(forwardParams, llvm.Undef(c.i8ptrType))
 
 			// Call deferred function.
-			c.createCall(fn.LLVMFn, forwardParams, "")
+			c.createCall(c.getFunction(fn), forwardParams, "")
 
 		default:
 			panic("unknown deferred function type")
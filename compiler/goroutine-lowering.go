@@ -152,7 +152,8 @@ func (c *Compiler) lowerTasks() error {
 		realMainWrapper := c.createGoroutineStartWrapper(realMain)
 		c.builder.SetInsertPointBefore(mainCall)
 		zero := llvm.ConstInt(c.uintptrType, 0, false)
-		c.createRuntimeCall("startGoroutine", []llvm.Value{realMainWrapper, zero}, "")
+		stackSize := c.createRuntimeCall("getGoroutineStackSize", []llvm.Value{realMainWrapper}, "stacksize")
+		c.createRuntimeCall("startGoroutine", []llvm.Value{realMainWrapper, zero, stackSize, c.createGoroutineName(realMain)}, "")
 		c.createRuntimeCall("scheduler", nil, "")
 	} else {
 		// Program doesn't need a scheduler. Call main.main directly.
@@ -19,7 +19,8 @@ func (c *Compiler) emitStartGoroutine(funcPtr llvm.Value, params []llvm.Value) l
 		paramBundle = c.builder.CreatePtrToInt(paramBundle, c.uintptrType, "")
 
 		calleeValue := c.createGoroutineStartWrapper(funcPtr)
-		c.createRuntimeCall("startGoroutine", []llvm.Value{calleeValue, paramBundle}, "")
+		stackSize := c.createRuntimeCall("getGoroutineStackSize", []llvm.Value{calleeValue}, "stacksize")
+		c.createRuntimeCall("startGoroutine", []llvm.Value{calleeValue, paramBundle, stackSize, c.createGoroutineName(funcPtr)}, "")
 	case "coroutines":
 		// We roundtrip through runtime.makeGoroutine as a signal (to find these
 		// calls) and to break any optimizations LLVM will try to do: they are
@@ -34,6 +35,32 @@ func (c *Compiler) emitStartGoroutine(funcPtr llvm.Value, params []llvm.Value) l
 	return llvm.Undef(funcPtr.Type().ElementType().ReturnType())
 }
 
+// createGoroutineName returns a string with the name of the function that is
+// started as a goroutine, which is used to report stack overflows. The string
+// is empty if stack overflow detection is disabled or if the function is not
+// known at compile time (when starting a func value).
+func (c *Compiler) createGoroutineName(fn llvm.Value) llvm.Value {
+	stringType := c.getLLVMRuntimeType("_string")
+	if c.StackCheck() == "none" || fn.IsAFunction().IsNil() {
+		return llvm.ConstNull(stringType)
+	}
+	name := fn.Name()
+	global := c.mod.NamedGlobal(name + "$goname")
+	if global.IsNil() {
+		buf := c.ctx.ConstString(name, false)
+		global = llvm.AddGlobal(c.mod, buf.Type(), name+"$goname")
+		global.SetInitializer(buf)
+		global.SetLinkage(llvm.InternalLinkage)
+		global.SetGlobalConstant(true)
+		global.SetUnnamedAddr(true)
+	}
+	zero := llvm.ConstInt(c.ctx.Int32Type(), 0, false)
+	return llvm.ConstNamedStruct(stringType, []llvm.Value{
+		llvm.ConstGEP(global, []llvm.Value{zero, zero}),
+		llvm.ConstInt(c.uintptrType, uint64(len(name)), false),
+	})
+}
+
 // createGoroutineStartWrapper creates a wrapper for the task-based
 // implementation of goroutines. For example, to call a function like this:
 //
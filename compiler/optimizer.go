@@ -133,7 +133,7 @@ func (c *Compiler) Optimize(optLevel, sizeLevel int, inlinerThreshold uint) []er
 	// After TinyGo-specific transforms have finished, undo exporting these functions.
 	for _, name := range c.getFunctionsUsedInTransforms() {
 		fn := c.mod.NamedFunction(name)
-		if fn.IsNil() {
+		if fn.IsNil() || fn.IsDeclaration() {
 			continue
 		}
 		fn.SetLinkage(llvm.InternalLinkage)
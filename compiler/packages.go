@@ -0,0 +1,376 @@
+package compiler
+
+// This file compiles each package into a separate LLVM module, which can be
+// cached, and links these modules together into a single module for the whole
+// program optimization passes (such as interp and the interface lowering).
+//
+// While compiling a package, functions and globals of other packages are only
+// declared, and only if they are used. All functions and globals are externally
+// visible until all modules are linked together, after which they are
+// internalized. Type codes and method sets are needed in multiple packages, so
+// they have linkonce_odr linkage until then.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"go/types"
+	"hash"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/tinygo-org/tinygo/ir"
+	"github.com/tinygo-org/tinygo/loader"
+	"golang.org/x/tools/go/ssa"
+	"tinygo.org/x/go-llvm"
+)
+
+// PackageCache stores the LLVM bitcode of compiled packages, so that packages
+// that haven't changed don't need to be compiled again.
+type PackageCache interface {
+	// Load returns the path of the bitcode file stored under the given key, or
+	// "" if there is none.
+	Load(key string) (string, error)
+
+	// Store stores the bitcode of a package under the given key.
+	Store(key string, bitcode []byte) error
+}
+
+// compilePackages compiles all packages of the program into separate modules,
+// or loads them from the cache, and links them into the current module.
+// Functions that are not part of a package (like method wrappers) are compiled
+// into a separate module that is never cached.
+func (c *Compiler) compilePackages(lprogram *loader.Program, cache PackageCache) error {
+	mod := c.mod
+	dibuilder := c.dibuilder
+	defer func() {
+		c.mod = mod
+		c.dibuilder = dibuilder
+		c.pkg = nil
+		c.difiles = make(map[string]llvm.Metadata)
+		c.ditypes = make(map[types.Type]llvm.Metadata)
+	}()
+
+	// Sort the functions by package, as they are compiled per package.
+	functions := make(map[*ssa.Package][]*ir.Function)
+	for _, f := range c.ir.Functions {
+		functions[f.Pkg] = append(functions[f.Pkg], f)
+	}
+
+	// The output of SSA dumps and coverage instrumentation is created while
+	// compiling, so the cache can't be used with those.
+	if c.DumpSSA() || c.TestConfig.Cover {
+		cache = nil
+	}
+
+	keys := make(map[string]string)
+	for _, lpkg := range lprogram.Sorted() {
+		pkg := c.ir.Program.Package(lpkg.Pkg)
+		if pkg == nil {
+			continue
+		}
+		var key string
+		if cache != nil {
+			var err error
+			key, err = c.packageKey(lpkg, functions[pkg], keys)
+			if err != nil {
+				return err
+			}
+			keys[lpkg.ImportPath] = key
+		}
+
+		var unit llvm.Module
+		if key != "" {
+			path, err := cache.Load(key)
+			if err != nil {
+				return err
+			}
+			if path != "" {
+				buf, err := llvm.NewMemoryBufferFromFile(path)
+				if err != nil {
+					return err
+				}
+				unit, err = c.ctx.ParseIR(buf)
+				if err != nil {
+					return fmt.Errorf("could not load cached package %s: %v", lpkg.ImportPath, err)
+				}
+			}
+		}
+		if unit.IsNil() {
+			numDiagnostics := len(c.diagnostics)
+			unit = c.compilePackage(lpkg.ImportPath, pkg, functions[pkg])
+			if key != "" && len(c.diagnostics) == numDiagnostics {
+				err := cache.Store(key, llvm.WriteBitcodeToMemoryBuffer(unit).Bytes())
+				if err != nil {
+					return err
+				}
+			}
+		}
+		delete(functions, pkg)
+
+		err := llvm.LinkModules(mod, unit)
+		if err != nil {
+			return fmt.Errorf("could not link package %s: %v", lpkg.ImportPath, err)
+		}
+	}
+
+	// Compile the remaining functions, which don't belong to a package.
+	var shared []*ir.Function
+	for _, f := range c.ir.Functions {
+		if _, ok := functions[f.Pkg]; ok {
+			shared = append(shared, f)
+		}
+	}
+	unit := c.compilePackage("shared", nil, shared)
+	err := llvm.LinkModules(mod, unit)
+	if err != nil {
+		return err
+	}
+
+	// The functions were declared in the package modules, which are destroyed
+	// while linking them. Point them to the functions in the linked module
+	// instead. Functions that aren't used anywhere are not part of it.
+	for _, f := range c.ir.Functions {
+		f.LLVMFn = mod.NamedFunction(f.LinkName())
+	}
+	return nil
+}
+
+// compilePackage compiles the given functions and the globals of the given
+// package into a new module. Other functions and globals are only declared.
+func (c *Compiler) compilePackage(name string, pkg *ssa.Package, functions []*ir.Function) llvm.Module {
+	c.mod = c.ctx.NewModule(name)
+	c.mod.SetTarget(c.Triple())
+	c.mod.SetDataLayout(c.targetData.String())
+	c.pkg = pkg
+	c.interfaceInvokeWrappers = nil
+	c.coverCounters = llvm.Value{}
+	if c.Debug() {
+		c.dibuilder = llvm.NewDIBuilder(c.mod)
+		c.difiles = make(map[string]llvm.Metadata)
+		c.ditypes = make(map[types.Type]llvm.Metadata)
+		c.cu = c.dibuilder.CreateCompileUnit(llvm.DICompileUnit{
+			Language:  0xb, // DW_LANG_C99 (0xc, off-by-one?)
+			File:      name,
+			Dir:       "",
+			Producer:  "TinyGo",
+			Optimized: true,
+		})
+	}
+
+	// Declare the functions of this package. Functions of other packages are
+	// declared when they are used (see getFunction).
+	frames := make([]*Frame, len(functions))
+	for i, f := range functions {
+		frames[i] = c.parseFuncDecl(f)
+	}
+
+	// Define all globals of this package, even the ones that are only used in
+	// other packages.
+	if pkg != nil {
+		var names []string
+		for name, member := range pkg.Members {
+			if _, ok := member.(*ssa.Global); ok {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			c.getGlobal(pkg.Members[name].(*ssa.Global))
+		}
+		c.setGlobalValues(pkg)
+	}
+
+	// Add definitions to declarations.
+	for _, frame := range frames {
+		if frame.fn.CName() != "" {
+			continue
+		}
+		if frame.fn.Blocks == nil {
+			continue // external function
+		}
+		c.parseFunc(frame)
+	}
+
+	// Define the already declared functions that wrap methods for use in
+	// interfaces.
+	for _, state := range c.interfaceInvokeWrappers {
+		c.createInterfaceInvokeWrapper(state)
+	}
+
+	// Remove declarations that are not used, to keep cached modules small.
+	for fn := c.mod.FirstFunction(); !fn.IsNil(); {
+		next := llvm.NextFunction(fn)
+		if fn.IsDeclaration() && fn.FirstUse().IsNil() {
+			fn.EraseFromParentAsFunction()
+		}
+		fn = next
+	}
+
+	if c.Debug() {
+		c.addDebugInfoFlags()
+		c.dibuilder.Finalize()
+		c.dibuilder.Destroy()
+	}
+	return c.mod
+}
+
+// packageKey returns the key of a package in the package cache. It includes
+// the compiler configuration, the source files of the package, the functions
+// that are used in the program and the keys of all imported packages and of the
+// runtime. An empty key is returned if the package can't be cached.
+func (c *Compiler) packageKey(lpkg *loader.Package, functions []*ir.Function, keys map[string]string) (string, error) {
+	if len(lpkg.CgoFiles) != 0 {
+		// Packages that use CGo depend on header files, which are not tracked.
+		return "", nil
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "package %s\n", lpkg.ImportPath)
+	fmt.Fprintf(h, "triple %s\n", c.Triple())
+	fmt.Fprintf(h, "cpu %s\n", c.CPU())
+	fmt.Fprintf(h, "features %q\n", c.Features())
+	fmt.Fprintf(h, "tags %q\n", c.BuildTags())
+	fmt.Fprintf(h, "gc %s\n", c.GC())
+	fmt.Fprintf(h, "scheduler %s\n", c.Scheduler())
+	fmt.Fprintf(h, "panic %s\n", c.PanicStrategy())
+	fmt.Fprintf(h, "stack-check %s\n", c.StackCheck())
+	fmt.Fprintf(h, "debug %t\n", c.Debug())
+	fmt.Fprintf(h, "test %t %q\n", c.TestConfig.CompileTestBinary, c.TestConfig.TestArgs())
+
+	// -X flags of this package.
+	pkgPaths := []string{lpkg.ImportPath}
+	if c.ir.Program.Package(lpkg.Pkg) == c.ir.MainPkg() {
+		pkgPaths = append(pkgPaths, "main")
+	}
+	var names []string
+	for _, pkgPath := range pkgPaths {
+		values := c.Options.GlobalValues[pkgPath]
+		names = names[:0]
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(h, "X %s.%s=%q\n", pkgPath, name, values[name])
+		}
+	}
+
+	// Source files.
+	err := c.hashPackageFiles(h, lpkg)
+	if err != nil {
+		return "", err
+	}
+
+	// Functions that are used in the program.
+	names = nil
+	for _, f := range functions {
+		names = append(names, f.LinkName())
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "func %s\n", name)
+	}
+
+	// Imported packages.
+	var imports []string
+	for path := range lpkg.Imports {
+		imports = append(imports, path)
+	}
+	sort.Strings(imports)
+	for _, path := range imports {
+		key, ok := keys[path]
+		if !ok || key == "" {
+			// The imported package can't be cached, so this one can't
+			// either.
+			return "", nil
+		}
+		fmt.Fprintf(h, "import %s %s\n", path, key)
+	}
+
+	// Every package calls into the runtime (to allocate memory, to panic,
+	// etc.), even if it doesn't import it. The runtime and the packages it
+	// imports are compiled before the key of the runtime is known, so they use
+	// the runtime source files instead.
+	if lpkg.ImportPath != "runtime" {
+		if key, ok := keys["runtime"]; ok {
+			if key == "" {
+				return "", nil
+			}
+			fmt.Fprintf(h, "runtime %s\n", key)
+		} else if runtimePkg := lpkg.Program.Packages["runtime"]; runtimePkg != nil {
+			err := c.hashPackageFiles(h, runtimePkg)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashPackageFiles writes the names and contents of the source files of the
+// given package to the hash.
+func (c *Compiler) hashPackageFiles(h hash.Hash, lpkg *loader.Package) error {
+	for _, file := range lpkg.Files {
+		path := c.ir.Program.Fset.File(file.Pos()).Name()
+		fmt.Fprintf(h, "file %s\n", path)
+		err := hashFile(h, path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashFile writes the contents of the given file to the hash.
+func hashFile(h hash.Hash, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(h, f)
+	return err
+}
+
+// internalize gives all functions and globals of the program internal linkage
+// after the package modules have been linked together, except for exported
+// functions and external globals. Type codes and method sets are made private
+// again.
+func (c *Compiler) internalize() {
+	for _, f := range c.ir.Functions {
+		if f.IsExported() || f.CName() != "" {
+			continue
+		}
+		fn := c.mod.NamedFunction(f.LinkName())
+		if fn.IsNil() || fn.IsDeclaration() {
+			continue
+		}
+		fn.SetLinkage(llvm.InternalLinkage)
+		fn.SetUnnamedAddr(true)
+	}
+	for _, pkg := range c.ir.Program.AllPackages() {
+		for _, member := range pkg.Members {
+			g, ok := member.(*ssa.Global)
+			if !ok {
+				continue
+			}
+			info := c.getGlobalInfo(g)
+			if info.extern {
+				continue
+			}
+			global := c.mod.NamedGlobal(info.linkName)
+			if global.IsNil() || global.IsDeclaration() {
+				continue
+			}
+			global.SetLinkage(llvm.InternalLinkage)
+		}
+	}
+	for global := c.mod.FirstGlobal(); !global.IsNil(); global = llvm.NextGlobal(global) {
+		if global.Linkage() == llvm.LinkOnceODRLinkage {
+			global.SetLinkage(llvm.PrivateLinkage)
+		}
+	}
+}
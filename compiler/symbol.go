@@ -7,6 +7,7 @@ import (
 	"go/ast"
 	"go/token"
 	"go/types"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -63,9 +64,11 @@ func (c *Compiler) getGlobal(g *ssa.Global) llvm.Value {
 		typ := g.Type().(*types.Pointer).Elem()
 		llvmType := c.getLLVMType(typ)
 		llvmGlobal = llvm.AddGlobal(c.mod, llvmType, info.linkName)
-		if !info.extern {
+		// The global is only defined in the module of its own package, see
+		// compilePackage. It is made internal after linking.
+		defined := !info.extern && g.Pkg == c.pkg
+		if defined {
 			llvmGlobal.SetInitializer(llvm.ConstNull(llvmType))
-			llvmGlobal.SetLinkage(llvm.InternalLinkage)
 		}
 
 		// Set alignment from the //go:align comment.
@@ -82,7 +85,7 @@ func (c *Compiler) getGlobal(g *ssa.Global) llvm.Value {
 			}
 		}
 
-		if c.Debug() && !info.extern {
+		if c.Debug() && defined {
 			// Add debug info.
 			// TODO: this should be done for every global in the program, not just
 			// the ones that are referenced from some code.
@@ -103,6 +106,59 @@ func (c *Compiler) getGlobal(g *ssa.Global) llvm.Value {
 	return llvmGlobal
 }
 
+// globalValue returns the value of a string global set with -ldflags="-X
+// importpath.name=value", if there is one. The main package can be referred to
+// as "main", like with the gc toolchain.
+func (c *Compiler) globalValue(g *ssa.Global) (string, bool) {
+	pkgPath := g.Pkg.Pkg.Path()
+	if g.Pkg == c.ir.MainPkg() {
+		if value, ok := c.Options.GlobalValues["main"][g.Name()]; ok {
+			return value, true
+		}
+	}
+	value, ok := c.Options.GlobalValues[pkgPath][g.Name()]
+	return value, ok
+}
+
+// setGlobalValues replaces the initializer of the string globals of the given
+// package that are set with -ldflags="-X importpath.name=value". Stores of a
+// constant to these globals in package initializers are skipped (see
+// parseInstr), so that the new value is stored as a constant string in the
+// program. Like the gc toolchain, globals that don't exist are ignored.
+func (c *Compiler) setGlobalValues(pkg *ssa.Package) {
+	var names []string
+	for name, member := range pkg.Members {
+		if g, ok := member.(*ssa.Global); ok {
+			if _, ok := c.globalValue(g); ok {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		g := pkg.Members[name].(*ssa.Global)
+		typ := g.Type().(*types.Pointer).Elem()
+		if basic, ok := typ.Underlying().(*types.Basic); !ok || basic.Kind() != types.String {
+			c.addError(g.Pos(), "cannot set "+g.RelString(nil)+" with -X: not a string variable")
+			continue
+		}
+		value, _ := c.globalValue(g)
+		buf := c.ctx.ConstString(value, false)
+		info := c.getGlobalInfo(g)
+		bufGlobal := llvm.AddGlobal(c.mod, buf.Type(), info.linkName+"$string")
+		bufGlobal.SetInitializer(buf)
+		bufGlobal.SetLinkage(llvm.InternalLinkage)
+		bufGlobal.SetGlobalConstant(true)
+		bufGlobal.SetUnnamedAddr(true)
+		zero := llvm.ConstInt(c.ctx.Int32Type(), 0, false)
+		str := llvm.ConstNamedStruct(c.getLLVMRuntimeType("_string"), []llvm.Value{
+			llvm.ConstGEP(bufGlobal, []llvm.Value{zero, zero}),
+			llvm.ConstInt(c.uintptrType, uint64(len(value)), false),
+		})
+		c.getGlobal(g).SetInitializer(str)
+	}
+}
+
 // getGlobalInfo returns some information about a specific global.
 func (c *Compiler) getGlobalInfo(g *ssa.Global) globalInfo {
 	info := globalInfo{}
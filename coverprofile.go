@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// Marker lines around the coverage profile in the output of a test binary. See
+// src/testing/cover.go.
+const (
+	coverProfileStart = "--- tinygo coverprofile start"
+	coverProfileEnd   = "--- tinygo coverprofile end"
+)
+
+// CoverProfileWriter wraps an io.Writer, but filters out the coverage profile
+// printed by a test binary and stores it in Profile instead.
+type CoverProfileWriter struct {
+	Out       io.Writer
+	Profile   bytes.Buffer
+	line      []byte
+	inProfile bool
+}
+
+// Write implements io.Writer. Lines are passed on to the underlying writer,
+// except for the coverage profile.
+func (w *CoverProfileWriter) Write(p []byte) (n int, err error) {
+	for _, c := range p {
+		w.line = append(w.line, c)
+		if c != '\n' {
+			continue
+		}
+		line := w.line
+		w.line = w.line[:0]
+		switch string(bytes.TrimRight(line, "\r\n")) {
+		case coverProfileStart:
+			w.inProfile = true
+		case coverProfileEnd:
+			w.inProfile = false
+		default:
+			if w.inProfile {
+				w.Profile.Write(line)
+			} else if _, err := w.Out.Write(line); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes the last incomplete line, if any, to the underlying writer.
+func (w *CoverProfileWriter) Flush() error {
+	if len(w.line) == 0 || w.inProfile {
+		return nil
+	}
+	_, err := w.Out.Write(w.line)
+	w.line = w.line[:0]
+	return err
+}
+
+// appendCoverProfile appends a coverage profile to the given file. The mode
+// line is only written at the start of the file, so that the profiles of
+// multiple packages can be combined in a single file like go test does.
+func appendCoverProfile(path string, profile []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if st.Size() != 0 && bytes.HasPrefix(profile, []byte("mode: ")) {
+		// Remove the mode line.
+		if i := bytes.IndexByte(profile, '\n'); i >= 0 {
+			profile = profile[i+1:]
+		}
+	}
+	if _, err := f.Write(profile); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCoverProfileWriter(t *testing.T) {
+	output := "" +
+		"=== RUN   TestFoo\n" +
+		"--- PASS: TestFoo\n" +
+		"PASS\n" +
+		coverProfileStart + "\n" +
+		"mode: count\n" +
+		"example.com/foo/foo.go:3.2,3.10 1 1\n" +
+		coverProfileEnd + "\r\n" +
+		"coverage: 100.0% of statements\n" +
+		"no newline"
+
+	// Write the output in small pieces, so that lines are split over multiple
+	// writes.
+	out := &bytes.Buffer{}
+	w := &CoverProfileWriter{Out: out}
+	for i := 0; i < len(output); i += 7 {
+		end := i + 7
+		if end > len(output) {
+			end = len(output)
+		}
+		if n, err := w.Write([]byte(output[i:end])); n != end-i || err != nil {
+			t.Fatalf("unexpected result of Write: %d, %v", n, err)
+		}
+	}
+	if out.String() != "=== RUN   TestFoo\n--- PASS: TestFoo\nPASS\ncoverage: 100.0% of statements\n" {
+		t.Errorf("unexpected output before Flush:\n%s", out.String())
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal("could not flush:", err)
+	}
+	if out.String() != "=== RUN   TestFoo\n--- PASS: TestFoo\nPASS\ncoverage: 100.0% of statements\nno newline" {
+		t.Errorf("unexpected output after Flush:\n%s", out.String())
+	}
+	if w.Profile.String() != "mode: count\nexample.com/foo/foo.go:3.2,3.10 1 1\n" {
+		t.Errorf("unexpected coverage profile:\n%s", w.Profile.String())
+	}
+}
+
+func TestAppendCoverProfile(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "tinygo-cover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	path := filepath.Join(tmpdir, "cover.out")
+
+	// The mode line is only written once, so that the profiles of multiple
+	// packages can be combined in a single file.
+	profiles := []string{
+		"mode: count\nexample.com/foo/foo.go:3.2,3.10 1 1\n",
+		"mode: count\nexample.com/bar/bar.go:5.2,7.3 2 0\n",
+	}
+	for _, profile := range profiles {
+		if err := appendCoverProfile(path, []byte(profile)); err != nil {
+			t.Fatal("could not append coverage profile:", err)
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "mode: count\nexample.com/foo/foo.go:3.2,3.10 1 1\nexample.com/bar/bar.go:5.2,7.3 2 0\n"
+	if string(data) != expected {
+		t.Errorf("unexpected coverage profile:\n%s\nexpected:\n%s", data, expected)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"go/scanner"
+	"go/token"
+	"go/types"
+	"io"
+	"os"
+
+	"github.com/tinygo-org/tinygo/builder"
+	"github.com/tinygo-org/tinygo/compileopts"
+	"github.com/tinygo-org/tinygo/interp"
+	"github.com/tinygo-org/tinygo/loader"
+)
+
+// jsonDiagnostic is a single diagnostic (such as a compiler error) as printed
+// with the -json flag.
+type jsonDiagnostic struct {
+	Type     string `json:"type"` // always "diagnostic"
+	Package  string `json:"package,omitempty"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"`
+	Stage    string `json:"stage,omitempty"` // loader, compiler, interp, transform, link
+	Message  string `json:"message"`
+}
+
+// jsonBuildEnd is printed with the -json flag when a build has finished, either
+// successfully or not. The sizes are those of tinygo build -size=short and are
+// only set for successful builds.
+type jsonBuildEnd struct {
+	Type    string `json:"type"` // always "build-end"
+	Package string `json:"package"`
+	Success bool   `json:"success"`
+	Output  string `json:"output,omitempty"` // only set for tinygo build
+	Code    uint64 `json:"code,omitempty"`
+	Data    uint64 `json:"data,omitempty"`
+	BSS     uint64 `json:"bss,omitempty"`
+	Flash   uint64 `json:"flash,omitempty"`
+	RAM     uint64 `json:"ram,omitempty"`
+}
+
+// newJSONBuildEnd returns the build-end event of a successful build.
+func newJSONBuildEnd(pkgName, output string, size *builder.SizeReport) jsonBuildEnd {
+	event := jsonBuildEnd{Type: "build-end", Package: pkgName, Success: true, Output: output}
+	if size != nil {
+		event.Code = size.Code
+		event.Data = size.Data
+		event.BSS = size.BSS
+		event.Flash = size.Flash()
+		event.RAM = size.RAM()
+	}
+	return event
+}
+
+// jsonOutput is printed with the -json flag for every line of output of a test
+// binary and for the summary line of a tested package, so that the output of
+// tinygo test -json only consists of JSON objects (like go test -json).
+type jsonOutput struct {
+	Type    string `json:"type"` // always "output"
+	Package string `json:"package"`
+	Output  string `json:"output"`
+}
+
+// jsonOutputWriter is an io.Writer that prints everything written to it as
+// output events to Out, one event per line.
+type jsonOutputWriter struct {
+	Out     io.Writer
+	Package string
+	line    []byte
+}
+
+// Write implements io.Writer.
+func (w *jsonOutputWriter) Write(p []byte) (n int, err error) {
+	for _, c := range p {
+		w.line = append(w.line, c)
+		if c == '\n' {
+			w.Flush()
+		}
+	}
+	return len(p), nil
+}
+
+// Flush prints the last incomplete line, if any.
+func (w *jsonOutputWriter) Flush() {
+	if len(w.line) == 0 {
+		return
+	}
+	writeJSON(w.Out, jsonOutput{Type: "output", Package: w.Package, Output: string(w.line)})
+	w.line = w.line[:0]
+}
+
+// printJSON prints a single JSON object on its own line to stdout.
+func printJSON(v interface{}) {
+	writeJSON(os.Stdout, v)
+}
+
+// writeJSON writes a single JSON object on its own line to w.
+func writeJSON(w io.Writer, v interface{}) {
+	// Encoding these simple structs cannot fail.
+	data, _ := json.Marshal(v)
+	w.Write(append(data, '\n'))
+}
+
+// printCompilerErrorJSON prints the given error as one or more JSON
+// diagnostics. If the error is a build error, it also prints a build-end event
+// to indicate the build failed.
+func printCompilerErrorJSON(pkgName string, err error) {
+	for _, diag := range compilerDiagnostics(err, "", "") {
+		printJSON(diag)
+	}
+	if _, ok := err.(*builder.StageError); ok {
+		printJSON(jsonBuildEnd{Type: "build-end", Package: pkgName})
+	}
+}
+
+// compilerDiagnostics converts the given error into a list of diagnostics. The
+// stage and package are inherited from wrapping errors.
+func compilerDiagnostics(err error, stage, pkg string) []jsonDiagnostic {
+	newDiagnostic := func(pos token.Position, msg string) jsonDiagnostic {
+		return jsonDiagnostic{
+			Type:     "diagnostic",
+			Package:  pkg,
+			File:     pos.Filename,
+			Line:     pos.Line,
+			Column:   pos.Column,
+			Severity: "error",
+			Stage:    stage,
+			Message:  msg,
+		}
+	}
+	switch err := err.(type) {
+	case *builder.StageError:
+		return compilerDiagnostics(err.Err, err.Stage, pkg)
+	case *builder.MultiError:
+		var diags []jsonDiagnostic
+		for _, err := range err.Errs {
+			diags = append(diags, compilerDiagnostics(err, stage, pkg)...)
+		}
+		return diags
+	case loader.Errors:
+		var diags []jsonDiagnostic
+		for _, e := range err.Errs {
+			diags = append(diags, compilerDiagnostics(e, stage, err.Pkg.ImportPath)...)
+		}
+		return diags
+	case *loader.ImportCycleError:
+		var pos token.Position
+		if len(err.ImportPositions) != 0 {
+			pos = err.ImportPositions[0]
+		}
+		return []jsonDiagnostic{newDiagnostic(pos, err.Error())}
+	case interp.Error:
+		pkg = err.ImportPath
+		var diags []jsonDiagnostic
+		for _, e := range err.Errs {
+			diags = append(diags, newDiagnostic(e.Pos, e.Msg))
+		}
+		return diags
+	case *interp.Unsupported:
+		pkg = err.ImportPath
+		return []jsonDiagnostic{newDiagnostic(err.Pos, "unsupported instruction during init evaluation")}
+	case types.Error:
+		return []jsonDiagnostic{newDiagnostic(err.Fset.Position(err.Pos), err.Msg)}
+	case scanner.Error:
+		return []jsonDiagnostic{newDiagnostic(err.Pos, err.Msg)}
+	case scanner.ErrorList:
+		var diags []jsonDiagnostic
+		for _, e := range err {
+			diags = append(diags, newDiagnostic(e.Pos, e.Msg))
+		}
+		return diags
+	default:
+		return []jsonDiagnostic{newDiagnostic(token.Position{}, err.Error())}
+	}
+}
+
+// buildPackage calls builder.Build and passes the path of the output file to
+// the action. With -json, it prints a build-end event just before calling the
+// action. Failed builds are reported by printCompilerErrorJSON instead.
+func buildPackage(pkgName, outpath string, config *compileopts.Config, action func(string) error) error {
+	return builder.Build(pkgName, outpath, config, func(result builder.BuildResult) error {
+		if config.Options.PrintJSON {
+			printJSON(newJSONBuildEnd(pkgName, "", result.Size))
+		}
+		return action(result.Binary)
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/tinygo-org/tinygo/builder"
+)
+
+func TestJSONOutputWriter(t *testing.T) {
+	// Lines may be split over multiple writes and multiple lines may be
+	// written at once. Every line is a separate event.
+	out := &bytes.Buffer{}
+	w := &jsonOutputWriter{Out: out, Package: "example.com/foo"}
+	for _, s := range []string{"=== RUN   Test", "Foo\n--- PASS: TestFoo\n", "PASS\n", "no newline"} {
+		if n, err := w.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatalf("unexpected result of Write: %d, %v", n, err)
+		}
+	}
+	w.Flush()
+	w.Flush() // nothing left to flush
+
+	var events []jsonOutput
+	dec := json.NewDecoder(out)
+	for dec.More() {
+		var event jsonOutput
+		if err := dec.Decode(&event); err != nil {
+			t.Fatal("could not decode event:", err)
+		}
+		events = append(events, event)
+	}
+	expected := []jsonOutput{
+		{Type: "output", Package: "example.com/foo", Output: "=== RUN   TestFoo\n"},
+		{Type: "output", Package: "example.com/foo", Output: "--- PASS: TestFoo\n"},
+		{Type: "output", Package: "example.com/foo", Output: "PASS\n"},
+		{Type: "output", Package: "example.com/foo", Output: "no newline"},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("unexpected events:\n%+v\nexpected:\n%+v", events, expected)
+	}
+}
+
+func TestJSONBuildEnd(t *testing.T) {
+	// The event contains the size of the program, not the size of the output
+	// file (which includes debug information).
+	size := &builder.SizeReport{Code: 1200, Data: 16, BSS: 512}
+	data, err := json.Marshal(newJSONBuildEnd("example.com/foo", "foo.elf", size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"type":"build-end","package":"example.com/foo","success":true,"output":"foo.elf","code":1200,"data":16,"bss":512,"flash":1216,"ram":528}`
+	if string(data) != expected {
+		t.Errorf("unexpected build-end event:\n%s\nexpected:\n%s", data, expected)
+	}
+
+	// The size isn't known if it wasn't loaded.
+	data, err = json.Marshal(newJSONBuildEnd("example.com/foo", "", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `{"type":"build-end","package":"example.com/foo","success":true}`
+	if string(data) != expected {
+		t.Errorf("unexpected build-end event:\n%s\nexpected:\n%s", data, expected)
+	}
+}
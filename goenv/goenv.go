@@ -18,6 +18,7 @@ var Keys = []string{
 	"GOROOT",
 	"GOPATH",
 	"GOCACHE",
+	"TINYGOCACHESIZE",
 	"CGO_ENABLED",
 	"TINYGOROOT",
 }
@@ -58,6 +59,10 @@ func Get(name string) string {
 			panic("could not find cache dir: " + err.Error())
 		}
 		return filepath.Join(dir, "tinygo")
+	case "TINYGOCACHESIZE":
+		// Maximum size of the cache directory, like 500M. The cache is not
+		// limited when it is empty.
+		return os.Getenv("TINYGOCACHESIZE")
 	case "CGO_ENABLED":
 		val := os.Getenv("CGO_ENABLED")
 		if val == "1" || val == "0" {
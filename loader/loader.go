@@ -5,6 +5,7 @@ import (
 	"errors"
 	"go/ast"
 	"go/build"
+	"go/doc"
 	"go/parser"
 	"go/scanner"
 	"go/token"
@@ -14,6 +15,8 @@ import (
 	"sort"
 	"strings"
 	"text/template"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/tinygo-org/tinygo/cgo"
 )
@@ -32,6 +35,7 @@ type Program struct {
 	TINYGOROOT   string // root of the TinyGo installation or root of the source code
 	CFlags       []string
 	ClangHeaders string
+	TestArgs     []string // -test.* flags passed to testing.M in a test binary
 }
 
 // Package holds a loaded package, its imports, and its parsed files.
@@ -192,6 +196,21 @@ func (p *Program) sort() {
 func (p *Program) Parse(compileTestBinary bool) error {
 	includeTests := compileTestBinary
 
+	if compileTestBinary {
+		// The generated test main imports the testing package, so make sure
+		// it is loaded even when the package itself has no test files.
+		mainPkg := p.Packages[p.mainPkg]
+		hasTesting := false
+		for _, path := range mainPkg.TestImports {
+			if path == "testing" {
+				hasTesting = true
+			}
+		}
+		if !hasTesting {
+			mainPkg.TestImports = append(mainPkg.TestImports, "testing")
+		}
+	}
+
 	// Load all imports
 	for _, pkg := range p.Sorted() {
 		err := pkg.importRecursively(includeTests)
@@ -231,23 +250,49 @@ func (p *Program) Parse(compileTestBinary bool) error {
 	return nil
 }
 
+// SwapTestMain removes the main function of the package under test and adds a
+// generated main function that runs all tests, examples and benchmarks in the
+// package. If the package defines a TestMain function, it is called instead of
+// testing.TestMain.
 func (p *Program) SwapTestMain() error {
-	var tests []string
+	var tests, benchmarks []string
+	var examples []*doc.Example
+	var errs []error
+	hasTestMain := false
 
-	isTestFunc := func(f *ast.FuncDecl) bool {
-		// TODO: improve signature check
-		if strings.HasPrefix(f.Name.Name, "Test") && f.Name.Name != "TestMain" {
-			return true
-		}
-		return false
-	}
 	mainPkg := p.Packages[p.mainPkg]
 	for _, f := range mainPkg.Files {
+		isTestFile := strings.HasSuffix(p.fset.Position(f.Package).Filename, "_test.go")
+		if isTestFile {
+			for _, ex := range doc.Examples(f) {
+				if ex.Output == "" && !ex.EmptyOutput {
+					// Don't run examples with no output, like go test.
+					continue
+				}
+				examples = append(examples, ex)
+			}
+		}
 		for i, d := range f.Decls {
 			switch v := d.(type) {
 			case *ast.FuncDecl:
-				if isTestFunc(v) {
-					tests = append(tests, v.Name.Name)
+				if isTestFile && v.Recv == nil {
+					name := v.Name.Name
+					if name == "TestMain" {
+						if !isTestingFunc(f, v, "M") {
+							errs = append(errs, p.signatureError(v, "func TestMain(m *testing.M)"))
+						}
+						hasTestMain = true
+					} else if isTestName(name, "Test") {
+						if !isTestingFunc(f, v, "T") {
+							errs = append(errs, p.signatureError(v, "func "+name+"(t *testing.T)"))
+						}
+						tests = append(tests, name)
+					} else if isTestName(name, "Benchmark") {
+						if !isTestingFunc(f, v, "B") {
+							errs = append(errs, p.signatureError(v, "func "+name+"(b *testing.B)"))
+						}
+						benchmarks = append(benchmarks, name)
+					}
 				}
 				if v.Name.Name == "main" {
 					// Remove main
@@ -261,9 +306,14 @@ func (p *Program) SwapTestMain() error {
 			}
 		}
 	}
+	if len(errs) != 0 {
+		return Errors{mainPkg, errs}
+	}
 
-	// TODO: Check if they defined a TestMain and call it instead of testing.TestMain
-	const mainBody = `package main
+	// The test main is added to the package under test, so it must use the
+	// same package name. The compiler will use its main function as the entry
+	// point regardless of the package name.
+	const mainBody = `package {{.PackageName}}
 
 import (
 	"testing"
@@ -274,19 +324,53 @@ func main () {
 		Tests: []testing.TestToCall{
 {{range .TestFunctions}}
 			{Name: "{{.}}", Func: {{.}}},
+{{end}}
+		},
+		Benchmarks: []testing.BenchmarkToCall{
+{{range .BenchmarkFunctions}}
+			{Name: "{{.}}", Func: {{.}}},
+{{end}}
+		},
+		Examples: []testing.ExampleToCall{
+{{range .Examples}}
+			{Name: "Example{{.Name}}", Func: Example{{.Name}}, Output: {{printf "%q" .Output}}, Unordered: {{.Unordered}}},
+{{end}}
+		},
+		Args: []string{
+{{range .TestArgs}}
+			{{printf "%q" .}},
 {{end}}
 		},
 	}
 
+{{if .HasTestMain}}
+	TestMain(m)
+{{else}}
 	testing.TestMain(m)
+{{end}}
 }
 `
 	tmpl := template.Must(template.New("testmain").Parse(mainBody))
 	b := bytes.Buffer{}
+	pkgName := mainPkg.Name
+	if pkgName == "" {
+		// Pseudo-package created from a single file.
+		pkgName = "main"
+	}
 	tmplData := struct {
-		TestFunctions []string
+		PackageName        string
+		TestFunctions      []string
+		BenchmarkFunctions []string
+		Examples           []*doc.Example
+		TestArgs           []string
+		HasTestMain        bool
 	}{
-		TestFunctions: tests,
+		PackageName:        pkgName,
+		TestFunctions:      tests,
+		BenchmarkFunctions: benchmarks,
+		Examples:           examples,
+		TestArgs:           p.TestArgs,
+		HasTestMain:        hasTestMain,
 	}
 
 	err := tmpl.Execute(&b, tmplData)
@@ -308,6 +392,64 @@ func main () {
 	return nil
 }
 
+// isTestName returns whether name is the name of a test function with the
+// given prefix, like TestFoo or Test_foo but not Testfoo.
+func isTestName(name, prefix string) bool {
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	if len(name) == len(prefix) {
+		return true
+	}
+	r, _ := utf8.DecodeRuneInString(name[len(prefix):])
+	return !unicode.IsLower(r)
+}
+
+// isTestingFunc returns whether fn has a single parameter of type
+// *testing.<typeName> and no results. The check is done on the AST as the
+// package hasn't been type checked yet, so it looks at how the testing package
+// is imported in the file.
+func isTestingFunc(f *ast.File, fn *ast.FuncDecl, typeName string) bool {
+	params := fn.Type.Params.List
+	if len(params) != 1 || len(params[0].Names) > 1 || fn.Type.Results != nil {
+		return false
+	}
+	ptr, ok := params[0].Type.(*ast.StarExpr)
+	if !ok {
+		return false
+	}
+	for _, spec := range f.Imports {
+		if spec.Path.Value != `"testing"` {
+			continue
+		}
+		if spec.Name != nil && spec.Name.Name == "." {
+			if ident, ok := ptr.X.(*ast.Ident); ok && ident.Name == typeName {
+				return true
+			}
+			continue
+		}
+		pkgName := "testing"
+		if spec.Name != nil {
+			pkgName = spec.Name.Name
+		}
+		if sel, ok := ptr.X.(*ast.SelectorExpr); ok && sel.Sel.Name == typeName {
+			if ident, ok := sel.X.(*ast.Ident); ok && ident.Name == pkgName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// signatureError returns an error for a test function with the wrong
+// signature, in the same format as `go test`.
+func (p *Program) signatureError(fn *ast.FuncDecl, signature string) error {
+	return scanner.Error{
+		Pos: p.fset.Position(fn.Pos()),
+		Msg: "wrong signature for " + fn.Name.Name + ", must be: " + signature,
+	}
+}
+
 // parseFile is a wrapper around parser.ParseFile.
 func (p *Program) parseFile(path string, mode parser.Mode) (*ast.File, error) {
 	if p.fset == nil {
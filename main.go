@@ -2,12 +2,15 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"go/build"
 	"go/scanner"
 	"go/types"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -15,9 +18,10 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
-	"syscall"
+	"text/tabwriter"
 	"time"
 
+	"github.com/google/shlex"
 	"github.com/tinygo-org/tinygo/builder"
 	"github.com/tinygo-org/tinygo/compileopts"
 	"github.com/tinygo-org/tinygo/goenv"
@@ -82,7 +86,10 @@ func Build(pkgName, outpath string, options *compileopts.Options) error {
 		return err
 	}
 
-	return builder.Build(pkgName, outpath, config, func(tmppath string) error {
+	var size *builder.SizeReport
+	err = builder.Build(pkgName, outpath, config, func(result builder.BuildResult) error {
+		size = result.Size
+		tmppath := result.Binary
 		if err := os.Rename(tmppath, outpath); err != nil {
 			// Moving failed. Do a file copy.
 			inf, err := os.Open(tmppath)
@@ -108,13 +115,19 @@ func Build(pkgName, outpath string, options *compileopts.Options) error {
 			return nil
 		}
 	})
+	if err == nil && options.PrintJSON {
+		printJSON(newJSONBuildEnd(pkgName, outpath, size))
+	}
+	return err
 }
 
-// Test runs the tests in the given package.
-func Test(pkgName string, options *compileopts.Options) error {
+// Test runs the tests in the given package. It returns whether all tests
+// passed, and prints a summary line for the package in the style of `go test`.
+func Test(pkgName string, options *compileopts.Options) (bool, error) {
+	options.TestConfig.CompileTestBinary = true
 	config, err := builder.NewConfig(options)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	// Add test build tag. This is incorrect: `go test` only looks at the
@@ -123,24 +136,89 @@ func Test(pkgName string, options *compileopts.Options) error {
 	// For details: https://github.com/golang/go/issues/21360
 	config.Target.BuildTags = append(config.Target.BuildTags, "test")
 
-	options.TestConfig.CompileTestBinary = true
-	return builder.Build(pkgName, ".elf", config, func(tmppath string) error {
-		cmd := exec.Command(tmppath)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err := cmd.Run()
-		if err != nil {
-			// Propagate the exit code
-			if err, ok := err.(*exec.ExitError); ok {
-				if status, ok := err.Sys().(syscall.WaitStatus); ok {
-					os.Exit(status.ExitStatus())
-				}
-				os.Exit(1)
+	// With -json, all output of the test binary is printed as JSON events so
+	// that it doesn't get mixed up with the build events on stdout.
+	var out io.Writer = os.Stdout
+	if config.Options.PrintJSON {
+		jsonOut := &jsonOutputWriter{Out: os.Stdout, Package: pkgName}
+		defer jsonOut.Flush()
+		out = jsonOut
+	}
+
+	var passed bool
+	err = buildPackage(pkgName, ".elf", config, func(tmppath string) error {
+		var err error
+		passed, err = runTestBinary(config, pkgName, tmppath, out)
+		return err
+	})
+	return passed, err
+}
+
+// runTestBinary runs a compiled test binary, directly or in an emulator, in the
+// directory of the package like go test. The test binary reports the test
+// result through its exit status: via semihosting in QEMU and via the WASI
+// proc_exit call in Node.js. The result is printed to out.
+func runTestBinary(config *compileopts.Config, pkgName, tmppath string, out io.Writer) (bool, error) {
+	var cmd *exec.Cmd
+	if len(config.Target.Emulator) == 0 {
+		// Run directly.
+		cmd = exec.Command(tmppath)
+	} else {
+		// Run in an emulator.
+		cmd = emulatorCommand(config, tmppath)
+	}
+	if wd, err := os.Getwd(); err == nil {
+		if pkg, err := build.Import(pkgName, wd, build.FindOnly); err == nil {
+			cmd.Dir = pkg.Dir
+		}
+	}
+	stdout := &CoverProfileWriter{Out: out}
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	printCommand(config, cmd)
+	start := time.Now()
+	err := cmd.Run()
+	duration := time.Since(start)
+	stdout.Flush()
+	if config.TestConfig.CoverProfile != "" && stdout.Profile.Len() != 0 {
+		if err := appendCoverProfile(config.TestConfig.CoverProfile, stdout.Profile.Bytes()); err != nil {
+			return false, err
+		}
+	}
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			// The test binary exits with a non-zero exit code when one of the
+			// tests failed.
+			fmt.Fprintf(out, "FAIL\t%s\t%.3fs\n", pkgName, duration.Seconds())
+			return false, nil
+		}
+		if len(config.Target.Emulator) != 0 {
+			return false, &commandError{"failed to run emulator with", tmppath, err}
+		}
+		return false, &commandError{"failed to run compiled binary", tmppath, err}
+	}
+	fmt.Fprintf(out, "ok  \t%s\t%.3fs\n", pkgName, duration.Seconds())
+	return true, nil
+}
+
+// emulatorCommand returns the command to run the given binary in the emulator
+// of the target, with extra arguments appended. Emulator arguments that refer
+// to files in the TinyGo root (like targets/wasm_exec.js) are made absolute, so
+// that the emulator can be run from any directory.
+func emulatorCommand(config *compileopts.Config, tmppath string, extraArgs ...string) *exec.Cmd {
+	root := goenv.Get("TINYGOROOT")
+	var args []string
+	for _, arg := range config.Target.Emulator[1:] {
+		if !filepath.IsAbs(arg) && !strings.HasPrefix(arg, "-") {
+			if _, err := os.Stat(filepath.Join(root, arg)); err == nil {
+				arg = filepath.Join(root, arg)
 			}
-			return &commandError{"failed to run compiled binary", tmppath, err}
 		}
-		return nil
-	})
+		args = append(args, arg)
+	}
+	args = append(args, tmppath)
+	args = append(args, extraArgs...)
+	return exec.Command(config.Target.Emulator[0], args...)
 }
 
 // Flash builds and flashes the built binary to the given serial port.
@@ -163,6 +241,8 @@ func Flash(pkgName, port string, options *compileopts.Options) error {
 			fileExt = ".elf"
 		case strings.Contains(config.Target.FlashCommand, "{bin}"):
 			fileExt = ".bin"
+		case strings.Contains(config.Target.FlashCommand, "{srec}"):
+			fileExt = ".srec"
 		case strings.Contains(config.Target.FlashCommand, "{uf2}"):
 			fileExt = ".uf2"
 		default:
@@ -181,7 +261,7 @@ func Flash(pkgName, port string, options *compileopts.Options) error {
 		return errors.New("unknown flash method: " + flashMethod)
 	}
 
-	return builder.Build(pkgName, fileExt, config, func(tmppath string) error {
+	return buildPackage(pkgName, fileExt, config, func(tmppath string) error {
 		// do we need port reset to put MCU into bootloader mode?
 		if config.Target.PortReset == "true" {
 			if port == "" {
@@ -234,6 +314,7 @@ func Flash(pkgName, port string, options *compileopts.Options) error {
 			cmd.Stdout = os.Stdout
 			cmd.Stderr = os.Stderr
 			cmd.Dir = goenv.Get("TINYGOROOT")
+			printCommand(config, cmd)
 			err := cmd.Run()
 			if err != nil {
 				return &commandError{"failed to flash", tmppath, err}
@@ -265,6 +346,7 @@ func Flash(pkgName, port string, options *compileopts.Options) error {
 			cmd := exec.Command("openocd", args...)
 			cmd.Stdout = os.Stdout
 			cmd.Stderr = os.Stderr
+			printCommand(config, cmd)
 			err = cmd.Run()
 			if err != nil {
 				return &commandError{"failed to flash", tmppath, err}
@@ -292,7 +374,7 @@ func FlashGDB(pkgName string, ocdOutput bool, options *compileopts.Options) erro
 		return errors.New("gdb not configured in the target specification")
 	}
 
-	return builder.Build(pkgName, "", config, func(tmppath string) error {
+	return buildPackage(pkgName, "", config, func(tmppath string) error {
 		// Find a good way to run GDB.
 		gdbInterface, openocdInterface := config.Programmer()
 		switch gdbInterface {
@@ -335,6 +417,7 @@ func FlashGDB(pkgName string, ocdOutput bool, options *compileopts.Options) erro
 			// GDB (to break the currently executing program).
 			setCommandAsDaemon(daemon)
 			// Start now, and kill it on exit.
+			printCommand(config, daemon)
 			daemon.Start()
 			defer func() {
 				daemon.Process.Signal(os.Interrupt)
@@ -360,6 +443,7 @@ func FlashGDB(pkgName string, ocdOutput bool, options *compileopts.Options) erro
 			// GDB (to break the currently executing program).
 			setCommandAsDaemon(daemon)
 			// Start now, and kill it on exit.
+			printCommand(config, daemon)
 			daemon.Start()
 			defer func() {
 				daemon.Process.Signal(os.Interrupt)
@@ -370,8 +454,7 @@ func FlashGDB(pkgName string, ocdOutput bool, options *compileopts.Options) erro
 			gdbCommands = append(gdbCommands, "target remote :1234")
 
 			// Run in an emulator.
-			args := append(config.Target.Emulator[1:], tmppath, "-s", "-S")
-			daemon := exec.Command(config.Target.Emulator[0], args...)
+			daemon := emulatorCommand(config, tmppath, "-s", "-S")
 			daemon.Stdout = os.Stdout
 			daemon.Stderr = os.Stderr
 
@@ -380,6 +463,7 @@ func FlashGDB(pkgName string, ocdOutput bool, options *compileopts.Options) erro
 			setCommandAsDaemon(daemon)
 
 			// Start now, and kill it on exit.
+			printCommand(config, daemon)
 			daemon.Start()
 			defer func() {
 				daemon.Process.Signal(os.Interrupt)
@@ -411,6 +495,7 @@ func FlashGDB(pkgName string, ocdOutput bool, options *compileopts.Options) erro
 		cmd.Stdin = os.Stdin
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
+		printCommand(config, cmd)
 		err := cmd.Run()
 		if err != nil {
 			return &commandError{"failed to run gdb with", tmppath, err}
@@ -429,12 +514,13 @@ func Run(pkgName string, options *compileopts.Options) error {
 		return err
 	}
 
-	return builder.Build(pkgName, ".elf", config, func(tmppath string) error {
+	return buildPackage(pkgName, ".elf", config, func(tmppath string) error {
 		if len(config.Target.Emulator) == 0 {
 			// Run directly.
 			cmd := exec.Command(tmppath)
 			cmd.Stdout = os.Stdout
 			cmd.Stderr = os.Stderr
+			printCommand(config, cmd)
 			err := cmd.Run()
 			if err != nil {
 				if err, ok := err.(*exec.ExitError); ok && err.Exited() {
@@ -446,10 +532,10 @@ func Run(pkgName string, options *compileopts.Options) error {
 			return nil
 		} else {
 			// Run in an emulator.
-			args := append(config.Target.Emulator[1:], tmppath)
-			cmd := exec.Command(config.Target.Emulator[0], args...)
+			cmd := emulatorCommand(config, tmppath)
 			cmd.Stdout = os.Stdout
 			cmd.Stderr = os.Stderr
+			printCommand(config, cmd)
 			err := cmd.Run()
 			if err != nil {
 				if err, ok := err.(*exec.ExitError); ok && err.Exited() {
@@ -463,6 +549,14 @@ func Run(pkgName string, options *compileopts.Options) error {
 	})
 }
 
+// printCommand prints the command line of an external command before it is
+// run, if -x is given.
+func printCommand(config *compileopts.Config, cmd *exec.Cmd) {
+	if config.Options.PrintCommands {
+		builder.PrintCommand(cmd.Args[0], cmd.Args[1:]...)
+	}
+}
+
 func touchSerialPortAt1200bps(port string) error {
 	// Open port
 	p, err := serial.Open(port, &serial.Mode{BaudRate: 1200})
@@ -576,6 +670,157 @@ func parseSize(s string) (int64, error) {
 	return n, err
 }
 
+// expandPackagePatterns expands package patterns ending in "/..." (like
+// "./...") to the list of packages below that directory, similar to the go
+// tool. Other package names are returned unchanged. Directories named testdata
+// or vendor and directories starting with "." or "_" are skipped, as are
+// directories without Go files.
+func expandPackagePatterns(patterns []string) ([]string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	var pkgNames []string
+	for _, pattern := range patterns {
+		if !strings.HasSuffix(pattern, "/...") {
+			pkgNames = append(pkgNames, pattern)
+			continue
+		}
+		prefix := strings.TrimSuffix(pattern, "/...")
+		root := filepath.FromSlash(prefix)
+		if !build.IsLocalImport(prefix) {
+			// Import path, look up the directory in $GOPATH.
+			pkg, err := build.Import(prefix, wd, build.FindOnly)
+			if err != nil {
+				return nil, err
+			}
+			root = pkg.Dir
+		}
+		matched := false
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				return nil
+			}
+			name := info.Name()
+			if path != root && (name == "testdata" || name == "vendor" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+				return filepath.SkipDir
+			}
+			if _, err := build.ImportDir(path, 0); err != nil {
+				if _, ok := err.(*build.NoGoError); ok {
+					// Not a Go package.
+					return nil
+				}
+			}
+			matched = true
+			if build.IsLocalImport(prefix) {
+				pkgName := filepath.ToSlash(path)
+				if !build.IsLocalImport(pkgName) {
+					pkgName = "./" + pkgName
+				}
+				pkgNames = append(pkgNames, pkgName)
+			} else {
+				rel, err := filepath.Rel(root, path)
+				if err != nil {
+					return err
+				}
+				pkgNames = append(pkgNames, strings.TrimSuffix(prefix+"/"+filepath.ToSlash(rel), "/."))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !matched {
+			return nil, fmt.Errorf("pattern %s: no packages found", pattern)
+		}
+	}
+	return pkgNames, nil
+}
+
+// targetInfo is the information about a target that is printed by the targets
+// command.
+type targetInfo struct {
+	Name        string   `json:"name"`
+	Triple      string   `json:"llvm-target"`
+	CPU         string   `json:"cpu,omitempty"`
+	GOOS        string   `json:"goos"`
+	GOARCH      string   `json:"goarch"`
+	FlashMethod string   `json:"flash-method,omitempty"`
+	Emulator    []string `json:"emulator,omitempty"`
+}
+
+// Targets prints all targets that can be passed to the -target flag: the
+// built-in targets and the target specifications given in paths (either .json
+// files or directories containing .json files). Abstract targets, that are only
+// meant to be inherited by other targets, are not included.
+func Targets(paths []string, asJSON bool) error {
+	names, err := compileopts.ListTargets()
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if strings.HasSuffix(path, ".json") {
+			names = append(names, path)
+			continue
+		}
+		files, err := filepath.Glob(filepath.Join(path, "*.json"))
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return errors.New("no target specifications found in " + path)
+		}
+		names = append(names, files...)
+	}
+
+	var targets []targetInfo
+	for _, name := range names {
+		spec, err := compileopts.LoadTarget(name)
+		if err != nil {
+			return fmt.Errorf("could not load target %s: %v", name, err)
+		}
+		if spec.IsAbstract() {
+			continue
+		}
+		targets = append(targets, targetInfo{
+			Name:        name,
+			Triple:      spec.Triple,
+			CPU:         spec.CPU,
+			GOOS:        spec.GOOS,
+			GOARCH:      spec.GOARCH,
+			FlashMethod: spec.FlashMethod,
+			Emulator:    spec.Emulator,
+		})
+	}
+
+	if asJSON {
+		data, err := json.MarshalIndent(targets, "", "\t")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tLLVM TARGET\tCPU\tGOOS/GOARCH\tFLASH METHOD\tEMULATOR")
+	for _, target := range targets {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s/%s\t%s\t%s\n", target.Name, target.Triple, orDash(target.CPU), target.GOOS, target.GOARCH, orDash(target.FlashMethod), orDash(strings.Join(target.Emulator, " ")))
+	}
+	return w.Flush()
+}
+
+// orDash returns s, or "-" if s is empty. It is used for printing tables.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
 // getDefaultPort returns the default serial port depending on the operating system.
 func getDefaultPort() (port string, err error) {
 	var portPath string
@@ -625,55 +870,118 @@ func getDefaultPort() (port string, err error) {
 	return d[0], nil
 }
 
+// parseLDFlags extracts the Go-style -X importpath.name=value flags from the
+// -ldflags flag. The remaining flags are passed to the linker. Like in gc, the
+// flags are split into fields as a shell would do it, so that a value with
+// spaces can be quoted: -ldflags='-X "main.version=1.0 beta"'.
+func parseLDFlags(ldflagsString string) ([]string, map[string]map[string]string, error) {
+	flags, err := shlex.Split(ldflagsString)
+	if err != nil {
+		return nil, nil, errors.New("-ldflags: " + err.Error())
+	}
+	var ldflags []string
+	var globalValues map[string]map[string]string
+	for i := 0; i < len(flags); i++ {
+		flag := flags[i]
+		var definition string
+		switch {
+		case flag == "-X" || flag == "--X":
+			if i+1 == len(flags) {
+				return nil, nil, errors.New("-ldflags: missing argument to -X")
+			}
+			i++
+			definition = flags[i]
+		case strings.HasPrefix(flag, "-X="):
+			definition = flag[len("-X="):]
+		default:
+			if flag != "" {
+				ldflags = append(ldflags, flag)
+			}
+			continue
+		}
+		eq := strings.IndexByte(definition, '=')
+		dot := strings.LastIndexByte(definition[:eq+1], '.')
+		if eq < 0 || dot <= 0 || dot+1 == eq {
+			return nil, nil, errors.New("-ldflags: -X flag requires argument of the form importpath.name=value, got " + definition)
+		}
+		pkgPath, name, value := definition[:dot], definition[dot+1:eq], definition[eq+1:]
+		if globalValues == nil {
+			globalValues = make(map[string]map[string]string)
+		}
+		if globalValues[pkgPath] == nil {
+			globalValues[pkgPath] = make(map[string]string)
+		}
+		globalValues[pkgPath][name] = value
+	}
+	return ldflags, globalValues, nil
+}
+
 func usage() {
 	fmt.Fprintln(os.Stderr, "TinyGo is a Go compiler for small places.")
 	fmt.Fprintln(os.Stderr, "version:", version)
 	fmt.Fprintf(os.Stderr, "usage: %s command [-printir] [-target=<target>] -o <output> <input>\n", os.Args[0])
 	fmt.Fprintln(os.Stderr, "\ncommands:")
-	fmt.Fprintln(os.Stderr, "  build: compile packages and dependencies")
-	fmt.Fprintln(os.Stderr, "  run:   compile and run immediately")
-	fmt.Fprintln(os.Stderr, "  test:  test packages")
-	fmt.Fprintln(os.Stderr, "  flash: compile and flash to the device")
-	fmt.Fprintln(os.Stderr, "  gdb:   run/flash and immediately enter GDB")
-	fmt.Fprintln(os.Stderr, "  env:   list environment variables used during build")
-	fmt.Fprintln(os.Stderr, "  clean: empty cache directory ("+goenv.Get("GOCACHE")+")")
-	fmt.Fprintln(os.Stderr, "  help:  print this help text")
+	fmt.Fprintln(os.Stderr, "  build:     compile packages and dependencies")
+	fmt.Fprintln(os.Stderr, "  run:       compile and run immediately")
+	fmt.Fprintln(os.Stderr, "  test:      test packages")
+	fmt.Fprintln(os.Stderr, "  flash:     compile and flash to the device")
+	fmt.Fprintln(os.Stderr, "  gdb:       run/flash and immediately enter GDB")
+	fmt.Fprintln(os.Stderr, "  env:       list environment variables used during build")
+	fmt.Fprintln(os.Stderr, "  targets:   list all targets that can be used with -target")
+	fmt.Fprintln(os.Stderr, "  size-diff: compare the sizes of two programs (ELF files or -size=json/csv reports)")
+	fmt.Fprintln(os.Stderr, "  uf2:       inspect, verify, convert or merge UF2 files (info, verify, convert, merge)")
+	fmt.Fprintln(os.Stderr, "  clean:     empty cache directory ("+goenv.Get("GOCACHE")+"), or only the files of -target and/or the -builtins")
+	fmt.Fprintln(os.Stderr, "  help:      print this help text")
 	fmt.Fprintln(os.Stderr, "\nflags:")
 	flag.PrintDefaults()
 }
 
-func handleCompilerError(err error) {
+// printCompilerError prints compiler errors using the provided logger function
+// (similar to fmt.Println).
+func printCompilerError(logln func(...interface{}), err error) {
+	switch err := err.(type) {
+	case *builder.StageError:
+		printCompilerError(logln, err.Err)
+	case *interp.Unsupported:
+		// hit an unknown/unsupported instruction
+		logln("#", err.ImportPath)
+		msg := "unsupported instruction during init evaluation:"
+		if err.Pos.String() != "" {
+			msg = err.Pos.String() + " " + msg
+		}
+		logln(msg)
+		err.Inst.Dump()
+		logln()
+	case types.Error, scanner.Error:
+		logln(err)
+	case interp.Error:
+		logln("#", err.ImportPath)
+		for _, err := range err.Errs {
+			logln(err)
+		}
+	case loader.Errors:
+		logln("#", err.Pkg.ImportPath)
+		for _, err := range err.Errs {
+			logln(err)
+		}
+	case *builder.MultiError:
+		for _, err := range err.Errs {
+			logln(err)
+		}
+	default:
+		logln("error:", err)
+	}
+}
+
+func handleCompilerError(pkgName string, options *compileopts.Options, err error) {
 	if err != nil {
-		switch err := err.(type) {
-		case *interp.Unsupported:
-			// hit an unknown/unsupported instruction
-			fmt.Fprintln(os.Stderr, "#", err.ImportPath)
-			msg := "unsupported instruction during init evaluation:"
-			if err.Pos.String() != "" {
-				msg = err.Pos.String() + " " + msg
-			}
-			fmt.Fprintln(os.Stderr, msg)
-			err.Inst.Dump()
-			fmt.Fprintln(os.Stderr)
-		case types.Error, scanner.Error:
-			fmt.Fprintln(os.Stderr, err)
-		case interp.Error:
-			fmt.Fprintln(os.Stderr, "#", err.ImportPath)
-			for _, err := range err.Errs {
-				fmt.Fprintln(os.Stderr, err)
-			}
-		case loader.Errors:
-			fmt.Fprintln(os.Stderr, "#", err.Pkg.ImportPath)
-			for _, err := range err.Errs {
-				fmt.Fprintln(os.Stderr, err)
-			}
-		case *builder.MultiError:
-			for _, err := range err.Errs {
-				fmt.Fprintln(os.Stderr, err)
-			}
-		default:
-			fmt.Fprintln(os.Stderr, "error:", err)
+		if options.PrintJSON {
+			printCompilerErrorJSON(pkgName, err)
+			os.Exit(1)
 		}
+		printCompilerError(func(args ...interface{}) {
+			fmt.Fprintln(os.Stderr, args...)
+		}, err)
 		os.Exit(1)
 	}
 }
@@ -689,7 +997,15 @@ func main() {
 	verifyIR := flag.Bool("verifyir", false, "run extra verification steps on LLVM IR")
 	tags := flag.String("tags", "", "a space-separated list of extra build tags")
 	target := flag.String("target", "", "LLVM target | .json file with TargetSpec")
-	printSize := flag.String("size", "", "print sizes (none, short, full)")
+	printSize := flag.String("size", "", "print sizes (none, short, full, symbols, json, csv)")
+	printStacks := flag.Bool("print-stacks", false, "print the worst-case stack usage of the program and each goroutine")
+	mapFile := flag.String("map", "", "write a linker map to this file (with a cross reference table for ld.lld) and print a summary per section and package")
+	compileCommands := flag.String("compile-commands", "", "write the C compiler invocations of the build to this compile_commands.json file (for clangd)")
+	printCommands := flag.Bool("x", false, "print the commands, temporary directories and cache hits of the build")
+	work := flag.Bool("work", false, "print the name of the temporary work directory and do not delete it when exiting")
+	parallelism := flag.Int("p", runtime.GOMAXPROCS(0), "the number of C compiler invocations that can run in parallel")
+	cacheSize := flag.String("cache-size", goenv.Get("TINYGOCACHESIZE"), "maximum size of the cache directory, least recently used files are removed first (default $TINYGOCACHESIZE, unlimited if empty)")
+	cleanBuiltins := flag.Bool("builtins", false, "only remove the compiled builtins (only for clean)")
 	nodebug := flag.Bool("no-debug", false, "disable DWARF debug symbol generation")
 	ocdOutput := flag.Bool("ocd-output", false, "print OCD daemon output during debug")
 	port := flag.String("port", "", "flash port")
@@ -698,6 +1014,22 @@ func main() {
 	ldFlags := flag.String("ldflags", "", "additional ldflags for linker")
 	wasmAbi := flag.String("wasm-abi", "js", "WebAssembly ABI conventions: js (no i64 params) or generic")
 	heapSize := flag.String("heap-size", "1M", "default heap size in bytes (only supported by WebAssembly)")
+	maxFlash := flag.String("max-flash", "", "maximum flash usage in bytes, overrides the flash-size of the target")
+	maxRAM := flag.String("max-ram", "", "maximum static RAM usage in bytes, overrides the ram-size of the target")
+	stackCheck := flag.String("stack-check", "", "goroutine stack overflow detection (none, canary, mpu), only supported with the tasks scheduler")
+	stackSize := flag.String("stack-size", "", "goroutine stack size in bytes if it cannot be determined automatically (only supported with the tasks scheduler)")
+	autoStackSize := flag.Bool("automatic-stack-size", false, "size goroutine stacks using their worst-case stack usage (default from the target, only supported with the tasks scheduler)")
+	binFill := flag.String("bin-fill", "0xff", "byte used to fill gaps between segments in a .bin file")
+	binBase := flag.String("bin-base", "", "start address of a .bin file (default: the lowest segment address)")
+	imageFormat := flag.String("image-format", "", "add a header or trailer to firmware images for the bootloader (crc32, sha256, header, mcuboot)")
+	imageVersion := flag.String("image-version", "", "version stored in the firmware image header, like 1.2.3+4")
+	jsonOutput := flag.Bool("json", false, "print diagnostics and build events as JSON, or the list of targets (for targets)")
+	testVerbose := flag.Bool("v", false, "verbose: print the output of all tests (only for test)")
+	testRun := flag.String("run", "", "only run tests matching this regexp (only for test)")
+	testBench := flag.String("bench", "", "run benchmarks matching this regexp (only for test)")
+	testBenchTime := flag.String("benchtime", "", "run each benchmark for a duration (like 1s) or number of iterations (like 100x) (only for test)")
+	testCover := flag.Bool("cover", false, "enable coverage analysis (only for test)")
+	testCoverProfile := flag.String("coverprofile", "", "write a coverage profile to this file, implies -cover (only for test)")
 
 	if len(os.Args) < 2 {
 		fmt.Fprintln(os.Stderr, "No command-line arguments supplied.")
@@ -706,21 +1038,52 @@ func main() {
 	}
 	command := os.Args[1]
 
+	switch command {
+	case "clang", "ld.lld", "wasm-ld":
+		// Run a built-in tool. The builder runs these in a child process, so
+		// that they can run in parallel. The arguments are passed as-is.
+		err := builder.RunTool(command, os.Args[2:]...)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	builder.ToolProcesses = true
+
 	flag.CommandLine.Parse(os.Args[2:])
 	options := &compileopts.Options{
-		Target:        *target,
-		Opt:           *opt,
-		GC:            *gc,
-		PanicStrategy: *panicStrategy,
-		Scheduler:     *scheduler,
-		PrintIR:       *printIR,
-		DumpSSA:       *dumpSSA,
-		VerifyIR:      *verifyIR,
-		Debug:         !*nodebug,
-		PrintSizes:    *printSize,
-		Tags:          *tags,
-		WasmAbi:       *wasmAbi,
-		Programmer:    *programmer,
+		Target:          *target,
+		Opt:             *opt,
+		GC:              *gc,
+		PanicStrategy:   *panicStrategy,
+		Scheduler:       *scheduler,
+		PrintIR:         *printIR,
+		DumpSSA:         *dumpSSA,
+		VerifyIR:        *verifyIR,
+		Debug:           !*nodebug,
+		PrintSizes:      *printSize,
+		PrintJSON:       *jsonOutput,
+		PrintStacks:     *printStacks,
+		MapFile:         *mapFile,
+		CompileCommands: *compileCommands,
+		PrintCommands:   *printCommands,
+		Work:            *work,
+		Parallelism:     *parallelism,
+		StackCheck:      *stackCheck,
+		ImageFormat:     *imageFormat,
+		ImageVersion:    *imageVersion,
+		Tags:            *tags,
+		WasmAbi:         *wasmAbi,
+		Programmer:      *programmer,
+		TestConfig: compileopts.TestConfig{
+			Verbose:      *testVerbose,
+			RunRegexp:    *testRun,
+			BenchRegexp:  *testBench,
+			BenchTime:    *testBenchTime,
+			Cover:        *testCover || *testCoverProfile != "",
+			CoverProfile: *testCoverProfile,
+		},
 	}
 
 	if *cFlags != "" {
@@ -728,7 +1091,14 @@ func main() {
 	}
 
 	if *ldFlags != "" {
-		options.LDFlags = strings.Split(*ldFlags, " ")
+		ldflags, globalValues, err := parseLDFlags(*ldFlags)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			usage()
+			os.Exit(1)
+		}
+		options.LDFlags = ldflags
+		options.GlobalValues = globalValues
 	}
 
 	if *panicStrategy != "print" && *panicStrategy != "trap" {
@@ -737,12 +1107,83 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *parallelism < 1 {
+		fmt.Fprintln(os.Stderr, "The number of parallel jobs (-p) must be at least 1.")
+		usage()
+		os.Exit(1)
+	}
+
+	switch *stackCheck {
+	case "", "none", "canary", "mpu":
+	default:
+		fmt.Fprintln(os.Stderr, "Stack check must be one of none, canary or mpu.")
+		usage()
+		os.Exit(1)
+	}
+
+	switch *imageFormat {
+	case "", "crc32", "sha256", "header", "mcuboot":
+	default:
+		fmt.Fprintln(os.Stderr, "Image format must be one of crc32, sha256, header or mcuboot.")
+		usage()
+		os.Exit(1)
+	}
+
 	var err error
 	if options.HeapSize, err = parseSize(*heapSize); err != nil {
 		fmt.Fprintln(os.Stderr, "Could not read heap size:", *heapSize)
 		usage()
 		os.Exit(1)
 	}
+	if *maxFlash != "" {
+		if options.MaxFlash, err = parseSize(*maxFlash); err != nil {
+			fmt.Fprintln(os.Stderr, "Could not read maximum flash size:", *maxFlash)
+			usage()
+			os.Exit(1)
+		}
+	}
+	if *maxRAM != "" {
+		if options.MaxRAM, err = parseSize(*maxRAM); err != nil {
+			fmt.Fprintln(os.Stderr, "Could not read maximum RAM size:", *maxRAM)
+			usage()
+			os.Exit(1)
+		}
+	}
+	if *stackSize != "" {
+		if options.StackSize, err = parseSize(*stackSize); err != nil {
+			fmt.Fprintln(os.Stderr, "Could not read stack size:", *stackSize)
+			usage()
+			os.Exit(1)
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		// Only override the default of the target if the flag was given.
+		if f.Name == "automatic-stack-size" {
+			options.AutoStackSize = autoStackSize
+		}
+	})
+	if *cacheSize != "" {
+		if options.CacheSize, err = parseSize(*cacheSize); err != nil {
+			fmt.Fprintln(os.Stderr, "Could not read cache size:", *cacheSize)
+			usage()
+			os.Exit(1)
+		}
+	}
+
+	if fill, err := strconv.ParseUint(*binFill, 0, 8); err != nil {
+		fmt.Fprintln(os.Stderr, "Could not read fill byte:", *binFill)
+		usage()
+		os.Exit(1)
+	} else {
+		options.BinFill = byte(fill)
+	}
+	if *binBase != "" {
+		if options.BinBase, err = strconv.ParseUint(*binBase, 0, 64); err != nil {
+			fmt.Fprintln(os.Stderr, "Could not read base address:", *binBase)
+			usage()
+			os.Exit(1)
+		}
+	}
 
 	os.Setenv("CC", "clang -target="+*target)
 
@@ -765,7 +1206,7 @@ func main() {
 			options.Target = "wasm"
 		}
 		err := Build(pkgName, *outpath, options)
-		handleCompilerError(err)
+		handleCompilerError(pkgName, options, err)
 	case "build-builtins":
 		// Note: this command is only meant to be used while making a release!
 		if *outpath == "" {
@@ -776,10 +1217,10 @@ func main() {
 		if *target == "" {
 			fmt.Fprintln(os.Stderr, "No target (-target).")
 		}
-		err := builder.CompileBuiltins(*target, func(path string) error {
+		err := builder.CompileBuiltins(*target, options, func(path string) error {
 			return moveFile(path, *outpath)
 		})
-		handleCompilerError(err)
+		handleCompilerError("", options, err)
 	case "flash", "gdb":
 		if *outpath != "" {
 			fmt.Fprintln(os.Stderr, "Output cannot be specified with the flash command.")
@@ -788,7 +1229,7 @@ func main() {
 		}
 		if command == "flash" {
 			err := Flash(flag.Arg(0), *port, options)
-			handleCompilerError(err)
+			handleCompilerError(flag.Arg(0), options, err)
 		} else {
 			if !options.Debug {
 				fmt.Fprintln(os.Stderr, "Debug disabled while running gdb?")
@@ -796,7 +1237,7 @@ func main() {
 				os.Exit(1)
 			}
 			err := FlashGDB(flag.Arg(0), *ocdOutput, options)
-			handleCompilerError(err)
+			handleCompilerError(flag.Arg(0), options, err)
 		}
 	case "run":
 		if flag.NArg() != 1 {
@@ -805,18 +1246,48 @@ func main() {
 			os.Exit(1)
 		}
 		err := Run(flag.Arg(0), options)
-		handleCompilerError(err)
+		handleCompilerError(flag.Arg(0), options, err)
 	case "test":
-		pkgName := "."
-		if flag.NArg() == 1 {
-			pkgName = flag.Arg(0)
-		} else if flag.NArg() > 1 {
-			fmt.Fprintln(os.Stderr, "test only accepts a single positional argument: package name, but multiple were specified")
-			usage()
+		patterns := flag.Args()
+		if len(patterns) == 0 {
+			patterns = []string{"."}
+		}
+		pkgNames, err := expandPackagePatterns(patterns)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if options.TestConfig.CoverProfile != "" {
+			// Start with an empty coverage profile, the profile of each
+			// package is appended to it.
+			if err := ioutil.WriteFile(options.TestConfig.CoverProfile, nil, 0666); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+		allTestsPassed := true
+		for _, pkgName := range pkgNames {
+			passed, err := Test(pkgName, options)
+			if err != nil {
+				if options.PrintJSON {
+					printCompilerErrorJSON(pkgName, err)
+				} else {
+					printCompilerError(func(args ...interface{}) {
+						fmt.Fprintln(os.Stderr, args...)
+					}, err)
+					fmt.Printf("FAIL\t%s [build failed]\n", pkgName)
+				}
+			}
+			if !passed {
+				allTestsPassed = false
+			}
+		}
+		if !allTestsPassed {
+			if !options.PrintJSON {
+				fmt.Println("FAIL")
+			}
 			os.Exit(1)
 		}
-		err := Test(pkgName, options)
-		handleCompilerError(err)
 	case "info":
 		if flag.NArg() == 1 {
 			options.Target = flag.Arg(0)
@@ -842,9 +1313,42 @@ func main() {
 		fmt.Printf("build tags:        %s\n", strings.Join(config.BuildTags(), " "))
 		fmt.Printf("garbage collector: %s\n", config.GC())
 		fmt.Printf("scheduler:         %s\n", config.Scheduler())
+	case "targets":
+		err := Targets(flag.Args(), *jsonOutput)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "size-diff":
+		if flag.NArg() != 2 {
+			fmt.Fprintln(os.Stderr, "size-diff requires two arguments: the old and the new program or size report")
+			usage()
+			os.Exit(1)
+		}
+		err := SizeDiff(flag.Arg(0), flag.Arg(1))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "uf2":
+		err := UF2(flag.Args())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 	case "clean":
-		// remove cache directory
-		err := os.RemoveAll(goenv.Get("GOCACHE"))
+		// Remove the cache directory, or only the part of it for the given
+		// target and/or the compiled builtins.
+		triple := ""
+		if *target != "" {
+			spec, err := compileopts.LoadTarget(*target)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "cannot clean cache:", err)
+				os.Exit(1)
+			}
+			triple = spec.Triple
+		}
+		err := builder.CleanCache(triple, *cleanBuiltins)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, "cannot clean cache:", err)
 			os.Exit(1)
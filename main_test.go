@@ -6,22 +6,42 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/tinygo-org/tinygo/builder"
 	"github.com/tinygo-org/tinygo/compileopts"
+	"github.com/tinygo-org/tinygo/goenv"
 	"github.com/tinygo-org/tinygo/loader"
 )
 
 const TESTDATA = "testdata"
 
+func TestMain(m *testing.M) {
+	// The builder runs the built-in tools in a child process: this test
+	// binary, started with the tool as the first argument.
+	if builder.IsToolProcess() {
+		err := builder.RunTool(os.Args[1], os.Args[2:]...)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	builder.ToolProcesses = true
+	os.Exit(m.Run())
+}
+
 func TestCompiler(t *testing.T) {
 	matches, err := filepath.Glob(filepath.Join(TESTDATA, "*.go"))
 	if err != nil {
@@ -95,6 +115,142 @@ func runBuild(src, out string, opts *compileopts.Options) error {
 }
 
 func runTest(path, target string, t *testing.T) {
+	config := &compileopts.Options{
+		Target:     target,
+		Opt:        "z",
+		PrintIR:    false,
+		DumpSSA:    false,
+		VerifyIR:   true,
+		Debug:      false,
+		PrintSizes: "",
+		WasmAbi:    "js",
+	}
+	runTestWithConfig(path, config, t)
+}
+
+// TestPackageCache builds and runs a program that needs a scheduler with both
+// scheduler implementations, first with an empty package cache and then with
+// all packages loaded from the cache.
+func TestPackageCache(t *testing.T) {
+	if testing.Short() {
+		t.Skip("needs QEMU")
+	}
+	if runtime.GOOS != "linux" {
+		t.Skip("the cache directory can only be changed on Linux")
+	}
+
+	// Use an empty cache directory.
+	cachedir, err := ioutil.TempDir("", "tinygo-cache")
+	if err != nil {
+		t.Fatal("could not create temporary directory:", err)
+	}
+	defer os.RemoveAll(cachedir)
+	oldCacheHome, hadCacheHome := os.LookupEnv("XDG_CACHE_HOME")
+	os.Setenv("XDG_CACHE_HOME", cachedir)
+	defer func() {
+		if hadCacheHome {
+			os.Setenv("XDG_CACHE_HOME", oldCacheHome)
+		} else {
+			os.Unsetenv("XDG_CACHE_HOME")
+		}
+	}()
+
+	for _, scheduler := range []string{"coroutines", "tasks"} {
+		for _, cache := range []string{"cold", "warm"} {
+			t.Run(scheduler+"-"+cache, func(t *testing.T) {
+				config := &compileopts.Options{
+					Target:    "cortex-m-qemu",
+					Scheduler: scheduler,
+					Opt:       "z",
+					VerifyIR:  true,
+				}
+				runTestWithConfig(filepath.Join(TESTDATA, "coroutines.go"), config, t)
+			})
+		}
+	}
+}
+
+// TestStackCheck checks that a goroutine stack overflow is detected by both
+// the stack canary and the MPU guard region.
+func TestStackCheck(t *testing.T) {
+	if testing.Short() {
+		t.Skip("needs QEMU")
+	}
+	for _, stackCheck := range []string{"canary", "mpu"} {
+		t.Run(stackCheck, func(t *testing.T) {
+			config := &compileopts.Options{
+				Target:     "cortex-m-qemu",
+				Scheduler:  "tasks",
+				StackCheck: stackCheck,
+				Opt:        "z",
+				VerifyIR:   true,
+			}
+			runTestWithConfig(filepath.Join(TESTDATA, "stackcheck", "overflow.go"), config, t)
+		})
+	}
+}
+
+// TestFailNow checks that FailNow and SkipNow stop a subtest, which is only
+// possible with the task based scheduler.
+func TestFailNow(t *testing.T) {
+	if testing.Short() {
+		t.Skip("needs QEMU")
+	}
+	config := &compileopts.Options{
+		Target:    "cortex-m-qemu",
+		Scheduler: "tasks",
+		Opt:       "z",
+		VerifyIR:  true,
+	}
+	runTestWithConfig(filepath.Join(TESTDATA, "testing", "failnow.go"), config, t)
+}
+
+// TestCoverage runs the tests of a package with coverage instrumentation and
+// compares the coverage profile with the expected profile. The directory of
+// the file names in the profile depends on the import path of the package, so
+// only the base name is compared.
+func TestCoverage(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "tinygo-cover")
+	if err != nil {
+		t.Fatal("could not create temporary directory:", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	profile := filepath.Join(tmpdir, "cover.out")
+
+	config := &compileopts.Options{
+		Opt:      "z",
+		VerifyIR: true,
+		TestConfig: compileopts.TestConfig{
+			Cover:        true,
+			CoverProfile: profile,
+		},
+	}
+	passed, err := Test("./"+filepath.ToSlash(filepath.Join(TESTDATA, "coverage")), config)
+	if err != nil {
+		t.Fatal("could not run tests:", err)
+	}
+	if !passed {
+		t.Error("tests failed")
+	}
+
+	expected, err := ioutil.ReadFile(filepath.Join(TESTDATA, "coverage", "cover.txt"))
+	if err != nil {
+		t.Fatal("could not read expected coverage profile:", err)
+	}
+	actual, err := ioutil.ReadFile(profile)
+	if err != nil {
+		t.Fatal("could not read coverage profile:", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(actual)), "\n")
+	for i, line := range lines {
+		lines[i] = line[strings.LastIndexByte(line, '/')+1:]
+	}
+	if strings.Join(lines, "\n") != strings.TrimSpace(string(expected)) {
+		t.Errorf("unexpected coverage profile:\n%s\nexpected:\n%s", actual, expected)
+	}
+}
+
+func runTestWithConfig(path string, config *compileopts.Options, t *testing.T) {
 	// Get the expected output for this test.
 	txtpath := path[:len(path)-3] + ".txt"
 	if path[len(path)-1] == os.PathSeparator {
@@ -118,16 +274,7 @@ func runTest(path, target string, t *testing.T) {
 	}()
 
 	// Build the test binary.
-	config := &compileopts.Options{
-		Target:     target,
-		Opt:        "z",
-		PrintIR:    false,
-		DumpSSA:    false,
-		VerifyIR:   true,
-		Debug:      false,
-		PrintSizes: "",
-		WasmAbi:    "js",
-	}
+	target := config.Target
 	binary := filepath.Join(tmpdir, "test")
 	err = runBuild("./"+path, binary, config)
 	if err != nil {
@@ -217,3 +364,174 @@ func runTest(path, target string, t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestParseLDFlags(t *testing.T) {
+	for _, tc := range []struct {
+		flags        string
+		ldflags      []string
+		globalValues map[string]map[string]string
+		err          string
+	}{
+		{flags: ""},
+		{flags: "--gc-sections -L /lib", ldflags: []string{"--gc-sections", "-L", "/lib"}},
+		{flags: "-X main.version=1.0", globalValues: map[string]map[string]string{"main": {"version": "1.0"}}},
+		{flags: "-X=main.version=1.0", globalValues: map[string]map[string]string{"main": {"version": "1.0"}}},
+		{flags: "--X main.version=1.0", globalValues: map[string]map[string]string{"main": {"version": "1.0"}}},
+		{flags: "-X main.url=http://example.com/?a=b", globalValues: map[string]map[string]string{"main": {"url": "http://example.com/?a=b"}}},
+		{flags: "-X main.empty=", globalValues: map[string]map[string]string{"main": {"empty": ""}}},
+		{flags: "-X github.com/x/y.z.Version=v1 -X gopkg.in/yaml.v2.Version=2", globalValues: map[string]map[string]string{
+			"github.com/x/y.z": {"Version": "v1"},
+			"gopkg.in/yaml.v2": {"Version": "2"},
+		}},
+		{flags: "-X  main.a=1  --gc-sections -X main.b=2", ldflags: []string{"--gc-sections"}, globalValues: map[string]map[string]string{"main": {"a": "1", "b": "2"}}},
+		{flags: `-X "main.version=1.0 beta" -X 'main.name=a b'`, globalValues: map[string]map[string]string{"main": {"version": "1.0 beta", "name": "a b"}}},
+		{flags: "-X=", err: "-ldflags: -X flag requires argument of the form importpath.name=value, got "},
+		{flags: "-X main.version", err: "-ldflags: -X flag requires argument of the form importpath.name=value, got main.version"},
+		{flags: "-X version=1.0", err: "-ldflags: -X flag requires argument of the form importpath.name=value, got version=1.0"},
+		{flags: "-X main.=1.0", err: "-ldflags: -X flag requires argument of the form importpath.name=value, got main.=1.0"},
+		{flags: "-X .version=1.0", err: "-ldflags: -X flag requires argument of the form importpath.name=value, got .version=1.0"},
+		{flags: "--gc-sections -X", err: "-ldflags: missing argument to -X"},
+		{flags: `-X "main.version=1.0`, err: "-ldflags: EOF found when expecting closing quote"},
+	} {
+		ldflags, globalValues, err := parseLDFlags(tc.flags)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("parseLDFlags(%q): expected error %q, got %v", tc.flags, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseLDFlags(%q): unexpected error: %v", tc.flags, err)
+			continue
+		}
+		if !reflect.DeepEqual(ldflags, tc.ldflags) {
+			t.Errorf("parseLDFlags(%q): expected ldflags %q, got %q", tc.flags, tc.ldflags, ldflags)
+		}
+		if !reflect.DeepEqual(globalValues, tc.globalValues) {
+			t.Errorf("parseLDFlags(%q): expected -X values %v, got %v", tc.flags, tc.globalValues, globalValues)
+		}
+	}
+}
+
+func TestExpandPackagePatterns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tinygo-patterns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{
+		"a/a.go",
+		"a/b/b.go",
+		"a/c/README",
+		"a/testdata/t.go",
+		"a/vendor/example.com/v/v.go",
+		"a/_x/x.go",
+		"a/.x/x.go",
+		"d/d.go",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		pkgName := filepath.Base(filepath.Dir(path))
+		if err := ioutil.WriteFile(path, []byte("package "+pkgName+"\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		patterns []string
+		pkgNames []string
+		err      string
+	}{
+		{patterns: []string{"./a"}, pkgNames: []string{"./a"}},
+		{patterns: []string{"./a", "./d", "fmt"}, pkgNames: []string{"./a", "./d", "fmt"}},
+		{patterns: []string{"./..."}, pkgNames: []string{"./a", "./a/b", "./d"}},
+		{patterns: []string{"./a/..."}, pkgNames: []string{"./a", "./a/b"}},
+		{patterns: []string{"./a/b/...", "./d"}, pkgNames: []string{"./a/b", "./d"}},
+		{patterns: []string{"./a/c/..."}, err: "pattern ./a/c/...: no packages found"},
+	} {
+		pkgNames, err := expandPackagePatterns(tc.patterns)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("expandPackagePatterns(%q): expected error %q, got %v", tc.patterns, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expandPackagePatterns(%q): unexpected error: %v", tc.patterns, err)
+			continue
+		}
+		if !reflect.DeepEqual(pkgNames, tc.pkgNames) {
+			t.Errorf("expandPackagePatterns(%q): expected %q, got %q", tc.patterns, tc.pkgNames, pkgNames)
+		}
+	}
+}
+
+func TestRunTestBinary(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test uses sh as an emulator")
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		emulator []string
+		passed   bool
+		output   string
+	}{
+		// The test result is reported through the exit status. The test
+		// binary runs in the package directory.
+		{[]string{"sh", "-c", "pwd"}, true, filepath.Join(wd, "testdata") + "\nok  \t./testdata\t"},
+		{[]string{"sh", "-c", "exit 1"}, false, "FAIL\t./testdata\t"},
+	}
+	for _, tc := range testCases {
+		config := &compileopts.Config{
+			Options: &compileopts.Options{},
+			Target:  &compileopts.TargetSpec{Emulator: tc.emulator},
+		}
+		buf := &bytes.Buffer{}
+		passed, err := runTestBinary(config, "./testdata", "main", buf)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.emulator, err)
+			continue
+		}
+		if passed != tc.passed {
+			t.Errorf("%q: expected passed=%t, got %t", tc.emulator, tc.passed, passed)
+		}
+		if !strings.HasPrefix(buf.String(), tc.output) {
+			t.Errorf("%q: unexpected output: %q", tc.emulator, buf.String())
+		}
+	}
+
+	// An emulator that can't be started is an error, not a failed test.
+	config := &compileopts.Config{
+		Options: &compileopts.Options{},
+		Target:  &compileopts.TargetSpec{Emulator: []string{filepath.Join(wd, "testdata", "no-such-emulator")}},
+	}
+	if _, err := runTestBinary(config, "./testdata", "main", ioutil.Discard); err == nil {
+		t.Error("expected an error for an emulator that doesn't exist")
+	}
+}
+
+func TestEmulatorCommand(t *testing.T) {
+	// Files in the TinyGo root are passed as absolute paths, as the emulator
+	// runs in the package directory.
+	config := &compileopts.Config{
+		Target: &compileopts.TargetSpec{Emulator: []string{"node", "targets/wasm_exec.js"}},
+	}
+	cmd := emulatorCommand(config, "/tmp/main", "-test.v")
+	expected := []string{"node", filepath.Join(goenv.Get("TINYGOROOT"), "targets", "wasm_exec.js"), "/tmp/main", "-test.v"}
+	if !reflect.DeepEqual(cmd.Args, expected) {
+		t.Errorf("expected %q, got %q", expected, cmd.Args)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/tinygo-org/tinygo/builder"
+)
+
+// sizeDelta is the difference in size of a single package or symbol between two
+// size reports.
+type sizeDelta struct {
+	name                    string
+	code, rodata, data, bss int64
+}
+
+func (d *sizeDelta) flash() int64 {
+	return d.code + d.rodata + d.data
+}
+
+func (d *sizeDelta) ram() int64 {
+	return d.data + d.bss
+}
+
+// SizeDiff compares the size reports of two programs and prints the growth per
+// package and per symbol. Each path can be a size report written with
+// -size=json or -size=csv, or an ELF file.
+func SizeDiff(oldPath, newPath string) error {
+	oldReport, err := builder.LoadSizeReport(oldPath)
+	if err != nil {
+		return err
+	}
+	newReport, err := builder.LoadSizeReport(newPath)
+	if err != nil {
+		return err
+	}
+
+	packages := diffSizeEntries(oldReport.Packages, newReport.Packages, func(e *builder.SizeReportEntry) string {
+		return e.Package
+	})
+	symbols := diffSizeEntries(oldReport.Symbols, newReport.Symbols, func(e *builder.SizeReportEntry) string {
+		if e.File != "" {
+			return e.Symbol + " (" + e.File + ")"
+		}
+		return e.Symbol
+	})
+
+	fmt.Printf("   code  rodata    data     bss |   flash     ram | package\n")
+	sum := &sizeDelta{name: "(sum)"}
+	for _, d := range packages {
+		printSizeDelta(d)
+		sum.code += d.code
+		sum.rodata += d.rodata
+		sum.data += d.data
+		sum.bss += d.bss
+	}
+	printSizeDelta(sum)
+	all := &sizeDelta{
+		name: "(all)",
+		code: int64(newReport.Code) - int64(oldReport.Code),
+		data: int64(newReport.Data) - int64(oldReport.Data),
+		bss:  int64(newReport.BSS) - int64(oldReport.BSS),
+	}
+	fmt.Printf("%+7d       - %+7d %+7d | %+7d %+7d | %s\n", all.code, all.data, all.bss, all.code+all.data, all.ram(), all.name)
+
+	if len(symbols) != 0 {
+		fmt.Printf("\n   code  rodata    data     bss |   flash     ram | symbol\n")
+		for _, d := range symbols {
+			printSizeDelta(d)
+		}
+	}
+	return nil
+}
+
+// diffSizeEntries returns the difference between two lists of size report
+// entries, matched by the given key. Only entries that changed in size are
+// returned, sorted by flash growth and then RAM growth (largest first).
+func diffSizeEntries(oldEntries, newEntries []builder.SizeReportEntry, key func(*builder.SizeReportEntry) string) []*sizeDelta {
+	deltas := make(map[string]*sizeDelta)
+	add := func(entries []builder.SizeReportEntry, sign int64) {
+		for i := range entries {
+			e := &entries[i]
+			name := key(e)
+			d := deltas[name]
+			if d == nil {
+				d = &sizeDelta{name: name}
+				deltas[name] = d
+			}
+			d.code += sign * int64(e.Code)
+			d.rodata += sign * int64(e.ROData)
+			d.data += sign * int64(e.Data)
+			d.bss += sign * int64(e.BSS)
+		}
+	}
+	add(oldEntries, -1)
+	add(newEntries, 1)
+
+	var changed []*sizeDelta
+	for _, d := range deltas {
+		if d.code != 0 || d.rodata != 0 || d.data != 0 || d.bss != 0 {
+			changed = append(changed, d)
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool {
+		if changed[i].flash() != changed[j].flash() {
+			return changed[i].flash() > changed[j].flash()
+		}
+		if changed[i].ram() != changed[j].ram() {
+			return changed[i].ram() > changed[j].ram()
+		}
+		return changed[i].name < changed[j].name
+	})
+	return changed
+}
+
+// printSizeDelta prints a single line of the size-diff table.
+func printSizeDelta(d *sizeDelta) {
+	fmt.Printf("%+7d %+7d %+7d %+7d | %+7d %+7d | %s\n", d.code, d.rodata, d.data, d.bss, d.flash(), d.ram(), d.name)
+}
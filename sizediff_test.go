@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/tinygo-org/tinygo/builder"
+)
+
+// TestSizeReportRoundTrip writes size reports as JSON and CSV, reads them back
+// like tinygo size-diff does and compares them.
+func TestSizeReportRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tinygo-sizediff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldReport := &builder.SizeReport{
+		Code: 1200,
+		Data: 16,
+		BSS:  512,
+		Packages: []builder.SizeReportEntry{
+			{Package: "main", Code: 100, ROData: 20},
+			{Package: "runtime", Code: 1000, Data: 16, BSS: 512},
+		},
+		Files: []builder.SizeReportEntry{
+			{Package: "main", File: "/src/main.go", Code: 100, ROData: 20},
+			{Package: "runtime", File: "/tinygo/src/runtime/gc.go", Code: 1000, Data: 16, BSS: 512},
+		},
+		Symbols: []builder.SizeReportEntry{
+			{Package: "main", File: "/src/main.go", Symbol: "main.main", Code: 100},
+			{Package: "main", Symbol: "main.table", ROData: 20},
+			{Package: "runtime", File: "/tinygo/src/runtime/gc.go", Symbol: "runtime.alloc", Code: 1000, Data: 16, BSS: 512},
+		},
+	}
+	newReport := &builder.SizeReport{
+		Code: 1300,
+		Data: 16,
+		BSS:  512,
+		Packages: []builder.SizeReportEntry{
+			{Package: "main", Code: 200, ROData: 20},
+			{Package: "runtime", Code: 1000, Data: 16, BSS: 512},
+		},
+		Files: []builder.SizeReportEntry{
+			{Package: "main", File: "/src/main.go", Code: 200, ROData: 20},
+			{Package: "runtime", File: "/tinygo/src/runtime/gc.go", Code: 1000, Data: 16, BSS: 512},
+		},
+		Symbols: []builder.SizeReportEntry{
+			{Package: "main", File: "/src/main.go", Symbol: "main.main", Code: 200},
+			{Package: "main", Symbol: "main.table", ROData: 20},
+			{Package: "runtime", File: "/tinygo/src/runtime/gc.go", Symbol: "runtime.alloc", Code: 1000, Data: 16, BSS: 512},
+		},
+	}
+
+	for _, ext := range []string{".json", ".csv"} {
+		var reports []*builder.SizeReport
+		for i, report := range []*builder.SizeReport{oldReport, newReport} {
+			path := filepath.Join(dir, "report"+strconv.Itoa(i)+ext)
+			f, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ext == ".json" {
+				err = report.WriteJSON(f)
+			} else {
+				err = report.WriteCSV(f)
+			}
+			f.Close()
+			if err != nil {
+				t.Fatalf("could not write %s report: %v", ext, err)
+			}
+			loaded, err := builder.LoadSizeReport(path)
+			if err != nil {
+				t.Fatalf("could not read %s report: %v", ext, err)
+			}
+			if !reflect.DeepEqual(loaded, report) {
+				t.Errorf("%s report changed after reading it back:\nwrote %+v\nread  %+v", ext, report, loaded)
+			}
+			reports = append(reports, loaded)
+		}
+
+		// Only main.main grew.
+		packages := diffSizeEntries(reports[0].Packages, reports[1].Packages, func(e *builder.SizeReportEntry) string {
+			return e.Package
+		})
+		expected := []*sizeDelta{{name: "main", code: 100}}
+		if !reflect.DeepEqual(packages, expected) {
+			t.Errorf("%s: unexpected package growth: %+v", ext, packages)
+		}
+		symbols := diffSizeEntries(reports[0].Symbols, reports[1].Symbols, func(e *builder.SizeReportEntry) string {
+			return e.Symbol
+		})
+		expected = []*sizeDelta{{name: "main.main", code: 100}}
+		if !reflect.DeepEqual(symbols, expected) {
+			t.Errorf("%s: unexpected symbol growth: %+v", ext, symbols)
+		}
+	}
+}
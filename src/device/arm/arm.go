@@ -76,6 +76,7 @@ const (
 	SYST_BASE = SCS_BASE + 0x0010
 	NVIC_BASE = SCS_BASE + 0x0100
 	SCB_BASE  = SCS_BASE + 0x0D00
+	MPU_BASE  = SCS_BASE + 0x0D90
 )
 
 const (
@@ -97,6 +98,13 @@ type SCB_Type struct {
 	_     volatile.Register32    // RESERVED1;
 	SHP   [2]volatile.Register32 // System Handlers Priority Registers. [0] is RESERVED
 	SHCSR volatile.Register32    // System Handler Control and State Register
+
+	// The following registers are not available on Cortex-M0 and Cortex-M0+.
+	CFSR  volatile.Register32 // Configurable Fault Status Register
+	HFSR  volatile.Register32 // HardFault Status Register
+	DFSR  volatile.Register32 // Debug Fault Status Register
+	MMFAR volatile.Register32 // MemManage Fault Address Register
+	BFAR  volatile.Register32 // BusFault Address Register
 }
 
 var SCB = (*SCB_Type)(unsafe.Pointer(uintptr(SCB_BASE)))
@@ -133,6 +141,21 @@ type SYST_Type struct {
 
 var SYST = (*SYST_Type)(unsafe.Pointer(uintptr(SYST_BASE)))
 
+// Memory Protection Unit (MPU)
+//
+// The MPU is optional: the TYPE register reads as zero if it is not present.
+//
+// Source: https://static.docs.arm.com/ddi0403/e/DDI0403E_d_armv7m_arm.pdf B3.5
+type MPU_Type struct {
+	TYPE volatile.Register32 // MPU Type Register
+	CTRL volatile.Register32 // MPU Control Register
+	RNR  volatile.Register32 // MPU Region Number Register
+	RBAR volatile.Register32 // MPU Region Base Address Register
+	RASR volatile.Register32 // MPU Region Attribute and Size Register
+}
+
+var MPU = (*MPU_Type)(unsafe.Pointer(uintptr(MPU_BASE)))
+
 // Bitfields for SYST: System Timer
 const (
 	// SYST.SYST_CSR: SysTick Control and Status Register
@@ -168,6 +191,48 @@ const (
 	SYST_CALIB_NOREF     = 0x80000000 // Bit NOREF.
 )
 
+// Bitfields for SCB and MPU registers
+const (
+	// SCB.CPUID: CPUID Base Register
+	SCB_CPUID_PARTNO_Pos       = 0x4    // Position of PARTNO field.
+	SCB_CPUID_PARTNO_Msk       = 0xfff0 // Bit mask of PARTNO field.
+	SCB_CPUID_PARTNO_CortexM0  = 0xc20  // Cortex-M0
+	SCB_CPUID_PARTNO_CortexM0P = 0xc60  // Cortex-M0+
+	SCB_CPUID_PARTNO_CortexM3  = 0xc23  // Cortex-M3
+	SCB_CPUID_PARTNO_CortexM4  = 0xc24  // Cortex-M4
+	SCB_CPUID_PARTNO_CortexM7  = 0xc27  // Cortex-M7
+
+	// SCB.SHCSR: System Handler Control and State Register
+	SCB_SHCSR_MEMFAULTENA = 0x10000 // Bit MEMFAULTENA.
+
+	// SCB.CFSR: Configurable Fault Status Register
+	SCB_CFSR_MSTKERR   = 0x10 // Bit MSTKERR: fault on exception entry stacking.
+	SCB_CFSR_MMARVALID = 0x80 // Bit MMARVALID: MMFAR holds a valid address.
+
+	// MPU.TYPE: MPU Type Register
+	MPU_TYPE_DREGION_Pos = 0x8    // Position of DREGION field.
+	MPU_TYPE_DREGION_Msk = 0xff00 // Bit mask of DREGION field.
+
+	// MPU.CTRL: MPU Control Register
+	MPU_CTRL_ENABLE     = 0x1 // Bit ENABLE.
+	MPU_CTRL_HFNMIENA   = 0x2 // Bit HFNMIENA.
+	MPU_CTRL_PRIVDEFENA = 0x4 // Bit PRIVDEFENA.
+
+	// MPU.RASR: MPU Region Attribute and Size Register
+	MPU_RASR_ENABLE   = 0x1        // Bit ENABLE.
+	MPU_RASR_SIZE_Pos = 0x1        // Position of SIZE field.
+	MPU_RASR_SIZE_Msk = 0x3e       // Bit mask of SIZE field.
+	MPU_RASR_B        = 0x10000    // Bit B (bufferable).
+	MPU_RASR_C        = 0x20000    // Bit C (cacheable).
+	MPU_RASR_S        = 0x40000    // Bit S (shareable).
+	MPU_RASR_TEX_Pos  = 0x13       // Position of TEX field.
+	MPU_RASR_TEX_Msk  = 0x380000   // Bit mask of TEX field.
+	MPU_RASR_AP_Pos   = 0x18       // Position of AP field.
+	MPU_RASR_AP_Msk   = 0x7000000  // Bit mask of AP field.
+	MPU_RASR_AP_RO    = 0x6        // Read-only for privileged and unprivileged code.
+	MPU_RASR_XN       = 0x10000000 // Bit XN (execute never).
+)
+
 // Enable the given interrupt number.
 func EnableIRQ(irq uint32) {
 	NVIC.ISER[irq>>5].Set(1 << (irq & 0x1F))
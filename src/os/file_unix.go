@@ -4,6 +4,7 @@ package os
 
 import (
 	"syscall"
+	_ "unsafe"
 )
 
 // Read reads up to len(b) bytes from the File. It returns the number of bytes
@@ -15,6 +16,9 @@ func (f *File) Read(b []byte) (n int, err error) {
 // Write writes len(b) bytes to the File. It returns the number of bytes written
 // and an error, if any. Write returns a non-nil error when n != len(b).
 func (f *File) Write(b []byte) (n int, err error) {
+	if f.fd == Stdout.fd && captureStdout(b) {
+		return len(b), nil
+	}
 	return syscall.Write(int(f.fd), b)
 }
 
@@ -22,3 +26,6 @@ func (f *File) Write(b []byte) (n int, err error) {
 func (f *File) Close() error {
 	return syscall.Close(int(f.fd))
 }
+
+//go:linkname captureStdout runtime.captureStdout
+func captureStdout(b []byte) bool
@@ -0,0 +1,63 @@
+package runtime
+
+// Output capturing, used by the testing package to check the output of
+// examples. While the standard output is captured, everything that would
+// normally be written to it (using println or os.Stdout) is stored in a buffer
+// instead.
+
+var (
+	stdoutCapturing bool
+	stdoutCaptured  []byte
+)
+
+// printchar writes a single byte to the standard output, or to the capture
+// buffer while output is captured.
+func printchar(c byte) {
+	if stdoutCapturing {
+		stdoutCaptured = append(stdoutCaptured, c)
+		return
+	}
+	putchar(c)
+}
+
+// captureStdout adds b to the capture buffer and returns true if the standard
+// output is currently being captured. It returns false otherwise, in which
+// case the caller should write b to the standard output itself.
+func captureStdout(b []byte) bool {
+	if !stdoutCapturing {
+		return false
+	}
+	stdoutCaptured = append(stdoutCaptured, b...)
+	return true
+}
+
+// flushCapture stops capturing the standard output and writes everything that
+// was captured so far to the real standard output. It is called before the
+// program aborts (for example on a panic), so that the captured output is not
+// lost and the error message itself is not captured. It doesn't allocate, so
+// it can also be called when the heap is exhausted.
+func flushCapture() {
+	if !stdoutCapturing {
+		return
+	}
+	stdoutCapturing = false
+	for _, c := range stdoutCaptured {
+		putchar(c)
+	}
+	stdoutCaptured = nil
+}
+
+// startCapture starts capturing the standard output.
+func startCapture() {
+	stdoutCapturing = true
+	stdoutCaptured = nil
+}
+
+// stopCapture stops capturing the standard output and returns everything that
+// was written to it since the call to startCapture.
+func stopCapture() string {
+	stdoutCapturing = false
+	s := string(stdoutCaptured)
+	stdoutCaptured = nil
+	return s
+}
@@ -272,6 +272,9 @@ func alloc(size uintptr) unsafe.Pointer {
 				i.setState(blockStateTail)
 			}
 
+			gcTotalAlloc += uint64(size)
+			gcMallocs++
+
 			// Return a pointer to this allocation.
 			pointer := thisAlloc.pointer()
 			memzero(pointer, size)
@@ -355,6 +358,7 @@ func sweep() {
 			// Unmarked head. Free it, including all tail blocks following it.
 			block.markFree()
 			freeCurrentObject = true
+			gcFrees++
 		case blockStateTail:
 			if freeCurrentObject {
 				// This is a tail object following an unmarked head.
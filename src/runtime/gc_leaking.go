@@ -23,6 +23,8 @@ func alloc(size uintptr) unsafe.Pointer {
 	if heapptr >= heapEnd {
 		runtimePanic("out of memory")
 	}
+	gcTotalAlloc += uint64(size)
+	gcMallocs++
 	for i := uintptr(0); i < uintptr(size); i += 4 {
 		ptr := (*uint32)(unsafe.Pointer(addr + i))
 		*ptr = 0
@@ -0,0 +1,30 @@
+package runtime
+
+// Memory statistics, updated by the heap allocator. They are only maintained
+// by the garbage collectors that are implemented in the runtime (not by
+// gc.none, which has no allocator).
+var (
+	gcTotalAlloc uint64 // total number of bytes allocated
+	gcMallocs    uint64 // total number of allocations
+	gcFrees      uint64 // total number of objects freed
+)
+
+// MemStats records statistics about the memory allocator. Only a subset of the
+// fields of the upstream Go runtime is implemented.
+type MemStats struct {
+	// TotalAlloc is cumulative bytes allocated for heap objects.
+	TotalAlloc uint64
+
+	// Mallocs is the cumulative count of heap objects allocated.
+	Mallocs uint64
+
+	// Frees is the cumulative count of heap objects freed.
+	Frees uint64
+}
+
+// ReadMemStats populates m with memory allocator statistics.
+func ReadMemStats(m *MemStats) {
+	m.TotalAlloc = gcTotalAlloc
+	m.Mallocs = gcMallocs
+	m.Frees = gcFrees
+}
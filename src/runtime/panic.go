@@ -7,6 +7,7 @@ func trap()
 
 // Builtin function panic(msg), used as a compiler intrinsic.
 func _panic(message interface{}) {
+	flushCapture()
 	printstring("panic: ")
 	printitf(message)
 	printnl()
@@ -15,8 +16,17 @@ func _panic(message interface{}) {
 
 // Cause a runtime panic, which is (currently) always a string.
 func runtimePanic(msg string) {
+	runtimePanicDetail(msg, "")
+}
+
+// runtimePanicDetail is like runtimePanic, but appends a detail (like the name
+// of a function) to the message without allocating memory.
+func runtimePanicDetail(msg, detail string) {
+	flushCapture()
 	printstring("panic: runtime error: ")
-	println(msg)
+	printstring(msg)
+	printstring(detail)
+	printnl()
 	abort()
 }
 
@@ -11,7 +11,7 @@ type stringer interface {
 //go:nobounds
 func printstring(s string) {
 	for i := 0; i < len(s); i++ {
-		putchar(s[i])
+		printchar(s[i])
 	}
 }
 
@@ -23,7 +23,7 @@ func printuint8(n uint8) {
 		if prevdigits != 0 {
 			printuint8(prevdigits)
 		}
-		putchar(byte((n % 10) + '0'))
+		printchar(byte((n % 10) + '0'))
 	}
 }
 
@@ -32,7 +32,7 @@ func printint8(n int8) {
 		printint32(int32(n))
 	} else {
 		if n < 0 {
-			putchar('-')
+			printchar('-')
 			n = -n
 		}
 		printuint8(uint8(n))
@@ -62,7 +62,7 @@ func printuint32(n uint32) {
 	}
 	// Print digits without the leading zeroes.
 	for i := firstdigit; i < 10; i++ {
-		putchar(digits[i])
+		printchar(digits[i])
 	}
 }
 
@@ -70,7 +70,7 @@ func printint32(n int32) {
 	// Print integer in signed big-endian base-10 notation, for humans to
 	// read.
 	if n < 0 {
-		putchar('-')
+		printchar('-')
 		n = -n
 	}
 	printuint32(uint32(n))
@@ -81,12 +81,12 @@ func printuint64(n uint64) {
 	if prevdigits != 0 {
 		printuint64(prevdigits)
 	}
-	putchar(byte((n % 10) + '0'))
+	printchar(byte((n % 10) + '0'))
 }
 
 func printint64(n int64) {
 	if n < 0 {
-		putchar('-')
+		printchar('-')
 		n = -n
 	}
 	printuint64(uint64(n))
@@ -174,31 +174,31 @@ func printfloat64(v float64) {
 	buf[n+5] = byte(e/10)%10 + '0'
 	buf[n+6] = byte(e%10) + '0'
 	for _, c := range buf {
-		putchar(c)
+		printchar(c)
 	}
 }
 
 func printcomplex64(c complex64) {
-	putchar('(')
+	printchar('(')
 	printfloat32(real(c))
 	printfloat32(imag(c))
 	printstring("i)")
 }
 
 func printcomplex128(c complex128) {
-	putchar('(')
+	printchar('(')
 	printfloat64(real(c))
 	printfloat64(imag(c))
 	printstring("i)")
 }
 
 func printspace() {
-	putchar(' ')
+	printchar(' ')
 }
 
 func printnl() {
-	putchar('\r')
-	putchar('\n')
+	printchar('\r')
+	printchar('\n')
 }
 
 func printitf(msg interface{}) {
@@ -244,7 +244,7 @@ func printitf(msg interface{}) {
 	default:
 		// cast to underlying type
 		itf := *(*_interface)(unsafe.Pointer(&msg))
-		putchar('(')
+		printchar('(')
 		switch unsafe.Sizeof(itf.typecode) {
 		case 2:
 			printuint16(uint16(itf.typecode))
@@ -253,9 +253,9 @@ func printitf(msg interface{}) {
 		case 8:
 			printuint64(uint64(itf.typecode))
 		}
-		putchar(':')
+		printchar(':')
 		print(itf.value)
-		putchar(')')
+		printchar(')')
 	}
 }
 
@@ -266,7 +266,7 @@ func printmap(m *hashmap) {
 	} else {
 		print(uint(m.count))
 	}
-	putchar(']')
+	printchar(']')
 }
 
 func printptr(ptr uintptr) {
@@ -274,14 +274,14 @@ func printptr(ptr uintptr) {
 		print("nil")
 		return
 	}
-	putchar('0')
-	putchar('x')
+	printchar('0')
+	printchar('x')
 	for i := 0; i < int(unsafe.Sizeof(ptr))*2; i++ {
 		nibble := byte(ptr >> (unsafe.Sizeof(ptr)*8 - 4))
 		if nibble < 10 {
-			putchar(nibble + '0')
+			printchar(nibble + '0')
 		} else {
-			putchar(nibble - 10 + 'a')
+			printchar(nibble - 10 + 'a')
 		}
 		ptr <<= 4
 	}
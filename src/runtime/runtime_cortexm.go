@@ -3,7 +3,6 @@
 package runtime
 
 import (
-	"device/arm"
 	"unsafe"
 )
 
@@ -63,16 +62,6 @@ func (r *calleeSavedRegs) prepareStartTask(fn, args uintptr) {
 	r.r5 = args
 }
 
-func abort() {
-	// disable all interrupts
-	arm.DisableInterrupts()
-
-	// lock up forever
-	for {
-		arm.Asm("wfi")
-	}
-}
-
 // The stack layout at the moment an interrupt occurs.
 // Registers can be accessed if the stack pointer is cast to a pointer to this
 // struct.
@@ -99,6 +88,7 @@ type interruptStack struct {
 // https://blog.feabhas.com/2013/02/developing-a-generic-hard-fault-handler-for-arm-cortex-m3cortex-m4/
 //go:export handleHardFault
 func handleHardFault(sp *interruptStack) {
+	flushCapture()
 	print("fatal error: ")
 	if uintptr(unsafe.Pointer(sp)) < 0x20000000 {
 		print("stack overflow")
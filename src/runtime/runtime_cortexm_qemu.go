@@ -28,13 +28,38 @@ func main() {
 
 const asyncScheduler = false
 
+func abort() {
+	// Exit QEMU with an error, so that panics and failed tests are reported
+	// as such by the host.
+	arm.SemihostingCall(arm.SemihostingReportException, arm.SemihostingRunTimeErrorUnknown)
+	for {
+		arm.Asm("wfi")
+	}
+}
+
+//go:linkname syscall_Exit syscall.Exit
+func syscall_Exit(code int) {
+	// The 32-bit semihosting exit call cannot pass an exit code, only a reason.
+	// QEMU exits with status 0 on ApplicationExit and with status 1 otherwise.
+	if code == 0 {
+		arm.SemihostingCall(arm.SemihostingReportException, arm.SemihostingApplicationExit)
+	} else {
+		arm.SemihostingCall(arm.SemihostingReportException, arm.SemihostingRunTimeErrorUnknown)
+	}
+	abort()
+}
+
 func sleepTicks(d timeUnit) {
 	// TODO: actually sleep here for the given time.
 	timestamp += d
 }
 
 func ticks() timeUnit {
-	return timestamp
+	// The semihosting clock has a resolution of 10ms, but it is the only clock
+	// available that follows the host wall clock. This makes it possible to
+	// measure the time taken by code running in QEMU, for example benchmarks.
+	centiseconds := arm.SemihostingCall(arm.SemihostingClock, 0)
+	return timestamp + timeUnit(centiseconds)*10000
 }
 
 // UART0 output register.
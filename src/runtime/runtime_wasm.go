@@ -18,6 +18,10 @@ type wasiIOVec struct {
 //export fd_write
 func fd_write(id uint32, iovs *wasiIOVec, iovs_len uint, nwritten *uint) (errno uint)
 
+//go:wasm-module wasi_unstable
+//export proc_exit
+func proc_exit(exitcode uint32)
+
 //export _start
 func _start() {
 	initAll()
@@ -68,6 +72,11 @@ func sleepTicks(d timeUnit)
 //go:export runtime.ticks
 func ticks() timeUnit
 
+//go:linkname syscall_Exit syscall.Exit
+func syscall_Exit(code int) {
+	proc_exit(uint32(code))
+}
+
 // Abort executes the wasm 'unreachable' instruction.
 func abort() {
 	trap()
@@ -4,8 +4,6 @@ package runtime
 
 import "unsafe"
 
-const stackSize = 1024
-
 // Stack canary, to detect a stack overflow. The number is a random number
 // generated by random.org. The bit fiddling dance is necessary because
 // otherwise Go wouldn't allow the cast to a smaller integer size.
@@ -16,8 +14,9 @@ var (
 )
 
 // This type points to the bottom of the goroutine stack and contains some state
-// that must be kept with the task. The last field is a canary, which is
-// necessary to make sure that no stack overflow occured when switching tasks.
+// that must be kept with the task. The last fields are used to make sure that no
+// stack overflow occured when switching tasks, and to report which goroutine
+// overflowed its stack if it did.
 type task struct {
 	// The order of fields in this structs must be kept in sync with assembly!
 	calleeSavedRegs
@@ -25,6 +24,8 @@ type task struct {
 	sp uintptr
 	taskState
 	canaryPtr *uintptr // used to detect stack overflows
+	stackGuardState
+	name string // name of the goroutine entry function, if known
 }
 
 // getCoroutine returns the currently executing goroutine. It is used as an
@@ -46,8 +47,11 @@ func (t *task) state() *taskState {
 // to the scheduler.
 func (t *task) resume() {
 	currentTask = t
+	enableStackGuard(t)
 	switchToTask(t)
+	disableStackGuard()
 	currentTask = nil
+	t.checkStack()
 }
 
 // switchToScheduler saves the current state on the stack, saves the current
@@ -71,19 +75,31 @@ func switchToTask(t *task)
 //go:extern tinygo_startTask
 var startTask [0]uint8
 
+// getGoroutineStackSize returns the stack size for a goroutine started with the
+// given goroutine start wrapper. It is implemented by the compiler: depending on
+// the target, it is either a constant or a value calculated from the worst-case
+// stack usage of the goroutine once the program has been linked.
+func getGoroutineStackSize(fn uintptr) uintptr
+
 // startGoroutine starts a new goroutine with the given function pointer and
-// argument. It creates a new goroutine stack, prepares it for execution, and
-// adds it to the runqueue.
-func startGoroutine(fn, args uintptr) {
+// argument. It creates a new goroutine stack of the given size, prepares it for
+// execution, and adds it to the runqueue. The name is only used to report a
+// stack overflow.
+func startGoroutine(fn, args, stackSize uintptr, name string) {
+	stackSize += stackGuardSize
 	stack := alloc(stackSize)
 	t := (*task)(unsafe.Pointer(uintptr(stack) + stackSize - unsafe.Sizeof(task{})))
-
-	// Set up the stack canary, a random number that should be checked when
-	// switching from the task back to the scheduler. The stack canary pointer
-	// points to the first word of the stack. If it has changed between now and
-	// the next stack switch, there was a stack overflow.
-	t.canaryPtr = (*uintptr)(unsafe.Pointer(stack))
-	*t.canaryPtr = stackCanary
+	t.name = name
+
+	if hasStackCanary {
+		// Set up the stack canary, a random number that should be checked
+		// when switching from the task back to the scheduler. The stack canary
+		// pointer points to the first word of the stack. If it has changed
+		// between now and the next stack switch, there was a stack overflow.
+		t.canaryPtr = (*uintptr)(unsafe.Pointer(stack))
+		*t.canaryPtr = stackCanary
+	}
+	initStackGuard(t, uintptr(stack))
 
 	// Store the initial sp/pc for the startTask function (implemented in
 	// assembly).
@@ -98,12 +114,26 @@ func startGoroutine(fn, args uintptr) {
 // any wakeups must be configured before calling yield
 //export runtime.yield
 func yield() {
-	// Check whether the canary (the lowest address of the stack) is still
-	// valid. If it is not, a stack overflow has occured.
-	if *currentTask.canaryPtr != stackCanary {
+	switchToScheduler(currentTask)
+}
+
+// checkStack checks whether the canary (the lowest address of the stack) is
+// still valid. If it is not, a stack overflow has occured. It is called each
+// time the task switches back to the scheduler.
+func (t *task) checkStack() {
+	if hasStackCanary && *t.canaryPtr != stackCanary {
+		t.stackOverflow()
+	}
+}
+
+// stackOverflow panics with a message that includes the name of the goroutine
+// entry function, if known. It must not allocate memory, as the heap may have
+// been overwritten by the stack overflow.
+func (t *task) stackOverflow() {
+	if t.name == "" {
 		runtimePanic("goroutine stack overflow")
 	}
-	switchToScheduler(currentTask)
+	runtimePanicDetail("goroutine stack overflow in ", t.name)
 }
 
 // getSystemStackPointer returns the current stack pointer of the system stack.
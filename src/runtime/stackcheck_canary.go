@@ -0,0 +1,19 @@
+// +build scheduler.tasks,!stackcheck.none
+// +build !cortexm !stackcheck.mpu
+
+package runtime
+
+// Stack overflow detection using only a stack canary (-stack-check=canary).
+// This is also used with -stack-check=mpu on chips without a supported MPU.
+
+const hasStackCanary = true
+
+const stackGuardSize = 0
+
+type stackGuardState struct{}
+
+func initStackGuard(t *task, stack uintptr) {}
+
+func enableStackGuard(t *task) {}
+
+func disableStackGuard() {}
@@ -0,0 +1,130 @@
+// +build scheduler.tasks,cortexm,stackcheck.mpu
+
+package runtime
+
+// Stack overflow detection using a stack canary and a MPU guard region at the
+// bottom of each goroutine stack (-stack-check=mpu). The guard region is
+// read-only, so that a stack overflow causes a MemManage fault as soon as it
+// happens while the garbage collector can still scan the stack. The guard is
+// only enabled while the goroutine is running.
+//
+// Only the PMSAv7 MPU of the Cortex-M3, Cortex-M4 and Cortex-M7 is supported.
+// On other chips, only the stack canary is used.
+
+import (
+	"device/arm"
+)
+
+const hasStackCanary = true
+
+// Size of the guard region. This is the smallest region size supported by the
+// MPU. The region must be aligned to its size.
+const stackGuardRegionSize = 32
+
+// Extra space allocated for each goroutine stack, to make room for an aligned
+// guard region.
+const stackGuardSize = 2 * stackGuardRegionSize
+
+type stackGuardState struct {
+	stackGuard uintptr // start of the guard region, or 0 without MPU
+}
+
+var (
+	stackGuardInitialized bool
+	stackGuardRegion      int = -1 // MPU region used for the guard, or -1 without MPU
+)
+
+// initStackGuard sets up the guard region for a new goroutine stack. The MPU is
+// configured when the first goroutine is started.
+func initStackGuard(t *task, stack uintptr) {
+	if !stackGuardInitialized {
+		stackGuardInitialized = true
+		initMPU()
+	}
+	if stackGuardRegion < 0 {
+		return
+	}
+	t.stackGuard = (stack + stackGuardRegionSize - 1) &^ (stackGuardRegionSize - 1)
+}
+
+// initMPU enables the MPU, if present and supported.
+func initMPU() {
+	switch (arm.SCB.CPUID.Get() & arm.SCB_CPUID_PARTNO_Msk) >> arm.SCB_CPUID_PARTNO_Pos {
+	case arm.SCB_CPUID_PARTNO_CortexM3, arm.SCB_CPUID_PARTNO_CortexM4, arm.SCB_CPUID_PARTNO_CortexM7:
+	default:
+		return
+	}
+	regions := (arm.MPU.TYPE.Get() & arm.MPU_TYPE_DREGION_Msk) >> arm.MPU_TYPE_DREGION_Pos
+	if regions == 0 {
+		return // no MPU present
+	}
+
+	// Use the highest numbered region, which takes priority over all other
+	// regions.
+	stackGuardRegion = int(regions - 1)
+
+	// Report MPU faults as MemManage faults instead of HardFaults, so that
+	// stack overflows can be detected as such.
+	arm.SCB.SHCSR.SetBits(arm.SCB_SHCSR_MEMFAULTENA)
+
+	// Enable the MPU. The default memory map is used for all memory that is
+	// not covered by a region (PRIVDEFENA).
+	arm.MPU.CTRL.SetBits(arm.MPU_CTRL_ENABLE | arm.MPU_CTRL_PRIVDEFENA)
+	arm.Asm("dsb")
+	arm.Asm("isb")
+}
+
+// enableStackGuard enables the guard region of the given task. It is called
+// just before switching to the task.
+func enableStackGuard(t *task) {
+	if t.stackGuard == 0 {
+		return
+	}
+	arm.MPU.RNR.Set(uint32(stackGuardRegion))
+	arm.MPU.RBAR.Set(uint32(t.stackGuard))
+	arm.MPU.RASR.Set(arm.MPU_RASR_ENABLE |
+		4<<arm.MPU_RASR_SIZE_Pos | // 2^(4+1) = 32 bytes
+		arm.MPU_RASR_AP_RO<<arm.MPU_RASR_AP_Pos |
+		arm.MPU_RASR_XN |
+		1<<arm.MPU_RASR_TEX_Pos | arm.MPU_RASR_C | arm.MPU_RASR_B) // normal memory, write-back
+	arm.Asm("dsb")
+	arm.Asm("isb")
+}
+
+// disableStackGuard disables the guard region after switching back to the
+// scheduler.
+func disableStackGuard() {
+	if stackGuardRegion < 0 {
+		return
+	}
+	arm.MPU.RNR.Set(uint32(stackGuardRegion))
+	arm.MPU.RASR.Set(0)
+	arm.Asm("dsb")
+	arm.Asm("isb")
+}
+
+// This function is called on a MemManage fault, which happens when a goroutine
+// writes to the guard region at the bottom of its stack or when an interrupt
+// handler tries to push registers there. It runs on the system stack.
+//go:export MemoryManagement_Handler
+func handleMemoryManagementFault() {
+	cfsr := arm.SCB.CFSR.Get()
+	if t := currentTask; t != nil && t.stackGuard != 0 {
+		if cfsr&arm.SCB_CFSR_MSTKERR != 0 {
+			t.stackOverflow()
+		}
+		if cfsr&arm.SCB_CFSR_MMARVALID != 0 {
+			addr := uintptr(arm.SCB.MMFAR.Get())
+			if addr >= t.stackGuard && addr < t.stackGuard+stackGuardRegionSize {
+				t.stackOverflow()
+			}
+		}
+	}
+	flushCapture()
+	print("fatal error: MemManage fault")
+	if cfsr&arm.SCB_CFSR_MMARVALID != 0 {
+		print(" with addr=", uintptr(arm.SCB.MMFAR.Get()))
+	}
+	println()
+	abort()
+}
@@ -0,0 +1,17 @@
+// +build scheduler.tasks,stackcheck.none
+
+package runtime
+
+// Stack overflow detection is disabled (-stack-check=none).
+
+const hasStackCanary = false
+
+const stackGuardSize = 0
+
+type stackGuardState struct{}
+
+func initStackGuard(t *task, stack uintptr) {}
+
+func enableStackGuard(t *task) {}
+
+func disableStackGuard() {}
@@ -3,15 +3,381 @@
 // license that can be found in the LICENSE file.
 //
 // This file has been modified for use by the TinyGo compiler.
+// src: https://github.com/golang/go/blob/61bb56ad/src/testing/benchmark.go
 
 package testing
 
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+	_ "unsafe" // for go:linkname
+)
+
+// Benchmark flags, see the flag variables in testing.go.
+var (
+	flagBenchRegexp string                              // -test.bench
+	flagBenchTime   = benchTimeFlag{d: 1 * time.Second} // -test.benchtime
+
+	// benchFilter contains the compiled -test.bench regexp, one for each
+	// level of sub-benchmarks.
+	benchFilter []*regexp.Regexp
+
+	// benchMaxLen is the width of the benchmark name column.
+	benchMaxLen int
+)
+
+// runtimeNanotime returns the current time in nanoseconds, as measured by the
+// ticks() function of the runtime.
+//go:linkname runtimeNanotime runtime.nanotime
+func runtimeNanotime() int64
+
+// benchTimeFlag is the value of the -test.benchtime flag: either a duration
+// (like 1s) or a number of iterations (like 100x).
+type benchTimeFlag struct {
+	d time.Duration
+	n int
+}
+
+func (f *benchTimeFlag) String() string {
+	if f.n > 0 {
+		return fmt.Sprintf("%dx", f.n)
+	}
+	return time.Duration(f.d).String()
+}
+
+func (f *benchTimeFlag) Set(s string) error {
+	if strings.HasSuffix(s, "x") {
+		n, err := strconv.ParseInt(s[:len(s)-1], 10, 0)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid count")
+		}
+		*f = benchTimeFlag{n: int(n)}
+		return nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid duration")
+	}
+	*f = benchTimeFlag{d: d}
+	return nil
+}
+
+// BenchmarkToCall is a reference to a benchmark that should be called during a
+// test suite run.
+type BenchmarkToCall struct {
+	// Name of the benchmark to call.
+	Name string
+	// Function reference to the benchmark.
+	Func func(*B)
+}
+
 // B is a type passed to Benchmark functions to manage benchmark timing and to
 // specify the number of iterations to run.
 //
-// TODO: Implement benchmarks. This struct allows test files containing
-// benchmarks to compile and run, but will not run the benchmarks themselves.
+// A benchmark ends when its Benchmark function returns or calls any of the methods
+// FailNow, Fatal, Fatalf, SkipNow, Skip, or Skipf. Those methods must be called
+// only from the goroutine running the Benchmark function.
+// The other reporting methods, such as the variations of Log and Error,
+// may be called simultaneously from multiple goroutines.
+//
+// Like in tests, benchmark logs are accumulated during execution
+// and dumped to standard output when done. Unlike in tests, benchmark logs
+// are always printed, so as not to hide output whose existence may be
+// affecting benchmark results.
 type B struct {
 	common
-	N int
+	N         int
+	benchFunc func(b *B)
+	benchTime benchTimeFlag
+	bytes     int64
+	timerOn   bool
+	result    BenchmarkResult
+
+	// The time at which the timer was last started, in nanoseconds.
+	startNanos int64
+
+	// The initial states of memStats.Mallocs and memStats.TotalAlloc.
+	startAllocs uint64
+	startBytes  uint64
+	// The net total of this test after being run.
+	netAllocs uint64
+	netBytes  uint64
+}
+
+var memStats runtime.MemStats
+
+// StartTimer starts timing a test. This function is called automatically
+// before a benchmark starts, but it can also be used to resume timing after
+// a call to StopTimer.
+func (b *B) StartTimer() {
+	if !b.timerOn {
+		runtime.ReadMemStats(&memStats)
+		b.startAllocs = memStats.Mallocs
+		b.startBytes = memStats.TotalAlloc
+		b.startNanos = runtimeNanotime()
+		b.timerOn = true
+	}
+}
+
+// StopTimer stops timing a test. This can be used to pause the timer
+// while performing complex initialization that you don't
+// want to measure.
+func (b *B) StopTimer() {
+	if b.timerOn {
+		b.duration += time.Duration(runtimeNanotime() - b.startNanos)
+		runtime.ReadMemStats(&memStats)
+		b.netAllocs += memStats.Mallocs - b.startAllocs
+		b.netBytes += memStats.TotalAlloc - b.startBytes
+		b.timerOn = false
+	}
+}
+
+// ResetTimer zeroes the elapsed benchmark time and memory allocation counters
+// and deletes user-reported metrics.
+// It does not affect whether the timer is running.
+func (b *B) ResetTimer() {
+	if b.timerOn {
+		runtime.ReadMemStats(&memStats)
+		b.startAllocs = memStats.Mallocs
+		b.startBytes = memStats.TotalAlloc
+		b.startNanos = runtimeNanotime()
+	}
+	b.duration = 0
+	b.netAllocs = 0
+	b.netBytes = 0
+}
+
+// SetBytes records the number of bytes processed in a single operation.
+// If this is called, the benchmark will report ns/op and MB/s.
+func (b *B) SetBytes(n int64) { b.bytes = n }
+
+// ReportAllocs enables malloc statistics for this benchmark.
+//
+// In TinyGo, malloc statistics are always reported, so this is a no-op.
+func (b *B) ReportAllocs() {
+}
+
+// runN runs a single benchmark for the specified number of iterations.
+func (b *B) runN(n int) {
+	// Try to get a comparable environment for each run
+	// by clearing garbage from previous runs.
+	runtime.GC()
+	b.N = n
+	b.ResetTimer()
+	b.StartTimer()
+	b.benchFunc(b)
+	b.StopTimer()
+}
+
+func min(x, y int64) int64 {
+	if x > y {
+		return y
+	}
+	return x
+}
+
+func max(x, y int64) int64 {
+	if x < y {
+		return y
+	}
+	return x
+}
+
+// doBench runs the benchmark function once to find out whether it has
+// sub-benchmarks. If it doesn't, it is run again with an increasing b.N until
+// it runs long enough to be timed reliably. It is run in a separate
+// goroutine if possible, so that FailNow and SkipNow can stop it.
+func (b *B) doBench() {
+	b.runN(1)
+	if !b.hasSub {
+		fmt.Fprintf(b.root().w, "%-*s\t", benchMaxLen, b.name)
+		b.launch()
+	}
+	b.finished = true
+	b.done()
+}
+
+// launch runs the benchmark function with an increasing b.N until the
+// benchmark runs for at least the -test.benchtime duration, or for exactly the
+// given number of iterations.
+func (b *B) launch() {
+	if b.benchTime.n > 0 {
+		b.runN(b.benchTime.n)
+	} else {
+		d := b.benchTime.d
+		for n := int64(1); !b.failed && b.duration < d && n < 1e9; {
+			last := n
+			// Predict required iterations.
+			goalns := d.Nanoseconds()
+			prevIters := int64(b.N)
+			prevns := b.duration.Nanoseconds()
+			if prevns <= 0 {
+				// Round up, to avoid div by zero.
+				prevns = 1
+			}
+			// Order of operations matters.
+			// For very fast benchmarks, prevIters ~= prevns.
+			// If you divide first, you get 0 or 1,
+			// which can hide an order of magnitude in execution time.
+			// So multiply first, then divide.
+			n = goalns * prevIters / prevns
+			// Run more iterations than we think we'll need (1.2x).
+			n += n / 5
+			// Don't grow too fast in case we had timing errors previously.
+			n = min(n, 100*last)
+			// Be sure to run at least one more than last time.
+			n = max(n, last+1)
+			// Don't run more than 1e9 times. (This also keeps n in int range on 32 bit platforms.)
+			n = min(n, 1e9)
+			b.runN(int(n))
+		}
+	}
+	b.result = BenchmarkResult{b.N, b.duration, b.bytes, b.netAllocs, b.netBytes}
+}
+
+// Run benchmarks f as a subbenchmark with the given name. It reports
+// whether there were any failures.
+//
+// A subbenchmark is like any other benchmark. A benchmark that calls Run at
+// least once will not be measured itself and will be called once with N=1.
+func (b *B) Run(name string, f func(b *B)) bool {
+	b.hasSub = true
+	benchName, ok := b.fullName(name, benchFilter)
+	if !ok {
+		return true
+	}
+	b.ran = true
+	if n := len(benchName) + 1; n > benchMaxLen {
+		benchMaxLen = n + 8 // Add additional slack to avoid too many jumps in size.
+	}
+
+	sub := &B{
+		common: common{
+			name:   benchName,
+			parent: &b.common,
+			level:  b.level + 1,
+		},
+		benchFunc: f,
+		benchTime: b.benchTime,
+	}
+	sub.w = indenter{&sub.common}
+
+	sub.run()
+	if !sub.hasSub && !sub.failed && !sub.skipped {
+		fmt.Fprintln(b.root().w, sub.result.String()+"\t"+sub.result.MemString())
+	}
+	sub.report()
+	return !sub.failed
+}
+
+// report prints the output of the benchmark, if there is any.
+func (b *B) report() {
+	if b.failed {
+		b.flushToParent("--- FAIL: %s\n", b.name)
+	} else if b.skipped {
+		b.flushToParent("--- SKIP: %s\n", b.name)
+	} else if b.output.Len() > 0 {
+		b.flushToParent("--- BENCH: %s\n", b.name)
+	}
+}
+
+// runBenchmarks runs the benchmarks that match the -test.bench flag. It
+// returns whether all benchmarks passed.
+func runBenchmarks(benchmarks []BenchmarkToCall) bool {
+	if len(benchFilter) == 0 {
+		return true
+	}
+	for _, benchmark := range benchmarks {
+		if len(benchmark.Name) > benchMaxLen && benchFilter[0].MatchString(benchmark.Name) {
+			benchMaxLen = len(benchmark.Name)
+		}
+	}
+	root := &B{
+		common: common{
+			w: os.Stdout,
+		},
+		benchTime: flagBenchTime,
+	}
+	for _, benchmark := range benchmarks {
+		root.Run(benchmark.Name, benchmark.Func)
+	}
+	return !root.failed
+}
+
+// BenchmarkResult contains the results of a benchmark run.
+type BenchmarkResult struct {
+	N         int           // The number of iterations.
+	T         time.Duration // The total time taken.
+	Bytes     int64         // Bytes processed in one iteration.
+	MemAllocs uint64        // The total number of memory allocations.
+	MemBytes  uint64        // The total number of bytes allocated.
+}
+
+// NsPerOp returns the "ns/op" metric.
+func (r BenchmarkResult) NsPerOp() int64 {
+	if r.N <= 0 {
+		return 0
+	}
+	return r.T.Nanoseconds() / int64(r.N)
+}
+
+// mbPerSec returns the "MB/s" metric.
+func (r BenchmarkResult) mbPerSec() float64 {
+	if r.Bytes <= 0 || r.T <= 0 || r.N <= 0 {
+		return 0
+	}
+	return (float64(r.Bytes) * float64(r.N) / 1e6) / r.T.Seconds()
+}
+
+// AllocsPerOp returns the "allocs/op" metric,
+// which is calculated as r.MemAllocs / r.N.
+func (r BenchmarkResult) AllocsPerOp() int64 {
+	if r.N <= 0 {
+		return 0
+	}
+	return int64(r.MemAllocs) / int64(r.N)
+}
+
+// AllocedBytesPerOp returns the "B/op" metric,
+// which is calculated as r.MemBytes / r.N.
+func (r BenchmarkResult) AllocedBytesPerOp() int64 {
+	if r.N <= 0 {
+		return 0
+	}
+	return int64(r.MemBytes) / int64(r.N)
+}
+
+// String returns a summary of the benchmark results.
+// It follows the benchmark result line format from
+// https://golang.org/design/14313-benchmark-format, not including the
+// benchmark name.
+func (r BenchmarkResult) String() string {
+	mbs := r.mbPerSec()
+	mb := ""
+	if mbs != 0 {
+		mb = fmt.Sprintf("\t%7.2f MB/s", mbs)
+	}
+	nsop := r.NsPerOp()
+	ns := fmt.Sprintf("%10d ns/op", nsop)
+	if r.N > 0 && nsop < 100 {
+		// The format specifiers here make sure that
+		// the ones digits line up for all three possible formats.
+		if nsop < 10 {
+			ns = fmt.Sprintf("%13.2f ns/op", float64(r.T.Nanoseconds())/float64(r.N))
+		} else {
+			ns = fmt.Sprintf("%12.1f ns/op", float64(r.T.Nanoseconds())/float64(r.N))
+		}
+	}
+	return fmt.Sprintf("%8d\t%s%s", r.N, ns, mb)
+}
+
+// MemString returns r.AllocedBytesPerOp and r.AllocsPerOp in the same format as 'go test'.
+func (r BenchmarkResult) MemString() string {
+	return fmt.Sprintf("%8d B/op\t%8d allocs/op",
+		r.AllocedBytesPerOp(), r.AllocsPerOp())
 }
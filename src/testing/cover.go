@@ -0,0 +1,68 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file has been modified for use by the TinyGo compiler.
+
+package testing
+
+import (
+	"fmt"
+)
+
+// Marker lines around the coverage profile in the output of the test binary.
+// Test binaries usually can't write files (for example when running in an
+// emulator), so the profile is written to the standard output instead and
+// extracted from there by tinygo test.
+const (
+	coverProfileStart = "--- tinygo coverprofile start"
+	coverProfileEnd   = "--- tinygo coverprofile end"
+)
+
+// Coverage data, filled in by the compiler when building with -cover. There is
+// an entry in coverBlocks for each block of consecutive statements that are
+// executed together, sorted by position. Blocks that are executed by the same
+// basic block share a counter.
+var (
+	coverCounters []uint32
+	coverBlocks   []coverBlock
+)
+
+// coverBlock is a block of statements, as in the coverage profile.
+type coverBlock struct {
+	file     string
+	line0    uint32
+	col0     uint32
+	line1    uint32
+	col1     uint32
+	numStmts uint32
+	counter  uint32 // index in coverCounters
+}
+
+// coverReport prints the percentage of covered statements and, with
+// -test.coverprofile, the coverage profile.
+func coverReport() {
+	if len(coverBlocks) == 0 {
+		return // not built with -cover
+	}
+
+	if flagCoverProfile != "" {
+		fmt.Println(coverProfileStart)
+		fmt.Println("mode: count")
+	}
+	var total, active int
+	for _, block := range coverBlocks {
+		count := coverCounters[block.counter]
+		total += int(block.numStmts)
+		if count > 0 {
+			active += int(block.numStmts)
+		}
+		if flagCoverProfile != "" {
+			fmt.Printf("%s:%d.%d,%d.%d %d %d\n", block.file, block.line0, block.col0, block.line1, block.col1, block.numStmts, count)
+		}
+	}
+	if flagCoverProfile != "" {
+		fmt.Println(coverProfileEnd)
+	}
+	fmt.Printf("coverage: %.1f%% of statements\n", 100*float64(active)/float64(total))
+}
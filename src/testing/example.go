@@ -0,0 +1,96 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file has been modified for use by the TinyGo compiler.
+// src: https://github.com/golang/go/blob/61bb56ad/src/testing/example.go
+
+package testing
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	_ "unsafe" // for go:linkname
+)
+
+// ExampleToCall is a reference to an example that should be called during a
+// test suite run.
+type ExampleToCall struct {
+	// Name of the example to call.
+	Name string
+	// Function reference to the example.
+	Func func()
+	// Output is the expected output, from the // Output: comment.
+	Output string
+	// Unordered is set for a // Unordered output: comment.
+	Unordered bool
+}
+
+// startCapture starts capturing everything written to the standard output.
+//go:linkname startCapture runtime.startCapture
+func startCapture()
+
+// stopCapture stops capturing the standard output and returns the captured
+// output.
+//go:linkname stopCapture runtime.stopCapture
+func stopCapture() string
+
+// runExamples runs the examples matching the -test.run flag. It returns
+// whether any examples were run and whether they all passed.
+func runExamples(examples []ExampleToCall) (ran, ok bool) {
+	ok = true
+	for _, eg := range examples {
+		if len(runFilter) != 0 && !runFilter[0].MatchString(eg.Name) {
+			continue
+		}
+		ran = true
+		if !runExample(eg) {
+			ok = false
+		}
+	}
+	return ran, ok
+}
+
+// runExample runs a single example, comparing its output to the expected
+// output.
+func runExample(eg ExampleToCall) (ok bool) {
+	if flagVerbose {
+		fmt.Printf("=== RUN   %s\n", eg.Name)
+	}
+
+	start := time.Now()
+	startCapture()
+	eg.Func()
+	// The runtime ends lines with "\r\n" (see printnl), normalize them the way
+	// go test does so that expected output can be written with plain newlines.
+	out := strings.Replace(stopCapture(), "\r\n", "\n", -1)
+	dstr := fmtDuration(time.Since(start))
+
+	var fail string
+	got := strings.TrimSpace(out)
+	want := strings.TrimSpace(eg.Output)
+	if eg.Unordered {
+		if sortLines(got) != sortLines(want) {
+			fail = fmt.Sprintf("got:\n%s\nwant (unordered):\n%s\n", out, eg.Output)
+		}
+	} else {
+		if got != want {
+			fail = fmt.Sprintf("got:\n%s\nwant:\n%s\n", got, want)
+		}
+	}
+	if fail != "" {
+		fmt.Printf("--- FAIL: %s (%s)\n%s", eg.Name, dstr, fail)
+	} else if flagVerbose {
+		fmt.Printf("--- PASS: %s (%s)\n", eg.Name, dstr)
+	}
+	return fail == ""
+}
+
+// sortLines sorts the lines of output, for comparing unordered output.
+func sortLines(output string) string {
+	lines := strings.Split(output, "\n")
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
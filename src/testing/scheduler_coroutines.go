@@ -0,0 +1,28 @@
+// +build scheduler.coroutines
+
+package testing
+
+// With the coroutine based scheduler, blocking functions can't be called
+// through a function pointer. Test functions are always called that way, so
+// tests can't be started in a separate goroutine and can't block. Instead,
+// tests are run directly, and FailNow and SkipNow can't stop a test.
+
+// run runs the test function.
+func (t *T) run(fn func(t *T)) {
+	tRunner(t, fn)
+}
+
+// run runs the benchmark.
+func (b *B) run() {
+	b.doBench()
+}
+
+// signalDone does nothing, as the parent test simply continues once the test
+// function returns.
+func (c *common) signalDone() {
+}
+
+// exit would stop the test, but a test can't be stopped without blocking. The
+// test continues to run until the test function returns.
+func (c *common) exit() {
+}
@@ -0,0 +1,37 @@
+// +build scheduler.tasks
+
+package testing
+
+import "runtime"
+
+// With the task based scheduler, every test runs in a separate goroutine, so
+// that FailNow and SkipNow can stop it with runtime.Goexit. The parent test
+// waits until it receives a signal that the test has finished.
+
+// run runs the test function in a new goroutine and waits until it is
+// finished.
+func (t *T) run(fn func(t *T)) {
+	t.signal = make(chan bool, 1)
+	go tRunner(t, fn)
+	<-t.signal
+}
+
+// run runs the benchmark in a new goroutine and waits until it is finished.
+func (b *B) run() {
+	b.signal = make(chan bool, 1)
+	go b.doBench()
+	<-b.signal
+}
+
+// signalDone signals to the parent test that this test has finished. The
+// channel is buffered, so that this never blocks the goroutine of the test.
+func (c *common) signalDone() {
+	c.signal <- true
+}
+
+// exit signals to the parent test that this test has finished and stops the
+// goroutine running the test.
+func (c *common) exit() {
+	c.done()
+	runtime.Goexit()
+}
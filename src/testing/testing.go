@@ -10,24 +10,56 @@ package testing
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Testing flags. Test binaries built by TinyGo usually don't have a command
+// line (for example when running on a microcontroller), so instead of using
+// the flag package the flags are passed in M.Args and parsed in M.Run.
+var (
+	flagVerbose   bool   // -test.v
+	flagRunRegexp string // -test.run
+
+	flagCoverProfile string // -test.coverprofile
+
+	// runFilter contains the compiled -test.run regexp, one for each level
+	// of subtests.
+	runFilter []*regexp.Regexp
 )
 
 // common holds the elements common between T and B and
 // captures common methods such as Errorf.
 type common struct {
-	output io.Writer
-
-	failed     bool   // Test or benchmark has failed.
-	skipped    bool   // Test of benchmark has been skipped.
-	finished   bool   // Test function has completed.
-	name       string // Name of test or benchmark.
+	output bytes.Buffer // Output generated by test or benchmark.
+	w      io.Writer    // For flushToParent.
+
+	ran      bool     // Test or benchmark (or one of its subtests) was executed.
+	failed   bool     // Test or benchmark has failed.
+	skipped  bool     // Test of benchmark has been skipped.
+	finished bool     // Test function has completed.
+	hasSub   bool     // Test has subtests.
+	cleanups []func() // Functions registered with Cleanup, in order of registration.
+
+	parent   *common
+	level    int            // Nesting depth of test or benchmark.
+	name     string         // Name of test or benchmark.
+	subNames map[string]int // Number of times each subtest name was used.
+	start    time.Time      // Time test or benchmark started
+	duration time.Duration
+	signal   chan bool // To signal a test is done (only with the task based scheduler).
 }
 
 // TB is the interface common to T and B.
 type TB interface {
+	Cleanup(func())
 	Error(args ...interface{})
 	Errorf(format string, args ...interface{})
 	Fail()
@@ -35,6 +67,7 @@ type TB interface {
 	Failed() bool
 	Fatal(args ...interface{})
 	Fatalf(format string, args ...interface{})
+	Helper()
 	Log(args ...interface{})
 	Logf(format string, args ...interface{})
 	Name() string
@@ -42,7 +75,6 @@ type TB interface {
 	SkipNow()
 	Skipf(format string, args ...interface{})
 	Skipped() bool
-	// Helper()
 }
 
 var _ TB = (*T)(nil)
@@ -62,6 +94,9 @@ func (c *common) Name() string {
 
 // Fail marks the function as having failed but continues execution.
 func (c *common) Fail() {
+	if c.parent != nil {
+		c.parent.Fail()
+	}
 	c.failed = true
 }
 
@@ -74,18 +109,48 @@ func (c *common) Failed() bool {
 // FailNow marks the function as having failed and stops its execution
 // by calling runtime.Goexit (which then runs all deferred calls in the
 // current goroutine).
+//
+// In TinyGo, deferred calls are not run by runtime.Goexit. Functions registered
+// with Cleanup are still run. With the coroutine scheduler the test can't be
+// stopped, see exit.
 func (c *common) FailNow() {
 	c.Fail()
-
 	c.finished = true
-	c.Error("FailNow is incomplete, requires runtime.Goexit()")
+	c.exit()
+}
+
+// done runs the cleanup functions and signals to the parent test that this
+// test has finished.
+func (c *common) done() {
+	c.runCleanup()
+	c.signalDone()
 }
 
 // log generates the output.
 func (c *common) log(s string) {
-	// This doesn't print the same as in upstream go, but works for now.
-	fmt.Fprintf(c.output, "\t")
-	fmt.Fprintln(c.output, s)
+	c.output.WriteString(c.decorate(s))
+}
+
+// decorate indents the log message and adds a final newline if needed. Unlike
+// upstream Go, the file and line number of the caller are not included as
+// TinyGo doesn't provide this information at runtime.
+func (c *common) decorate(s string) string {
+	buf := new(strings.Builder)
+	// Every line is indented at least 4 spaces.
+	buf.WriteString("    ")
+	lines := strings.Split(s, "\n")
+	if l := len(lines); l > 1 && lines[l-1] == "" {
+		lines = lines[:l-1]
+	}
+	for i, line := range lines {
+		if i > 0 {
+			// Second and subsequent lines are indented an additional 4 spaces.
+			buf.WriteString("\n        ")
+		}
+		buf.WriteString(line)
+	}
+	buf.WriteByte('\n')
+	return buf.String()
 }
 
 // Log formats its arguments using default formatting, analogous to Println,
@@ -138,11 +203,12 @@ func (c *common) Skipf(format string, args ...interface{}) {
 }
 
 // SkipNow marks the test as having been skipped and stops its execution
-// by calling runtime.Goexit.
+// by calling runtime.Goexit. With the coroutine scheduler the test can't be
+// stopped, see exit.
 func (c *common) SkipNow() {
 	c.skip()
 	c.finished = true
-	c.Error("SkipNow is incomplete, requires runtime.Goexit()")
+	c.exit()
 }
 
 func (c *common) skip() {
@@ -154,6 +220,185 @@ func (c *common) Skipped() bool {
 	return c.skipped
 }
 
+// Helper marks the calling function as a test helper function. In upstream Go,
+// this changes the file and line information printed in logs. TinyGo doesn't
+// print this information, so this is a no-op.
+func (c *common) Helper() {
+}
+
+// Cleanup registers a function to be called when the test (or subtest) and all
+// its subtests complete. Cleanup functions will be called in last added,
+// first called order.
+func (c *common) Cleanup(f func()) {
+	c.cleanups = append(c.cleanups, f)
+}
+
+// runCleanup calls the cleanup functions registered with Cleanup, in reverse
+// order. Cleanup functions that are registered while running the cleanup
+// functions are run as well.
+func (c *common) runCleanup() {
+	for len(c.cleanups) != 0 {
+		cleanup := c.cleanups[len(c.cleanups)-1]
+		c.cleanups = c.cleanups[:len(c.cleanups)-1]
+		cleanup()
+	}
+}
+
+// root returns the top-level common struct, which writes to the standard
+// output.
+func (c *common) root() *common {
+	root := c
+	for root.parent != nil {
+		root = root.parent
+	}
+	return root
+}
+
+// flushToParent writes the test result line and the output of this test to
+// the parent test (or the standard output for top-level tests).
+func (c *common) flushToParent(format string, args ...interface{}) {
+	p := c.parent
+	fmt.Fprintf(p.w, format, args...)
+	io.Copy(p.w, &c.output)
+	c.output.Reset()
+}
+
+// indenter writes the output of a subtest into the output of its parent,
+// indented by 4 spaces.
+type indenter struct {
+	c *common
+}
+
+func (w indenter) Write(b []byte) (n int, err error) {
+	n = len(b)
+	for len(b) > 0 {
+		end := bytes.IndexByte(b, '\n')
+		if end == -1 {
+			end = len(b)
+		} else {
+			end++
+		}
+		// An indent of 4 spaces will neatly align the dashes with the status
+		// indicator of the parent.
+		const indent = "    "
+		w.c.output.WriteString(indent)
+		w.c.output.Write(b[:end])
+		b = b[end:]
+	}
+	return
+}
+
+// Parallel signals that this test is to be run in parallel with (and only with)
+// other parallel tests.
+//
+// TinyGo runs all tests sequentially, so this is a no-op.
+func (t *T) Parallel() {
+}
+
+// fullName returns the full name of a subtest or sub-benchmark with the given
+// name, rewritten to be unique among its siblings, and whether it matches the
+// given filter (from -test.run or -test.bench).
+func (c *common) fullName(name string, filter []*regexp.Regexp) (string, bool) {
+	name = rewrite(name)
+	if c.subNames == nil {
+		c.subNames = make(map[string]int)
+	}
+	n := c.subNames[name]
+	c.subNames[name] = n + 1
+	if n > 0 {
+		name = fmt.Sprintf("%s#%02d", name, n)
+	}
+	matched := true
+	if c.level < len(filter) {
+		matched = filter[c.level].MatchString(name)
+	}
+	if c.name != "" {
+		name = c.name + "/" + name
+	}
+	return name, matched
+}
+
+// rewrite rewrites a subtest name, replacing spaces with underscores and
+// escaping unprintable characters.
+func rewrite(s string) string {
+	b := []byte{}
+	for _, r := range s {
+		switch {
+		case unicode.IsSpace(r):
+			b = append(b, '_')
+		case !strconv.IsPrint(r):
+			s := strconv.QuoteRune(r)
+			b = append(b, s[1:len(s)-1]...)
+		default:
+			b = append(b, string(r)...)
+		}
+	}
+	return string(b)
+}
+
+// Run runs f as a subtest of t called name. It waits until the subtest is
+// finished and returns whether it succeeded.
+//
+// Subtests are run sequentially, even when they call t.Parallel.
+func (t *T) Run(name string, f func(t *T)) bool {
+	t.hasSub = true
+	testName, ok := t.fullName(name, runFilter)
+	if !ok {
+		return true
+	}
+	t.ran = true
+
+	sub := &T{
+		common: common{
+			name:   testName,
+			parent: &t.common,
+			level:  t.level + 1,
+		},
+	}
+	sub.w = indenter{&sub.common}
+
+	if flagVerbose {
+		fmt.Fprintf(t.root().w, "=== RUN   %s\n", sub.name)
+	}
+
+	sub.start = time.Now()
+	sub.run(f)
+	sub.duration = time.Since(sub.start)
+	sub.report()
+	return !sub.failed
+}
+
+// tRunner runs a single test function and signals the parent test when it is
+// finished.
+func tRunner(t *T, fn func(t *T)) {
+	fn(t)
+	t.finished = true
+	t.done()
+}
+
+// report prints the result of the test, and its output if needed.
+func (t *T) report() {
+	if t.parent == nil {
+		return
+	}
+	dstr := fmtDuration(t.duration)
+	format := "--- %s: %s (%s)\n"
+	if t.Failed() {
+		t.flushToParent(format, "FAIL", t.name, dstr)
+	} else if flagVerbose {
+		if t.Skipped() {
+			t.flushToParent(format, "SKIP", t.name, dstr)
+		} else {
+			t.flushToParent(format, "PASS", t.name, dstr)
+		}
+	}
+}
+
+// fmtDuration returns a string representing d in the form "87.00s".
+func fmtDuration(d time.Duration) string {
+	return fmt.Sprintf("%.2fs", d.Seconds())
+}
+
 // TestToCall is a reference to a test that should be called during a test suite run.
 type TestToCall struct {
 	// Name of the test to call.
@@ -166,39 +411,168 @@ type TestToCall struct {
 type M struct {
 	// tests is a list of the test names to execute
 	Tests []TestToCall
+
+	// benchmarks is a list of the benchmarks to execute when -test.bench is
+	// set
+	Benchmarks []BenchmarkToCall
+
+	// examples is a list of the examples (with expected output) to execute
+	Examples []ExampleToCall
+
+	// Args contains the -test.* flags for this test suite, like -test.v and
+	// -test.run. They are parsed by Run.
+	Args []string
 }
 
 // Run the test suite.
 func (m *M) Run() int {
-	failures := 0
+	err := parseFlags(m.Args)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+
+	root := &T{
+		common: common{
+			w: os.Stdout,
+		},
+	}
 	for _, test := range m.Tests {
-		t := &T{
-			common: common{
-				name:   test.Name,
-				output: &bytes.Buffer{},
-			},
-		}
+		root.Run(test.Name, test.Func)
+	}
 
-		fmt.Printf("=== RUN   %s\n", test.Name)
-		test.Func(t)
+	exampleRan, exampleOk := runExamples(m.Examples)
 
-		if t.failed {
-			fmt.Printf("--- FAIL: %s\n", test.Name)
-		} else {
-			fmt.Printf("--- PASS: %s\n", test.Name)
+	if !root.ran && !exampleRan && flagBenchRegexp == "" {
+		fmt.Println("testing: warning: no tests to run")
+	}
+	if root.failed || !exampleOk || !runBenchmarks(m.Benchmarks) {
+		fmt.Println("FAIL")
+		coverReport()
+		return 1
+	}
+	fmt.Println("PASS")
+	coverReport()
+	return 0
+}
+
+// parseFlags parses the -test.* flags given in args. Flags may be given as
+// -flag=value or -flag value (for non-boolean flags), with one or two dashes.
+func parseFlags(args []string) error {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if len(arg) < 2 || arg[0] != '-' {
+			return fmt.Errorf("testing: unexpected argument: %s", arg)
+		}
+		name := strings.TrimPrefix(arg[1:], "-")
+		value := ""
+		hasValue := false
+		if eq := strings.IndexByte(name, '='); eq >= 0 {
+			name, value, hasValue = name[:eq], name[eq+1:], true
+		}
+		switch name {
+		case "test.v", "test.benchmem":
+			// Boolean flags.
+			v := true
+			if hasValue {
+				var err error
+				v, err = strconv.ParseBool(value)
+				if err != nil {
+					return fmt.Errorf("invalid boolean value %q for -%s", value, name)
+				}
+			}
+			if name == "test.v" {
+				flagVerbose = v
+			}
+			// Memory statistics are always reported, so -test.benchmem is
+			// accepted but ignored.
+		case "test.run", "test.bench", "test.benchtime", "test.coverprofile":
+			// Flags with a value.
+			if !hasValue {
+				if i+1 >= len(args) {
+					return errors.New("flag needs an argument: -" + name)
+				}
+				i++
+				value = args[i]
+			}
+			switch name {
+			case "test.run":
+				flagRunRegexp = value
+			case "test.bench":
+				flagBenchRegexp = value
+			case "test.coverprofile":
+				flagCoverProfile = value
+			case "test.benchtime":
+				if err := flagBenchTime.Set(value); err != nil {
+					return fmt.Errorf("invalid value %q for flag -%s: %s", value, name, err)
+				}
+			}
+		default:
+			return errors.New("flag provided but not defined: " + arg)
 		}
-		fmt.Println(t.output)
+	}
 
-		if t.failed {
-			failures++
+	var err error
+	runFilter, err = compileFilter(flagRunRegexp, "-test.run")
+	if err != nil {
+		return err
+	}
+	benchFilter, err = compileFilter(flagBenchRegexp, "-test.bench")
+	return err
+}
+
+// compileFilter compiles the regexp given in a -test.run or -test.bench flag,
+// one regexp per level of subtests. It returns nil for an empty regexp.
+func compileFilter(s, flagName string) ([]*regexp.Regexp, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var filter []*regexp.Regexp
+	for _, elem := range splitRegexp(s) {
+		re, err := regexp.Compile(elem)
+		if err != nil {
+			return nil, fmt.Errorf("testing: invalid regexp for %s: %s", flagName, err)
 		}
+		filter = append(filter, re)
 	}
+	return filter, nil
+}
 
-	if failures > 0 {
-		fmt.Printf("exit status %d\n", failures)
-		fmt.Println("FAIL")
+// splitRegexp splits the -test.run regexp into one regexp per level of
+// subtests. Slashes inside brackets and parentheses do not split the regexp.
+func splitRegexp(s string) []string {
+	a := make([]string, 0, strings.Count(s, "/"))
+	cs := 0
+	cp := 0
+	for i := 0; i < len(s); {
+		switch s[i] {
+		case '[':
+			cs++
+		case ']':
+			if cs--; cs < 0 { // An unmatched ']' is legal.
+				cs = 0
+			}
+		case '(':
+			if cs == 0 {
+				cp++
+			}
+		case ')':
+			if cs == 0 {
+				cp--
+			}
+		case '\\':
+			i++
+		case '/':
+			if cs == 0 && cp == 0 {
+				a = append(a, s[:i])
+				s = s[i+1:]
+				i = 0
+				continue
+			}
+		}
+		i++
 	}
-	return failures
+	return append(a, s)
 }
 
 func TestMain(m *M) {
@@ -210,6 +210,15 @@
 						mem().setUint32(nwritten_ptr, nwritten, true);
 						return 0;
 					},
+					proc_exit: (code) => {
+						if (global.process) {
+							// Node.js
+							process.exit(code);
+						} else {
+							// Can't exit in a browser.
+							throw 'trying to exit with code ' + code;
+						}
+					},
 				},
 				env: {
 					// func ticks() float64
@@ -0,0 +1,27 @@
+package coverage
+
+// Sign returns the sign of x.
+func Sign(x int) int {
+	if x < 0 {
+		return -1
+	} else if x > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Sum returns the sum of the positive numbers in xs.
+func Sum(xs []int) int {
+	total := 0
+	for _, x := range xs {
+		if Sign(x) > 0 {
+			total += x
+		}
+	}
+	return total
+}
+
+// Unused is never called by the tests.
+func Unused() {
+	println("unused")
+}
@@ -0,0 +1,9 @@
+package coverage
+
+import "testing"
+
+func TestSum(t *testing.T) {
+	if sum := Sum([]int{1, -2, 3}); sum != 4 {
+		t.Errorf("expected 4, got %d", sum)
+	}
+}
@@ -0,0 +1,13 @@
+package main
+
+// This program sleeps without starting any goroutines. With the tasks
+// scheduler, main.main must still be started as a goroutine, as sleeping
+// switches to the scheduler.
+
+import "time"
+
+func main() {
+	println("before sleep")
+	time.Sleep(time.Millisecond)
+	println("after sleep")
+}
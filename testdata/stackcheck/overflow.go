@@ -0,0 +1,42 @@
+package main
+
+// This program overflows the stack of a goroutine, which must be detected by
+// the stack check (-stack-check=canary or -stack-check=mpu). It only runs on
+// cortex-m-qemu, see TestStackCheck.
+
+import "time"
+
+func main() {
+	println("start")
+	go overflow()
+	time.Sleep(time.Millisecond)
+	println("stack overflow not detected")
+}
+
+func overflow() {
+	println(recurse(32))
+}
+
+// recurse uses at least 64 bytes of stack per call. The stack usage of a
+// recursive function is unknown, so the goroutine gets the default stack size,
+// which is too small for 32 calls.
+//go:noinline
+func recurse(n int) int {
+	var buf [16]int
+	for i := range buf {
+		buf[i] = n + i
+	}
+	if n == 0 {
+		return sum(&buf)
+	}
+	return recurse(n-1) + sum(&buf)
+}
+
+//go:noinline
+func sum(buf *[16]int) int {
+	total := 0
+	for _, n := range buf {
+		total += n
+	}
+	return total
+}
@@ -0,0 +1,48 @@
+package main
+
+// This program runs subtests that call FailNow and SkipNow, which must stop the
+// subtest but not its parent. Stopping a test needs the task based scheduler,
+// so this program only runs on cortex-m-qemu, see TestFailNow.
+
+import (
+	"os"
+	"testing"
+)
+
+func main() {
+	m := &testing.M{
+		Tests: []testing.TestToCall{
+			{Name: "TestSubtests", Func: TestSubtests},
+			{Name: "TestAfter", Func: TestAfter},
+		},
+		Args: []string{"-test.v"},
+	}
+	os.Exit(m.Run())
+}
+
+func TestSubtests(t *testing.T) {
+	t.Run("fail", func(t *testing.T) {
+		t.Cleanup(func() {
+			t.Log("cleanup")
+		})
+		t.Log("before FailNow")
+		t.FailNow()
+		t.Log("after FailNow")
+	})
+	t.Run("fatal", func(t *testing.T) {
+		t.Fatal("fatal error")
+		t.Log("after Fatal")
+	})
+	t.Run("skip", func(t *testing.T) {
+		t.Skip("skipped")
+		t.Error("after Skip")
+	})
+	t.Run("pass", func(t *testing.T) {
+		t.Log("pass")
+	})
+	t.Log("parent continues")
+}
+
+func TestAfter(t *testing.T) {
+	t.Log("next test")
+}
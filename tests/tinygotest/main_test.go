@@ -1,9 +1,15 @@
 package main
 
 import (
+	"os"
 	"testing" // This is the tinygo testing package
 )
 
+func TestMain(m *testing.M) {
+	println("setting up the test suite")
+	os.Exit(m.Run())
+}
+
 func TestFail1(t *testing.T) {
 	t.Error("TestFail1 failed because of stuff and things")
 }
@@ -21,5 +27,40 @@ func TestPass(t *testing.T) {
 	t.Log("TestPass passed")
 }
 
-func BenchmarkNotImplemented(b *testing.B) {
+func TestSubtests(t *testing.T) {
+	t.Cleanup(func() {
+		t.Log("TestSubtests cleanup")
+	})
+	t.Run("pass", func(t *testing.T) {
+		t.Helper()
+		t.Log("subtest passed")
+	})
+	t.Run("skip", func(t *testing.T) {
+		t.Skip("subtest skipped")
+		t.Error("unreachable")
+	})
+	t.Run("fail", func(t *testing.T) {
+		t.Fatal("subtest failed")
+	})
+}
+
+func BenchmarkAlloc(b *testing.B) {
+	var buf []byte
+	for i := 0; i < b.N; i++ {
+		buf = make([]byte, 16)
+	}
+	_ = buf
+}
+
+func ExampleHello() {
+	println("hello")
+	// Output: hello
+}
+
+func ExampleUnordered() {
+	println("b")
+	println("a")
+	// Unordered output:
+	// a
+	// b
 }
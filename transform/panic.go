@@ -17,7 +17,7 @@ func ReplacePanicsWithTrap(mod llvm.Module) {
 		trapType := llvm.FunctionType(ctx.VoidType(), nil, false)
 		trap = llvm.AddFunction(mod, "llvm.trap", trapType)
 	}
-	for _, name := range []string{"runtime._panic", "runtime.runtimePanic"} {
+	for _, name := range []string{"runtime._panic", "runtime.runtimePanic", "runtime.runtimePanicDetail"} {
 		fn := mod.NamedFunction(name)
 		if fn.IsNil() {
 			continue
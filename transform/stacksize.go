@@ -0,0 +1,53 @@
+package transform
+
+import (
+	"tinygo.org/x/go-llvm"
+)
+
+// CreateStackSizeLoads replaces calls to runtime.getGoroutineStackSize with the
+// stack size of the goroutine that is about to be started.
+//
+// Without automatic stack sizing, all goroutines get the same (default) stack
+// size. With automatic stack sizing, each goroutine start wrapper gets its own
+// global, named after the wrapper with a "$stacksize" suffix. These globals are
+// initialized to the default stack size and can be updated after linking, once
+// the worst-case stack usage of each goroutine is known. The stack size is
+// loaded from this global when starting the goroutine.
+func CreateStackSizeLoads(mod llvm.Module, defaultStackSize uint64, automatic bool) {
+	fn := mod.NamedFunction("runtime.getGoroutineStackSize")
+	if fn.IsNil() {
+		// The program doesn't start any goroutines.
+		return
+	}
+
+	ctx := mod.Context()
+	targetData := llvm.NewTargetData(mod.DataLayout())
+	defer targetData.Dispose()
+	uintptrType := ctx.IntType(targetData.PointerSize() * 8)
+	builder := ctx.NewBuilder()
+	defer builder.Dispose()
+
+	for _, call := range getUses(fn) {
+		stackSize := llvm.ConstInt(uintptrType, defaultStackSize, false)
+		wrapper := call.Operand(0)
+		if !wrapper.IsAConstantExpr().IsNil() && wrapper.Opcode() == llvm.PtrToInt {
+			wrapper = wrapper.Operand(0)
+		}
+		if automatic && !wrapper.IsAFunction().IsNil() {
+			name := wrapper.Name() + "$stacksize"
+			global := mod.NamedGlobal(name)
+			if global.IsNil() {
+				// The global must be externally visible so that it won't be
+				// optimized away and can be found in the symbol table after
+				// linking.
+				global = llvm.AddGlobal(mod, uintptrType, name)
+				global.SetInitializer(stackSize)
+			}
+			builder.SetInsertPointBefore(call)
+			stackSize = builder.CreateLoad(global, "")
+		}
+		call.ReplaceAllUsesWith(stackSize)
+		call.EraseFromParentAsInstruction()
+	}
+	fn.EraseFromParentAsFunction()
+}
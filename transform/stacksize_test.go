@@ -0,0 +1,14 @@
+package transform
+
+import (
+	"testing"
+
+	"tinygo.org/x/go-llvm"
+)
+
+func TestCreateStackSizeLoads(t *testing.T) {
+	t.Parallel()
+	testTransform(t, "testdata/stacksize", func(mod llvm.Module) {
+		CreateStackSizeLoads(mod, 1024, true)
+	})
+}
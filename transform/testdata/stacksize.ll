@@ -0,0 +1,26 @@
+target datalayout = "e-m:e-p:32:32-i64:64-v128:64:128-a:0:32-n32-S64"
+target triple = "armv7m-none-eabi"
+
+declare i32 @runtime.getGoroutineStackSize(i32, i8*, i8*)
+
+declare void @runtime.startGoroutine(i32, i32, i32, i8*, i8*)
+
+declare void @"main.worker"(i8*, i8*)
+
+define internal void @"main.worker$gowrapper"(i8*) {
+entry:
+  call void @"main.worker"(i8* undef, i8* undef)
+  ret void
+}
+
+; This is equivalent to the following code:
+;     go worker()
+;     go worker()
+define void @main.main() {
+entry:
+  %0 = call i32 @runtime.getGoroutineStackSize(i32 ptrtoint (void (i8*)* @"main.worker$gowrapper" to i32), i8* undef, i8* null)
+  call void @runtime.startGoroutine(i32 ptrtoint (void (i8*)* @"main.worker$gowrapper" to i32), i32 0, i32 %0, i8* undef, i8* null)
+  %1 = call i32 @runtime.getGoroutineStackSize(i32 ptrtoint (void (i8*)* @"main.worker$gowrapper" to i32), i8* undef, i8* null)
+  call void @runtime.startGoroutine(i32 ptrtoint (void (i8*)* @"main.worker$gowrapper" to i32), i32 0, i32 %1, i8* undef, i8* null)
+  ret void
+}
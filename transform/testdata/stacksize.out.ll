@@ -0,0 +1,23 @@
+target datalayout = "e-m:e-p:32:32-i64:64-v128:64:128-a:0:32-n32-S64"
+target triple = "armv7m-none-eabi"
+
+@"main.worker$gowrapper$stacksize" = global i32 1024
+
+declare void @runtime.startGoroutine(i32, i32, i32, i8*, i8*)
+
+declare void @main.worker(i8*, i8*)
+
+define internal void @"main.worker$gowrapper"(i8*) {
+entry:
+  call void @main.worker(i8* undef, i8* undef)
+  ret void
+}
+
+define void @main.main() {
+entry:
+  %0 = load i32, i32* @"main.worker$gowrapper$stacksize"
+  call void @runtime.startGoroutine(i32 ptrtoint (void (i8*)* @"main.worker$gowrapper" to i32), i32 0, i32 %0, i8* undef, i8* null)
+  %1 = load i32, i32* @"main.worker$gowrapper$stacksize"
+  call void @runtime.startGoroutine(i32 ptrtoint (void (i8*)* @"main.worker$gowrapper" to i32), i32 0, i32 %1, i8* undef, i8* null)
+  ret void
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/tinygo-org/tinygo/builder"
+)
+
+// UF2 implements the tinygo uf2 command, which inspects, verifies, converts
+// and merges UF2 files. The first argument is the action to perform.
+func UF2(args []string) error {
+	if len(args) == 0 {
+		return errors.New("uf2 requires an action: info, verify, convert or merge")
+	}
+	action := args[0]
+	flags := flag.NewFlagSet("uf2 "+action, flag.ExitOnError)
+	outpath := flags.String("o", "", "output filename")
+	family := flags.String("family", "", "UF2 family ID (convert: family to extract, merge: default family of new blocks)")
+	flags.Parse(args[1:])
+
+	switch action {
+	case "info", "verify":
+		if flags.NArg() != 1 {
+			return errors.New("uf2 " + action + " requires a single UF2 file")
+		}
+		if action == "info" {
+			return builder.PrintUF2Info(flags.Arg(0))
+		}
+		err := builder.VerifyUF2File(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		fmt.Println(flags.Arg(0) + ": OK")
+		return nil
+	case "convert":
+		if flags.NArg() != 1 || *outpath == "" {
+			return errors.New("usage: tinygo uf2 convert -o <file.bin|file.hex|file.srec> [-family=<id>] <file.uf2>")
+		}
+		return builder.ConvertUF2File(flags.Arg(0), *outpath, *family)
+	case "merge":
+		if flags.NArg() == 0 || *outpath == "" {
+			return errors.New("usage: tinygo uf2 merge -o <file.uf2> [-family=<id>] <input>[,addr=<address>][,family=<id>]...")
+		}
+		var inputs []builder.UF2Input
+		for _, arg := range flags.Args() {
+			input, err := parseUF2Input(arg, *family)
+			if err != nil {
+				return err
+			}
+			inputs = append(inputs, input)
+		}
+		return builder.MergeUF2Files(*outpath, inputs)
+	default:
+		return errors.New("unknown uf2 action: " + action)
+	}
+}
+
+// parseUF2Input parses an input argument of tinygo uf2 merge, in the form
+// path[,addr=<address>][,family=<id>]. The address is only used for .bin files.
+func parseUF2Input(arg, family string) (builder.UF2Input, error) {
+	parts := strings.Split(arg, ",")
+	input := builder.UF2Input{
+		Path:     parts[0],
+		FamilyID: family,
+	}
+	if _, err := os.Stat(input.Path); err != nil {
+		return input, err
+	}
+	for _, part := range parts[1:] {
+		i := strings.IndexByte(part, '=')
+		if i < 0 {
+			return input, errors.New("invalid uf2 input option: " + part)
+		}
+		key, value := part[:i], part[i+1:]
+		switch key {
+		case "addr":
+			addr, err := strconv.ParseUint(value, 0, 32)
+			if err != nil {
+				return input, errors.New("invalid address for " + input.Path + ": " + value)
+			}
+			input.Address = addr
+		case "family":
+			input.FamilyID = value
+		default:
+			return input, errors.New("invalid uf2 input option: " + part)
+		}
+	}
+	return input, nil
+}